@@ -0,0 +1,40 @@
+package classifier
+
+import (
+	"context"
+
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+var logger = logging.For(logging.Classifier)
+
+// Backfill classifies the torrents that were added before classification existed, batchSize at a
+// time, and returns how many it classified.
+func Backfill(ctx context.Context, database persistence.Database, batchSize int) (int, error) {
+	var n int
+	for {
+		torrents, err := database.GetUnclassifiedTorrents(ctx, batchSize)
+		if err != nil {
+			return n, err
+		}
+		if len(torrents) == 0 {
+			return n, nil
+		}
+
+		classified := make([]persistence.ClassifiedTorrent, len(torrents))
+		for i, torrent := range torrents {
+			classified[i] = persistence.ClassifiedTorrent{
+				ID:             torrent.ID,
+				ContentDetails: Classify(torrent.Name, torrent.Files),
+			}
+		}
+
+		if err = database.SetContentDetails(ctx, classified); err != nil {
+			return n, err
+		}
+
+		n += len(classified)
+		logger.Info("classified torrents", "count", n)
+	}
+}
@@ -0,0 +1,157 @@
+// Package classifier assigns torrents a content category, and detects the attributes of their
+// contents that their names reveal, such as the resolution of a video.
+package classifier
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// Content categories.
+const (
+	Video    = "video"
+	Audio    = "audio"
+	Ebook    = "ebook"
+	Software = "software"
+	Archive  = "archive"
+	Image    = "image"
+	Other    = "other"
+)
+
+// Categories lists every category Classify may assign, in the order they are offered to users.
+var Categories = []string{Video, Audio, Ebook, Software, Archive, Image, Other}
+
+// IsCategory reports whether s is one of Categories.
+func IsCategory(s string) bool {
+	for _, category := range Categories {
+		if s == category {
+			return true
+		}
+	}
+	return false
+}
+
+var extensionCategories = map[string]string{}
+
+func init() {
+	for category, extensions := range map[string][]string{
+		Video: {"mkv", "mp4", "m4v", "avi", "mov", "wmv", "webm", "flv", "mpg", "mpeg", "m2ts", "ts",
+			"vob", "ogv", "3gp", "rmvb"},
+		Audio: {"mp3", "flac", "ogg", "opus", "m4a", "m4b", "aac", "wav", "ape", "wv", "wma", "alac",
+			"dsf", "mka"},
+		Ebook: {"epub", "mobi", "azw", "azw3", "pdf", "djvu", "fb2", "cbz", "cbr", "lit"},
+		Software: {"exe", "msi", "dmg", "pkg", "apk", "deb", "rpm", "appimage", "iso", "img", "jar",
+			"bin"},
+		Archive: {"zip", "rar", "7z", "tar", "gz", "tgz", "bz2", "xz", "zst"},
+		Image: {"jpg", "jpeg", "png", "gif", "webp", "bmp", "tif", "tiff", "heic", "raw", "cr2",
+			"nef", "psd"},
+	} {
+		for _, extension := range extensions {
+			extensionCategories[extension] = category
+		}
+	}
+}
+
+var (
+	resolutionRegexp = regexp.MustCompile(`(?i)\b(2160p|1440p|1080p|1080i|720p|576p|480p|4k|uhd)\b`)
+	codecRegexps     = []struct {
+		codec  string
+		regexp *regexp.Regexp
+	}{
+		{"h265", regexp.MustCompile(`(?i)\b(x265|h\.?265|hevc)\b`)},
+		{"h264", regexp.MustCompile(`(?i)\b(x264|h\.?264|avc)\b`)},
+		{"av1", regexp.MustCompile(`(?i)\bav1\b`)},
+		{"vp9", regexp.MustCompile(`(?i)\bvp9\b`)},
+		{"xvid", regexp.MustCompile(`(?i)\bxvid\b`)},
+		{"divx", regexp.MustCompile(`(?i)\bdivx\b`)},
+	}
+	// S01E02, or 1x02; then S01 or "Season 1" alone for season packs.
+	episodeRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\bS(\d{1,2})[ ._-]?E(\d{1,3})\b`),
+		regexp.MustCompile(`(?i)\b(\d{1,2})x(\d{2,3})\b`),
+	}
+	seasonRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\bS(\d{1,2})\b`),
+		regexp.MustCompile(`(?i)\bSeason[ ._-]?(\d{1,2})\b`),
+	}
+)
+
+// Classify assigns the torrent of the given name and files the category that makes up most of its
+// size, and detects the attributes of its contents from its name. Torrents whose files have no
+// known extension are classified as Other.
+func Classify(name string, files []persistence.File) persistence.ContentDetails {
+	sizes := make(map[string]int64)
+	for _, file := range files {
+		if category, ok := extensionCategories[extension(file.Path)]; ok {
+			sizes[category] += file.Size
+		}
+	}
+
+	details := persistence.ContentDetails{Category: Other}
+	var largest int64 = -1
+	// Iterating over Categories rather than sizes breaks ties deterministically.
+	for _, category := range Categories {
+		if size, ok := sizes[category]; ok && size > largest {
+			details.Category, largest = category, size
+		}
+	}
+
+	if details.Category == Video {
+		details.Resolution = resolution(name)
+		details.Codec = codec(name)
+		details.Season, details.Episode = seasonAndEpisode(name)
+	}
+
+	return details
+}
+
+func extension(filePath string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+}
+
+func resolution(name string) string {
+	match := resolutionRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+
+	resolution := strings.ToLower(match[1])
+	if resolution == "4k" || resolution == "uhd" {
+		return "2160p"
+	}
+	return resolution
+}
+
+func codec(name string) string {
+	for _, c := range codecRegexps {
+		if c.regexp.MatchString(name) {
+			return c.codec
+		}
+	}
+	return ""
+}
+
+// seasonAndEpisode returns the season and episode numbers in name, or zero for those it does not
+// have.
+func seasonAndEpisode(name string) (int, int) {
+	for _, r := range episodeRegexps {
+		if match := r.FindStringSubmatch(name); match != nil {
+			season, _ := strconv.Atoi(match[1])
+			episode, _ := strconv.Atoi(match[2])
+			return season, episode
+		}
+	}
+
+	for _, r := range seasonRegexps {
+		if match := r.FindStringSubmatch(name); match != nil {
+			season, _ := strconv.Atoi(match[1])
+			return season, 0
+		}
+	}
+
+	return 0, 0
+}
@@ -0,0 +1,68 @@
+package classifier
+
+import (
+	"testing"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+func TestClassifyBySize(t *testing.T) {
+	files := []persistence.File{
+		{Path: "Movie/Movie.mkv", Size: 4 << 30},
+		{Path: "Movie/Movie.srt", Size: 100 << 10},
+		{Path: "Movie/cover.jpg", Size: 200 << 10},
+		{Path: "Movie/Movie.nfo", Size: 1 << 10},
+	}
+
+	if details := Classify("Movie", files); details.Category != Video {
+		t.Errorf("expected %q, got %q", Video, details.Category)
+	}
+}
+
+func TestClassifyCategories(t *testing.T) {
+	cases := map[string]string{
+		"album/01 - track.FLAC": Audio,
+		"book.epub":             Ebook,
+		"setup.exe":             Software,
+		"ubuntu-22.04.iso":      Software,
+		"backup.tar.gz":         Archive,
+		"photo.jpeg":            Image,
+		"README":                Other,
+		"notes.txt":             Other,
+	}
+
+	for path, expected := range cases {
+		details := Classify(path, []persistence.File{{Path: path, Size: 1}})
+		if details.Category != expected {
+			t.Errorf("expected %q for %q, got %q", expected, path, details.Category)
+		}
+	}
+}
+
+func TestClassifyVideoAttributes(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected persistence.ContentDetails
+	}{
+		{"Show.S02E05.1080p.WEB.x264-GROUP", persistence.ContentDetails{Resolution: "1080p", Codec: "h264", Season: 2, Episode: 5}},
+		{"Show 3x12 720p HEVC", persistence.ContentDetails{Resolution: "720p", Codec: "h265", Season: 3, Episode: 12}},
+		{"Show.Season.4.Complete.4K.AV1", persistence.ContentDetails{Resolution: "2160p", Codec: "av1", Season: 4}},
+		{"Show S01 COMPLETE", persistence.ContentDetails{Season: 1}},
+		{"Movie.1920x1080.2019", persistence.ContentDetails{}},
+	}
+
+	for _, c := range cases {
+		c.expected.Category = Video
+		details := Classify(c.name, []persistence.File{{Path: "video.mkv", Size: 1}})
+		if details != c.expected {
+			t.Errorf("expected %+v for %q, got %+v", c.expected, c.name, details)
+		}
+	}
+}
+
+func TestClassifyOnlyDetectsAttributesOfVideos(t *testing.T) {
+	details := Classify("Album.S01E01.1080p", []persistence.File{{Path: "track.mp3", Size: 1}})
+	if details != (persistence.ContentDetails{Category: Audio}) {
+		t.Errorf("expected no attributes, got %+v", details)
+	}
+}
@@ -1,62 +1,260 @@
 package crawler
 
 import (
-	"log"
+	"context"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/t-richards/magnetico/internal/classifier"
 	"github.com/t-richards/magnetico/internal/dht"
+	"github.com/t-richards/magnetico/internal/logging"
 	"github.com/t-richards/magnetico/internal/metadata"
 	"github.com/t-richards/magnetico/internal/persistence"
+	"github.com/t-richards/magnetico/internal/rules"
+	"github.com/t-richards/magnetico/internal/stats"
 )
 
+var logger = logging.For(logging.Crawler)
+
 type crawlerOpts struct {
 	IndexerAddrs        []string
 	IndexerInterval     time.Duration
 	IndexerMaxNeighbors uint
 
-	LeechMaxN int
+	LeechMaxN        int
+	LeechDeadline    time.Duration
+	LeechTimeouts    metadata.LeechTimeouts
+	LeechEncryption  metadata.EncryptionPolicy
+	LeechTransport   metadata.TransportStrategy
+	LeechUTPAddr     string
+	LeechQueueSize   int
+	LeechQueueMaxAge time.Duration
+
+	FailureCacheSize      int
+	FailureBackoffBase    time.Duration
+	FailureBackoffMax     time.Duration
+	FailureCachePersisted bool
+
+	RulesPath           string
+	RulesReloadInterval time.Duration
+
+	InfoHashFilterFalsePositiveRate float64
+
+	DatabaseBatchSize  int
+	DatabaseBatchDelay time.Duration
+	DatabaseMaxPending int
+	DatabaseBackoffMin time.Duration
+	DatabaseBackoffMax time.Duration
+	DatabaseMaxBusy    time.Duration
 }
 
-func Run(database *persistence.Database) {
+// Run crawls the DHT, adding the torrents it discovers to the database, until it is interrupted or
+// the database fails for good: it is corrupt, or has been busy for too long.
+func Run(database persistence.Database) error {
 	// Hardcoded options for now.
 	opts := crawlerOpts{
 		IndexerAddrs:        []string{"0.0.0.0:0"},
 		IndexerInterval:     1 * time.Second,
 		IndexerMaxNeighbors: 1000,
 		LeechMaxN:           50,
+		LeechDeadline:       5 * time.Second,
+		LeechTimeouts: metadata.LeechTimeouts{
+			Connect:   1 * time.Second,
+			Handshake: 2 * time.Second,
+			Piece:     2 * time.Second,
+		},
+		LeechEncryption:  metadata.PreferPlaintext,
+		LeechTransport:   metadata.PreferTCP,
+		LeechUTPAddr:     "0.0.0.0:0",
+		LeechQueueSize:   5000,
+		LeechQueueMaxAge: 10 * time.Minute,
+
+		FailureCacheSize:      100000,
+		FailureBackoffBase:    15 * time.Minute,
+		FailureBackoffMax:     24 * time.Hour,
+		FailureCachePersisted: true,
+
+		RulesPath:           rules.DefaultPath,
+		RulesReloadInterval: 30 * time.Second,
+
+		InfoHashFilterFalsePositiveRate: 0.01,
+
+		DatabaseBatchSize:  100,
+		DatabaseBatchDelay: 500 * time.Millisecond,
+		DatabaseMaxPending: 1000,
+		DatabaseBackoffMin: 100 * time.Millisecond,
+		DatabaseBackoffMax: 30 * time.Second,
+		DatabaseMaxBusy:    10 * time.Minute,
 	}
 
 	// Handle Ctrl-C gracefully.
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
 
+	var failureStore metadata.FailureStore
+	if opts.FailureCachePersisted {
+		failureStore = database
+	}
+	failureCache, err := metadata.NewFailureCache(opts.FailureCacheSize, opts.FailureBackoffBase, opts.FailureBackoffMax, failureStore)
+	if err != nil {
+		fatal("could not load the failure cache", "err", err)
+	}
+
+	if err = database.LoadInfoHashFilter(context.Background(), opts.InfoHashFilterFalsePositiveRate); err != nil {
+		fatal("could not load the info hash filter", "err", err)
+	}
+
+	rulesEngine, err := rules.NewEngine(opts.RulesPath, opts.RulesReloadInterval)
+	if err != nil {
+		fatal("could not load the rules", "path", opts.RulesPath, "err", err)
+	}
+
+	dialer, err := metadata.NewDialer(opts.LeechTransport, opts.LeechUTPAddr)
+	if err != nil {
+		fatal("could not create the leech dialer", "err", err)
+	}
+
 	trawlingManager := dht.NewManager(opts.IndexerAddrs, opts.IndexerInterval, opts.IndexerMaxNeighbors)
-	metadataSink := metadata.NewSink(5*time.Second, opts.LeechMaxN)
+	metadataSink := metadata.NewSink(opts.LeechDeadline, metadata.LeechOptions{
+		Timeouts:   opts.LeechTimeouts,
+		Encryption: opts.LeechEncryption,
+		Dialer:     dialer,
+	}, opts.LeechMaxN, opts.LeechQueueSize, opts.LeechQueueMaxAge, failureCache)
+	stats.Default.SetSink(func() stats.Sink {
+		sinkStats := metadataSink.Stats()
+		s := stats.Sink{
+			QueueLength:      sinkStats.QueueLength,
+			InFlight:         sinkStats.InFlight,
+			Queued:           sinkStats.Queued,
+			Merged:           sinkStats.Merged,
+			Dropped:          sinkStats.Dropped,
+			Expired:          sinkStats.Expired,
+			Fetches:          make(map[string]uint64, len(sinkStats.Fetches)),
+			EncryptedFetches: sinkStats.EncryptedFetches,
+			ExternalIP:       sinkStats.ExternalIP,
+		}
+		for transport, n := range sinkStats.Fetches {
+			s.Fetches[string(transport)] = n
+		}
+		for client, n := range sinkStats.Clients {
+			s.Clients = append(s.Clients, stats.ClientCount{Client: client, Succeeded: n.Succeeded, Failed: n.Failed})
+		}
+		return s
+	})
+	addNewTorrents := func(torrents []persistence.NewTorrent) (int, error) {
+		return database.AddNewTorrents(context.Background(), torrents)
+	}
+	databaseWriter := newWriter(addNewTorrents, opts.DatabaseBatchSize, opts.DatabaseBatchDelay,
+		opts.DatabaseMaxPending, opts.DatabaseBackoffMin, opts.DatabaseBackoffMax, opts.DatabaseMaxBusy)
+
+	terminate := func() {
+		trawlingManager.Terminate()
+		metadataSink.Terminate()
+		failureCache.Close()
+		rulesEngine.Terminate()
+		if err := dialer.Close(); err != nil {
+			logger.Error("could not close the leech dialer", "err", err)
+		}
+	}
 
 	// The "event loop".
 	for {
 		select {
 		case <-interruptChan:
-			trawlingManager.Terminate()
-			return
+			terminate()
+			// Write the last batch, giving the pending torrents a last chance.
+			if err := databaseWriter.Flush(); err != nil || len(databaseWriter.pending) > 0 {
+				logger.Warn("could not add the pending torrents to the database",
+					"pending", len(databaseWriter.pending), "err", err)
+			}
+			return nil
 
 		case result := <-trawlingManager.Output():
 			infoHash := result.InfoHash()
 
-			exists, err := database.DoesTorrentExist(infoHash[:])
+			// Do not waste leeches on info hashes that keep failing, or that we would not keep.
+			if failureCache.ShouldSkip(infoHash) || rulesEngine.MatchInfoHash(infoHash[:]) {
+				continue
+			}
+
+			known, err := isKnown(database, infoHash[:])
 			if err != nil {
-				log.Fatalf("Could not check whether torrent exists! %V", err)
-			} else if !exists {
+				terminate()
+				return err
+			}
+			if !known {
 				metadataSink.Sink(result)
 			}
 
 		case md := <-metadataSink.Drain():
-			if err := database.AddNewTorrent(md.InfoHash, md.Name, md.Files); err != nil {
-				log.Fatalf("Could not add new torrent to the database. %v", err)
+			if text, blocked := rulesEngine.Match(&persistence.TorrentFiles{
+				InfoHash: md.InfoHash,
+				Name:     md.Name,
+				Files:    md.Files,
+			}); blocked {
+				logger.Info("not indexing torrent as it matches a rule",
+					"infohash", hex.EncodeToString(md.InfoHash), "name", md.Name, "rule", text)
+				continue
+			}
+
+			err := databaseWriter.Write(persistence.NewTorrent{
+				InfoHash:       md.InfoHash,
+				InfoHashV2:     md.InfoHashV2,
+				Name:           md.Name,
+				Files:          md.Files,
+				Info:           md.Info,
+				TorrentDetails: md.TorrentDetails,
+				ContentDetails: classifier.Classify(md.Name, md.Files),
+			})
+			if err != nil {
+				terminate()
+				return fmt.Errorf("could not add the torrent to the database: %w", err)
+			}
+
+		case <-databaseWriter.Retry():
+			if err := databaseWriter.Flush(); err != nil {
+				terminate()
+				return fmt.Errorf("could not add the pending torrents to the database: %w", err)
 			}
 		}
 	}
 }
+
+// isKnown reports whether the torrent of the info hash need not be leeched: it is stored already, or
+// an admin deleted it, in which case it must not be indexed again. Once the info hash filter is
+// loaded, neither check queries the database about the info hashes that it rules out, which are
+// nearly all of those sampled.
+//
+// While the database is busy, it reports false so as to leech anyway: AddNewTorrents skips the
+// torrents that exist. Other errors cost us this info hash only, as it will be sighted again, and
+// it fails only if the database fails for good.
+func isKnown(database persistence.Database, infoHash []byte) (bool, error) {
+	known, err := database.DoesTorrentExist(context.Background(), infoHash)
+	if err == nil && !known {
+		known, err = database.IsTorrentDeleted(context.Background(), infoHash)
+	}
+
+	switch {
+	case err == nil:
+		return known, nil
+	case persistence.IsBusy(err):
+		logger.Debug("could not check whether the torrent exists",
+			"infohash", hex.EncodeToString(infoHash), "err", err)
+		return false, nil
+	case persistence.IsFatal(err):
+		return false, fmt.Errorf("could not check whether the torrent exists: %w", err)
+	default:
+		logger.Error("could not check whether the torrent exists",
+			"infohash", hex.EncodeToString(infoHash), "err", err)
+		return true, nil
+	}
+}
+
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,42 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+func TestIsKnown(t *testing.T) {
+	database := persistence.NewMemoryDatabase()
+	stored, deleted, unknown := make([]byte, 20), make([]byte, 20), make([]byte, 20)
+	stored[0], deleted[0], unknown[0] = 1, 2, 3
+	for _, infoHash := range [][]byte{stored, deleted} {
+		err := database.AddNewTorrent(context.Background(), persistence.NewTorrent{
+			InfoHash: infoHash,
+			Name:     "some torrent",
+			Files:    []persistence.File{{Path: "some file.txt", Size: 100}},
+		})
+		if err != nil {
+			t.Fatalf("could not add the torrent: %v", err)
+		}
+	}
+	if ok, err := database.DeleteTorrent(context.Background(), deleted, "alice"); !ok || err != nil {
+		t.Fatalf("could not delete the torrent: %v (%v)", ok, err)
+	}
+
+	// The deleted torrent is offered again, as the DHT keeps announcing it, but is not leeched.
+	for _, c := range []struct {
+		name     string
+		infoHash []byte
+		known    bool
+	}{
+		{"stored", stored, true},
+		{"deleted", deleted, true},
+		{"unknown", unknown, false},
+	} {
+		if known, err := isKnown(database, c.infoHash); known != c.known || err != nil {
+			t.Errorf("%s: expected %v, got %v (%v)", c.name, c.known, known, err)
+		}
+	}
+}
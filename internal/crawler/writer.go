@@ -0,0 +1,153 @@
+package crawler
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// writer adds torrents to the database in batches of up to batchSize, written at most batchDelay
+// after their first torrent. While the database is busy (locked by the web interface, say), it
+// holds on to them and retries with exponential backoff, so that their metadata is not lost.
+type writer struct {
+	add func([]persistence.NewTorrent) (int, error)
+
+	batchSize  int
+	batchDelay time.Duration
+	maxPending int
+	backoffMin time.Duration
+	backoffMax time.Duration
+	// maxBusy is how long the database may stay busy before the writer gives up on it.
+	maxBusy time.Duration
+
+	pending   []persistence.NewTorrent
+	backoff   time.Duration
+	busySince time.Time
+	retry     <-chan time.Time
+}
+
+func newWriter(add func([]persistence.NewTorrent) (int, error), batchSize int, batchDelay time.Duration,
+	maxPending int, backoffMin, backoffMax, maxBusy time.Duration) *writer {
+	w := new(writer)
+	w.add = add
+	w.batchSize = batchSize
+	w.batchDelay = batchDelay
+	w.maxPending = maxPending
+	w.backoffMin = backoffMin
+	w.backoffMax = backoffMax
+	w.maxBusy = maxBusy
+	return w
+}
+
+// Write queues the torrent, and writes the pending torrents if they make a full batch. It returns
+// an error only if the database is corrupt, or has been busy for longer than maxBusy; errors
+// specific to a torrent are logged, and the torrent dropped.
+func (w *writer) Write(torrent persistence.NewTorrent) error {
+	if len(w.pending) >= w.maxPending {
+		logger.Warn("dropping torrent as too many are waiting for the database",
+			"infohash", hex.EncodeToString(torrent.InfoHash), "pending", len(w.pending))
+		return nil
+	}
+	w.pending = append(w.pending, torrent)
+	metrics.DBPendingTorrents.Set(float64(len(w.pending)))
+
+	switch {
+	case w.backoff > 0:
+		// Wait for the retry, as the database is busy.
+		return nil
+	case len(w.pending) >= w.batchSize:
+		return w.Flush()
+	case w.retry == nil:
+		w.retry = time.After(w.batchDelay)
+	}
+	return nil
+}
+
+// Retry fires when the pending torrents should be written with Flush: once the batch delay has
+// elapsed, or the database may no longer be busy. It is nil, and so never fires, while no torrent
+// is pending.
+func (w *writer) Retry() <-chan time.Time {
+	return w.retry
+}
+
+// Flush writes the pending torrents, oldest first, until the database is busy.
+func (w *writer) Flush() error {
+	w.retry = nil
+	defer func() { metrics.DBPendingTorrents.Set(float64(len(w.pending))) }()
+
+	for len(w.pending) > 0 {
+		batch := w.pending[:min(len(w.pending), w.batchSize)]
+		_, err := w.add(batch)
+		switch {
+		case err == nil:
+
+		case retryable(err):
+			return w.retryLater(err)
+
+		case persistence.IsFatal(err):
+			return err
+
+		case len(batch) > 1:
+			// As the batch was rolled back, find out which of its torrents failed by writing them
+			// one by one.
+			if err = w.addOneByOne(batch); retryable(err) {
+				return w.retryLater(err)
+			} else if err != nil {
+				return err
+			}
+
+		default:
+			logger.Error("could not add the torrent to the database",
+				"infohash", hex.EncodeToString(batch[0].InfoHash), "err", err)
+		}
+
+		clear(batch) // let the metadata be garbage collected
+		w.pending = w.pending[len(batch):]
+		w.backoff = 0
+		w.busySince = time.Time{}
+	}
+
+	return nil
+}
+
+// retryLater schedules the next retry while the database is busy, unless it has been for longer
+// than maxBusy.
+func (w *writer) retryLater(err error) error {
+	now := time.Now()
+	if w.busySince.IsZero() {
+		w.busySince = now
+	} else if now.Sub(w.busySince) > w.maxBusy {
+		return fmt.Errorf("database busy for %s: %w", now.Sub(w.busySince).Round(time.Second), err)
+	}
+
+	w.backoff = min(max(2*w.backoff, w.backoffMin), w.backoffMax)
+	w.retry = time.After(w.backoff)
+	logger.Warn("database busy, will retry", "pending", len(w.pending), "backoff", w.backoff, "err", err)
+	return nil
+}
+
+// addOneByOne writes the torrents in their own transactions, dropping those that fail. It returns
+// an error only if the database is busy (or timed out) or corrupt, so that the torrents are written again as a
+// batch later on; which may write some of them twice, a no-op.
+func (w *writer) addOneByOne(torrents []persistence.NewTorrent) error {
+	for i := range torrents {
+		if _, err := w.add(torrents[i : i+1]); retryable(err) || persistence.IsFatal(err) {
+			return err
+		} else if err != nil {
+			logger.Error("could not add the torrent to the database",
+				"infohash", hex.EncodeToString(torrents[i].InfoHash), "err", err)
+		}
+	}
+	return nil
+}
+
+// retryable reports whether err is due to the database being busy, or so slow that the write timed
+// out, in which case the torrents are worth writing again later.
+func retryable(err error) bool {
+	return persistence.IsBusy(err) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,143 @@
+package crawler
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// busyError returns the error SQLite fails with when the database is locked by another connection.
+func busyError(t *testing.T) error {
+	filename := filepath.Join(t.TempDir(), "magnetico.db")
+	locker, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	t.Cleanup(func() { locker.Close() })
+	tx, err := locker.Begin()
+	if err != nil {
+		t.Fatalf("could not begin a transaction: %v", err)
+	}
+	t.Cleanup(func() { _ = tx.Rollback() })
+	if _, err = tx.Exec("CREATE TABLE t (x);"); err != nil {
+		t.Fatalf("could not take the write lock: %v", err)
+	}
+
+	conn, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE u (x);")
+	if !persistence.IsBusy(err) {
+		t.Fatalf("expected a busy error, got %v", err)
+	}
+	return err
+}
+
+// fakeDatabase fails with err while it is set, fails batches that include a torrent named "bad",
+// and records the torrents added otherwise.
+type fakeDatabase struct {
+	err     error
+	batches int
+	added   []string
+}
+
+func (db *fakeDatabase) add(torrents []persistence.NewTorrent) (int, error) {
+	if db.err != nil {
+		return 0, db.err
+	}
+	for _, torrent := range torrents {
+		if torrent.Name == "bad" {
+			return 0, errors.New("CHECK constraint failed")
+		}
+	}
+	db.batches++
+	for _, torrent := range torrents {
+		db.added = append(db.added, torrent.Name)
+	}
+	return len(torrents), nil
+}
+
+func write(t *testing.T, w *writer, names ...string) {
+	for _, name := range names {
+		if err := w.Write(persistence.NewTorrent{Name: name}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestWriterBatches(t *testing.T) {
+	db := new(fakeDatabase)
+	w := newWriter(db.add, 2, time.Millisecond, 10, time.Millisecond, time.Millisecond, time.Hour)
+
+	write(t, w, "a", "b", "c")
+	if db.batches != 1 || len(db.added) != 2 {
+		t.Fatalf("expected a full batch to be written straight away, got %q", db.added)
+	}
+
+	// The last torrent is written once the batch delay elapses.
+	<-w.Retry()
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if db.batches != 2 || len(db.added) != 3 || db.added[2] != "c" {
+		t.Errorf("expected the partial batch to be written, got %q", db.added)
+	}
+	if len(w.pending) != 0 || w.Retry() != nil {
+		t.Errorf("expected no torrents to be pending")
+	}
+}
+
+func TestWriterRetriesWhileBusy(t *testing.T) {
+	db := &fakeDatabase{err: busyError(t)}
+	w := newWriter(db.add, 1, time.Millisecond, 2, time.Millisecond, time.Millisecond, time.Hour)
+
+	write(t, w, "a", "b", "c")
+	if len(db.added) != 0 || len(w.pending) != 2 {
+		t.Fatalf("expected 2 torrents to be pending (and the third dropped), got %d", len(w.pending))
+	}
+	if w.Retry() == nil {
+		t.Fatalf("expected a retry to be scheduled")
+	}
+
+	db.err = nil
+	<-w.Retry()
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(db.added) != 2 || db.added[0] != "a" || db.added[1] != "b" {
+		t.Errorf("expected the pending torrents to be added in order, got %q", db.added)
+	}
+	if len(w.pending) != 0 || w.Retry() != nil {
+		t.Errorf("expected no torrents to be pending")
+	}
+}
+
+func TestWriterGivesUpWhenBusyForTooLong(t *testing.T) {
+	db := &fakeDatabase{err: busyError(t)}
+	w := newWriter(db.add, 1, time.Millisecond, 10, time.Millisecond, time.Millisecond, 0)
+
+	write(t, w, "a")
+	<-w.Retry()
+	if err := w.Flush(); !persistence.IsBusy(err) {
+		t.Errorf("expected the busy error to be returned, got %v", err)
+	}
+}
+
+func TestWriterDropsTorrentsThatFail(t *testing.T) {
+	db := new(fakeDatabase)
+	w := newWriter(db.add, 3, time.Millisecond, 10, time.Millisecond, time.Millisecond, time.Hour)
+
+	write(t, w, "a", "bad", "c")
+	if len(db.added) != 2 || db.added[0] != "a" || db.added[1] != "c" {
+		t.Errorf("expected the other torrents of the batch to be added, got %q", db.added)
+	}
+	if len(w.pending) != 0 || w.Retry() != nil {
+		t.Errorf("expected the torrent to be dropped rather than retried")
+	}
+}
@@ -2,10 +2,14 @@ package mainline
 
 import (
 	"crypto/rand"
-	"log"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+	"github.com/t-richards/magnetico/internal/stats"
 )
 
 var (
@@ -27,6 +31,8 @@ type IndexingService struct {
 	routingTable      map[string]*net.UDPAddr
 	routingTableMutex sync.RWMutex
 	maxNeighbors      uint
+	address           string
+	routingTableSize  prometheus.Gauge
 
 	counter          uint16
 	getPeersRequests map[[2]byte][20]byte // GetPeersQuery.`t` -> infohash
@@ -63,6 +69,8 @@ func NewIndexingService(laddr string, interval time.Duration, maxNeighbors uint,
 	service.nodeID = make([]byte, 20)
 	service.routingTable = make(map[string]*net.UDPAddr)
 	service.maxNeighbors = maxNeighbors
+	service.address = laddr
+	service.routingTableSize = metrics.RoutingTableSize.WithLabelValues(laddr)
 	service.eventHandlers = eventHandlers
 
 	service.getPeersRequests = make(map[[2]byte][20]byte)
@@ -72,7 +80,7 @@ func NewIndexingService(laddr string, interval time.Duration, maxNeighbors uint,
 
 func (is *IndexingService) Start() {
 	if is.started {
-		log.Panicln("Attempting to Start() a mainline/IndexingService that has been already started! (Programmer error.)")
+		panic("Attempting to Start() a mainline/IndexingService that has been already started! (Programmer error.)")
 	}
 	is.started = true
 
@@ -96,6 +104,7 @@ func (is *IndexingService) index() {
 			is.findNeighbors()
 			is.routingTableMutex.Lock()
 			is.routingTable = make(map[string]*net.UDPAddr)
+			is.reportRoutingTableSize()
 			is.routingTableMutex.Unlock()
 		}
 	}
@@ -112,12 +121,12 @@ func (is *IndexingService) bootstrap() {
 		target := make([]byte, 20)
 		_, err := rand.Read(target)
 		if err != nil {
-			log.Panicln("Could NOT generate random bytes during bootstrapping!")
+			panic("Could NOT generate random bytes during bootstrapping! " + err.Error())
 		}
 
 		addr, err := net.ResolveUDPAddr("udp", node)
 		if err != nil {
-			log.Printf("Could NOT resolve (UDP) address of the bootstrapping node! %s", node)
+			dhtLogger.Warn("could not resolve the address of a bootstrapping node", "node", node, "err", err)
 			continue
 		}
 
@@ -143,7 +152,7 @@ func (is *IndexingService) findNeighbors() {
 	for _, addr := range addressesToSend {
 		_, err := rand.Read(target)
 		if err != nil {
-			log.Panicln("Could NOT generate random bytes during bootstrapping!")
+			panic("Could NOT generate random bytes during bootstrapping! " + err.Error())
 		}
 
 		is.protocol.SendMessage(
@@ -156,6 +165,7 @@ func (is *IndexingService) findNeighbors() {
 func (is *IndexingService) onFindNodeResponse(response *Message, addr *net.UDPAddr) {
 	is.routingTableMutex.Lock()
 	defer is.routingTableMutex.Unlock()
+	defer is.reportRoutingTableSize()
 
 	for _, node := range response.R.Nodes {
 		if uint(len(is.routingTable)) >= is.maxNeighbors {
@@ -170,7 +180,7 @@ func (is *IndexingService) onFindNodeResponse(response *Message, addr *net.UDPAd
 		target := make([]byte, 20)
 		_, err := rand.Read(target)
 		if err != nil {
-			log.Panicln("Could NOT generate random bytes!")
+			panic("Could NOT generate random bytes! " + err.Error())
 		}
 		is.protocol.SendMessage(
 			NewSampleInfohashesQuery(is.nodeID, []byte("aa"), target),
@@ -179,6 +189,12 @@ func (is *IndexingService) onFindNodeResponse(response *Message, addr *net.UDPAd
 	}
 }
 
+// reportRoutingTableSize must be called with routingTableMutex held.
+func (is *IndexingService) reportRoutingTableSize() {
+	is.routingTableSize.Set(float64(len(is.routingTable)))
+	stats.Default.SetRoutingTableSize(is.address, len(is.routingTable))
+}
+
 func (is *IndexingService) onGetPeersResponse(msg *Message, addr *net.UDPAddr) {
 	var t [2]byte
 	copy(t[:], msg.T)
@@ -240,6 +256,7 @@ func (is *IndexingService) onSampleInfohashesResponse(msg *Message, addr *net.UD
 	// iterate
 	is.routingTableMutex.Lock()
 	defer is.routingTableMutex.Unlock()
+	defer is.reportRoutingTableSize()
 	for _, node := range msg.R.Nodes {
 		if uint(len(is.routingTable)) >= is.maxNeighbors {
 			break
@@ -254,7 +271,7 @@ func (is *IndexingService) onSampleInfohashesResponse(msg *Message, addr *net.UD
 			target := make([]byte, 20)
 			_, err := rand.Read(target)
 			if err != nil {
-				log.Panicln("Could NOT generate random bytes!")
+				panic("Could NOT generate random bytes! " + err.Error())
 			}
 			is.protocol.SendMessage(
 				NewSampleInfohashesQuery(is.nodeID, []byte("aa"), target),
@@ -3,16 +3,23 @@ package mainline
 import (
 	"crypto/rand"
 	"crypto/sha1"
-	"log"
 	"net"
 	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/metrics"
+	"github.com/t-richards/magnetico/internal/stats"
 	"github.com/t-richards/magnetico/internal/util"
 )
 
+var (
+	dhtLogger       = logging.For(logging.DHT)
+	transportLogger = logging.For(logging.Transport)
+)
+
 type Protocol struct {
 	previousTokenSecret, currentTokenSecret []byte
 	tokenLock                               sync.Mutex
@@ -50,7 +57,7 @@ func NewProtocol(laddr string, eventHandlers ProtocolEventHandlers) (p *Protocol
 	p.currentTokenSecret, p.previousTokenSecret = make([]byte, 20), make([]byte, 20)
 	_, err := rand.Read(p.currentTokenSecret)
 	if err != nil {
-		log.Fatalln("Could NOT generate random bytes for token secret!")
+		panic("Could NOT generate random bytes for token secret! " + err.Error())
 	}
 	copy(p.previousTokenSecret, p.currentTokenSecret)
 
@@ -59,7 +66,7 @@ func NewProtocol(laddr string, eventHandlers ProtocolEventHandlers) (p *Protocol
 
 func (p *Protocol) Start() {
 	if p.started {
-		log.Panicln("Attempting to Start() a mainline/Protocol that has been already started! (Programmer error.)")
+		panic("Attempting to Start() a mainline/Protocol that has been already started! (Programmer error.)")
 	}
 	p.started = true
 
@@ -70,7 +77,7 @@ func (p *Protocol) Start() {
 
 func (p *Protocol) Terminate() {
 	if !p.started {
-		log.Panicln("Attempted to Terminate() a mainline/Protocol that has not been Start()ed! (Programmer error.)")
+		panic("Attempted to Terminate() a mainline/Protocol that has not been Start()ed! (Programmer error.)")
 	}
 
 	p.transport.Terminate()
@@ -145,6 +152,24 @@ func (omc orderedMessagesCount) String() string {
 	}
 	return mostReceivedMessageTypes
 }
+
+// toStats converts the counts for the stats registry.
+func (omc orderedMessagesCount) toStats() []stats.MessageCount {
+	counts := make([]stats.MessageCount, 0, len(omc))
+	for _, m := range omc {
+		count := stats.MessageCount{
+			Type:       m.messageType,
+			Count:      m.messageCount,
+			Percentage: m.percentageOverTotal,
+		}
+		if len(m.subMessages) > 0 {
+			count.Queries = m.subMessages.toStats()
+		}
+		counts = append(counts, count)
+	}
+	return counts
+}
+
 func (p *Protocol) printStats() {
 	for {
 		time.Sleep(StatsPrintClock)
@@ -171,6 +196,7 @@ func (p *Protocol) printStats() {
 		p.stats.RUnlock()
 		orderedMessages.CalculatePercentagesOverTotal(totalMessages)
 		orderedMessages.Sort()
+		stats.Default.SetDHTMessages(orderedMessages.toStats())
 
 		p.stats.Reset()
 	}
@@ -281,12 +307,41 @@ func (p *Protocol) onMessage(msg *Message, addr *net.UDPAddr) {
 	}
 
 	// let's update stats at the end so that in case of an "r" message the previous switch case can update the temporaryQ field
+	y, q := messageLabels(msg.Y, temporaryQ)
 	p.stats.Lock()
-	if _, ok := p.stats.messageTypeCount[msg.Y]; !ok {
-		p.stats.messageTypeCount[msg.Y] = make(map[string]int)
+	if _, ok := p.stats.messageTypeCount[y]; !ok {
+		p.stats.messageTypeCount[y] = make(map[string]int)
 	}
-	p.stats.messageTypeCount[msg.Y][temporaryQ]++
+	p.stats.messageTypeCount[y][q]++
 	p.stats.Unlock()
+	metrics.DHTMessages.WithLabelValues("in", y, q).Inc()
+}
+
+// knownQueries are the queries that messages received are counted by, besides "other".
+var knownQueries = map[string]bool{
+	"":                  true,
+	"ping":              true,
+	"find_node":         true,
+	"get_peers":         true,
+	"announce_peer":     true,
+	"vote":              true,
+	"sample_infohashes": true,
+	"ping_or_announce":  true,
+}
+
+// messageLabels returns the type and query that a message received is counted by. Any peer can
+// send any type and query, so those that are unknown are counted as "other" rather than as
+// themselves, lest they grow the stats and metrics without bound.
+func messageLabels(y, q string) (string, string) {
+	switch y {
+	case "q", "r", "e":
+	default:
+		y = "other"
+	}
+	if !knownQueries[q] {
+		q = "other"
+	}
+	return y, q
 }
 
 func (p *Protocol) SendMessage(msg *Message, addr *net.UDPAddr) {
@@ -396,7 +451,7 @@ func (p *Protocol) updateTokenSecret() {
 		_, err := rand.Read(p.currentTokenSecret)
 		if err != nil {
 			p.tokenLock.Unlock()
-			log.Fatalf("Could NOT generate random bytes for token secret! %v", err)
+			panic("Could NOT generate random bytes for token secret! " + err.Error())
 		}
 		p.tokenLock.Unlock()
 	}
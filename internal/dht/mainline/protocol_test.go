@@ -1,8 +1,11 @@
 package mainline
 
 import (
+	"fmt"
 	"net"
 	"testing"
+
+	"github.com/t-richards/magnetico/internal/metrics"
 )
 
 var protocolTestValidInstances = []struct {
@@ -214,3 +217,45 @@ func TestNewGetPeersResponseWithNodes(t *testing.T) {
 		t.Errorf("NewGetPeersResponseWithNodes returned an invalid message!")
 	}
 }
+
+func TestOnMessageBoundsLabels(t *testing.T) {
+	p := &Protocol{stats: protocolStats{messageTypeCount: make(map[string]map[string]int)}}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	for i := 0; i < 1000; i++ {
+		p.onMessage(&Message{Y: fmt.Sprintf("y%d", i), Q: fmt.Sprintf("q%d", i)}, addr)
+		p.onMessage(&Message{Y: "e", Q: fmt.Sprintf("q%d", i)}, addr)
+	}
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %v", err)
+	}
+	series := 0
+	for _, family := range families {
+		if family.GetName() != "magnetico_dht_messages_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["direction"] != "in" {
+				continue
+			}
+			series++
+			if y, q := messageLabels(labels["type"], labels["query"]); y != labels["type"] || q != labels["query"] {
+				t.Errorf("expected only known types and queries, got %v", labels)
+			}
+		}
+	}
+	if series > 4*len(knownQueries) {
+		t.Errorf("expected at most %d series of messages received, got %d", 4*len(knownQueries), series)
+	}
+
+	p.stats.RLock()
+	defer p.stats.RUnlock()
+	if len(p.stats.messageTypeCount) != 2 || p.stats.messageTypeCount["other"]["other"] != 1000 || p.stats.messageTypeCount["e"]["other"] != 1000 {
+		t.Errorf("expected the messages to be counted as other, got %v", p.stats.messageTypeCount)
+	}
+}
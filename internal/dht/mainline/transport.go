@@ -2,8 +2,8 @@ package mainline
 
 import (
 	"bytes"
-	"log"
 	"net"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -13,6 +13,8 @@ import (
 	"github.com/anacrolix/torrent/bencode"
 	"golang.org/x/sys/unix"
 
+	"github.com/t-richards/magnetico/internal/metrics"
+	"github.com/t-richards/magnetico/internal/stats"
 	"github.com/t-richards/magnetico/internal/util"
 )
 
@@ -61,10 +63,10 @@ func NewTransport(laddr string, onMessage func(*Message, *net.UDPAddr), onConges
 	var err error
 	t.laddr, err = net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
-		log.Panicf("Could not resolve the UDP address for the trawler! %v", err)
+		panic("Could not resolve the UDP address for the trawler! " + err.Error())
 	}
 	if t.laddr.IP.To4() == nil {
-		log.Panicln("IP address is not IPv4!")
+		panic("IP address is not IPv4!")
 	}
 
 	t.stats = &transportStats{
@@ -89,21 +91,23 @@ func (t *Transport) Start() {
 	// end up in a debugging horror.
 	//                                                                   Here ends my justification.
 	if t.started {
-		log.Panicln("Attempting to Start() a mainline/Transport that has been already started! (Programmer error.)")
+		panic("Attempting to Start() a mainline/Transport that has been already started! (Programmer error.)")
 	}
 	t.started = true
 
 	var err error
 	t.fd, err = unix.Socket(unix.SOCK_DGRAM, unix.AF_INET, 0)
 	if err != nil {
-		log.Fatalf("Could NOT create a UDP socket! %v", err)
+		transportLogger.Error("could not create a UDP socket", "err", err)
+		os.Exit(1)
 	}
 
 	var ip [4]byte
 	copy(ip[:], t.laddr.IP.To4())
 	err = unix.Bind(t.fd, &unix.SockaddrInet4{Addr: ip, Port: t.laddr.Port})
 	if err != nil {
-		log.Fatalf("Could NOT bind the socket! %v", err)
+		transportLogger.Error("could not bind the socket", "address", t.laddr, "err", err)
+		os.Exit(1)
 	}
 
 	go t.printStats()
@@ -120,7 +124,7 @@ func (t *Transport) readMessages() {
 	for {
 		n, fromSA, err := unix.Recvfrom(t.fd, t.buffer, 0)
 		if err == unix.EPERM || err == unix.ENOBUFS { // todo: are these errors possible for recvfrom?
-			log.Printf("READ CONGESTION! %v", err)
+			transportLogger.Warn("read congestion", "err", err)
 			t.onCongestion()
 		} else if err != nil {
 			// Socket is probably closed
@@ -136,7 +140,7 @@ func (t *Transport) readMessages() {
 
 		from := util.SockaddrToUDPAddr(fromSA)
 		if from == nil {
-			log.Panicln("dht mainline transport SockaddrToUDPAddr: nil")
+			panic("dht mainline transport SockaddrToUDPAddr: nil")
 		}
 
 		var msg Message
@@ -243,6 +247,8 @@ func (t *Transport) printStats() {
 		}
 		t.stats.RUnlock()
 
+		stats.Default.AddTransport(uint64(currentTotalSend), uint64(currentTotalRead), StatsPrintClock)
+
 		sort.Sort(tempOrderedPorts)
 
 		mostUsedPortsBuffer := bytes.Buffer{}
@@ -279,10 +285,11 @@ func (t *Transport) WriteMessages(msg *Message, addr *net.UDPAddr) {
 
 	data, err := bencode.Marshal(msg)
 	if err != nil {
-		log.Panicln("Could NOT marshal an outgoing message! (Programmer error.)")
+		panic("Could NOT marshal an outgoing message! (Programmer error.)")
 	}
 	addrSA := util.NetAddrToSockaddr(addr)
 	if addrSA == nil {
+		metrics.DHTSendsDropped.Inc()
 		return
 	}
 	t.stats.Lock()
@@ -290,6 +297,7 @@ func (t *Transport) WriteMessages(msg *Message, addr *net.UDPAddr) {
 	t.stats.sentPorts[a]++
 	t.stats.totalSend++
 	t.stats.Unlock()
+	metrics.DHTMessages.WithLabelValues("out", msg.Y, msg.Q).Inc()
 
 	err = unix.Sendto(t.fd, data, 0, addrSA)
 	if err == unix.EPERM || err == unix.ENOBUFS {
@@ -307,11 +315,13 @@ func (t *Transport) WriteMessages(msg *Message, addr *net.UDPAddr) {
 		 *
 		 * Source: https://docs.python.org/3/library/asyncio-protocol.html#flow-control-callbacks
 		 */
-		log.Printf("WRITE CONGESTION! %v", err)
+		transportLogger.Warn("write congestion", "err", err)
+		metrics.DHTSendsThrottled.Inc()
 		if t.onCongestion != nil {
 			t.onCongestion()
 		}
 	} else if err != nil {
-		log.Printf("Could NOT write an UDP packet! %v", err)
+		transportLogger.Warn("could not write a UDP packet", "to", addr, "err", err)
+		metrics.DHTSendsDropped.Inc()
 	}
 }
@@ -1,13 +1,17 @@
 package dht
 
 import (
-	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/t-richards/magnetico/internal/dht/mainline"
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/metrics"
 )
 
+var logger = logging.For(logging.DHT)
+
 type Service interface {
 	Start()
 	Terminate()
@@ -21,11 +25,15 @@ type Result interface {
 type Manager struct {
 	output           chan Result
 	indexingServices []Service
+
+	dropped atomic.Uint64
 }
 
 func NewManager(addrs []string, interval time.Duration, maxNeighbors uint) *Manager {
 	manager := new(Manager)
-	manager.output = make(chan Result, 20)
+	// The consumer of the output only has to hand results over to the metadata sink's queue, so a
+	// generous buffer is enough to absorb bursts of sample_infohashes responses.
+	manager.output = make(chan Result, 1000)
 
 	for _, addr := range addrs {
 		service := mainline.NewIndexingService(addr, interval, maxNeighbors, mainline.IndexingServiceEventHandlers{
@@ -46,7 +54,10 @@ func (m *Manager) onIndexingResult(res mainline.IndexingResult) {
 	select {
 	case m.output <- res:
 	default:
-		log.Println("DHT manager output ch is full, idx result dropped!")
+		metrics.DHTResultsDropped.Inc()
+		if m.dropped.Add(1)%1000 == 1 {
+			logger.Warn("output channel is full, dropping indexing results", "dropped", m.dropped.Load())
+		}
 	}
 }
 
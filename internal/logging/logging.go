@@ -0,0 +1,182 @@
+// Package logging configures the structured loggers of magnetico's subsystems.
+//
+// Loggers returned by For can be created at any time, including during package initialisation:
+// they follow the configuration that Setup installs later on.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Environment variables that configure logging.
+const (
+	// FormatEnv is "text" (the default) or "json".
+	FormatEnv = "MAGNETICO_LOG_FORMAT"
+	// LevelEnv is a level ("debug", "info", "warn" or "error"; "info" by default), optionally
+	// followed by per-subsystem levels, e.g. "info,dht=warn,leech=debug".
+	LevelEnv = "MAGNETICO_LOG_LEVEL"
+)
+
+// Subsystems, as logged in the "subsystem" attribute of their records.
+const (
+	DHT         = "dht"
+	Transport   = "transport"
+	Leech       = "leech"
+	Sink        = "sink"
+	Persistence = "persistence"
+	Serve       = "serve"
+	Crawler     = "crawler"
+	Rules       = "rules"
+	Classifier  = "classifier"
+)
+
+// config is what Setup installs.
+type config struct {
+	handler slog.Handler // lets every record through; levels are enforced by subsystemHandler
+	level   slog.Level
+	levels  map[string]slog.Level // by subsystem
+}
+
+func (c *config) levelOf(subsystem string) slog.Level {
+	if level, ok := c.levels[subsystem]; ok {
+		return level
+	}
+	return c.level
+}
+
+var current atomic.Pointer[config]
+
+func init() {
+	current.Store(&config{
+		handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	})
+}
+
+// Setup makes every logger write to w in the given format ("text" or "json") at the given levels
+// (as in LevelEnv), and routes the standard library's log package through them as well.
+func Setup(w io.Writer, format string, levels string) error {
+	c := new(config)
+	c.level = slog.LevelInfo
+	c.levels = make(map[string]slog.Level)
+
+	for i, spec := range strings.Split(levels, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		subsystem, levelText, found := strings.Cut(spec, "=")
+		if !found {
+			subsystem, levelText = "", spec
+		} else if i == 0 && subsystem == "" {
+			return fmt.Errorf("invalid level %q", spec)
+		}
+
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelText)); err != nil {
+			return fmt.Errorf("invalid level %q", spec)
+		}
+
+		if subsystem == "" {
+			c.level = level
+		} else {
+			c.levels[subsystem] = level
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case "", "text":
+		c.handler = slog.NewTextHandler(w, options)
+	case "json":
+		c.handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	current.Store(c)
+	slog.SetDefault(slog.New(&subsystemHandler{}))
+
+	return nil
+}
+
+// SetupFromEnv calls Setup with the configuration in the environment, writing to stderr.
+func SetupFromEnv() error {
+	return Setup(os.Stderr, os.Getenv(FormatEnv), os.Getenv(LevelEnv))
+}
+
+// For returns the logger of a subsystem.
+func For(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// subsystemHandler hands records over to the handler of the current config, at the level of its
+// subsystem.
+type subsystemHandler struct {
+	subsystem string // none if empty
+	// with are the WithAttrs and WithGroup calls made on the handler, to be replayed on the
+	// handler of the config.
+	with []func(slog.Handler) slog.Handler
+
+	resolved atomic.Pointer[resolvedHandler]
+}
+
+// resolvedHandler caches the handler of a subsystemHandler for a config.
+type resolvedHandler struct {
+	config  *config
+	handler slog.Handler
+	level   slog.Level
+}
+
+func (h *subsystemHandler) resolve() *resolvedHandler {
+	c := current.Load()
+	if r := h.resolved.Load(); r != nil && r.config == c {
+		return r
+	}
+
+	r := &resolvedHandler{config: c, handler: c.handler, level: c.levelOf(h.subsystem)}
+	if h.subsystem != "" {
+		r.handler = r.handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	}
+	for _, with := range h.with {
+		r.handler = with(r.handler)
+	}
+	h.resolved.Store(r)
+
+	return r
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	r := h.resolve()
+	return level >= r.level && r.handler.Enabled(ctx, level)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.resolve().handler.Handle(ctx, record)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.withHandler(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.withHandler(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *subsystemHandler) withHandler(with func(slog.Handler) slog.Handler) *subsystemHandler {
+	h2 := new(subsystemHandler)
+	h2.subsystem = h.subsystem
+	h2.with = append(h.with[:len(h.with):len(h.with)], with)
+	return h2
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	// Created before Setup, as package-level loggers are.
+	dht := For(DHT).With("port", 6881)
+	leech := For(Leech)
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, "json", "warn,leech=debug"); err != nil {
+		t.Fatalf("could not set up logging: %v", err)
+	}
+
+	dht.Info("not logged")
+	dht.Warn("congestion", "err", "EPERM")
+	leech.Debug("handshake")
+	log.Printf("from the log package")
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("expected JSON, got %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if r := records[0]; r["msg"] != "congestion" || r["subsystem"] != "dht" || r["port"] != 6881.0 || r["err"] != "EPERM" {
+		t.Errorf("unexpected first record %v", r)
+	}
+	if r := records[1]; r["msg"] != "handshake" || r["subsystem"] != "leech" || r["level"] != "DEBUG" {
+		t.Errorf("unexpected second record %v", r)
+	}
+
+	// The log package logs at the info level, which is below the default level of "warn".
+	buf.Reset()
+	if err := Setup(&buf, "text", "info"); err != nil {
+		t.Fatalf("could not set up logging: %v", err)
+	}
+	log.Printf("from the log package")
+	dht.Debug("not logged")
+	if out := buf.String(); !strings.Contains(out, "from the log package") || strings.Contains(out, "not logged") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestSetupErrors(t *testing.T) {
+	for _, c := range []struct{ format, levels string }{
+		{"xml", "info"},
+		{"text", "loud"},
+		{"text", "info,dht=loud"},
+		{"text", "=debug"},
+	} {
+		if err := Setup(&bytes.Buffer{}, c.format, c.levels); err == nil {
+			t.Errorf("expected %q and %q to be rejected", c.format, c.levels)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package metadata
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+// Bounds of the maps of clientStats, as their keys are chosen by the peers.
+const (
+	maxTrackedClients     = 256
+	maxExternalIPVoters   = 64
+	otherClients          = "other"
+	externalIPMinimumVote = 2
+)
+
+// ClientStats count the outcomes of the leeches that got as far as the extension handshake, by the
+// client of the peer.
+type ClientStats struct {
+	Succeeded uint64
+	Failed    uint64
+}
+
+// clientStats aggregates what peers tell about themselves and about us in their extension
+// handshakes.
+type clientStats struct {
+	mu      sync.Mutex
+	clients map[string]*ClientStats
+	// externalIPs counts the peers that reported each of our IP addresses in "yourip".
+	externalIPs map[string]uint64
+	// externalIP is the one reported by most peers, or "" unless at least externalIPMinimumVote of
+	// them agree.
+	externalIP string
+}
+
+func newClientStats() *clientStats {
+	cs := new(clientStats)
+	cs.clients = make(map[string]*ClientStats)
+	cs.externalIPs = make(map[string]uint64)
+	return cs
+}
+
+func (cs *clientStats) record(stats LeechStats, succeeded bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if stats.YourIP != nil {
+		ip := stats.YourIP.String()
+		if _, exists := cs.externalIPs[ip]; exists || len(cs.externalIPs) < maxExternalIPVoters {
+			cs.externalIPs[ip]++
+			cs.electExternalIPLocked()
+		}
+	}
+
+	if stats.Client == "" {
+		return
+	}
+	name := clientName(stats.Client)
+	client, exists := cs.clients[name]
+	if !exists {
+		if len(cs.clients) >= maxTrackedClients {
+			name = otherClients
+			client = cs.clients[name]
+		}
+		if client == nil {
+			client = new(ClientStats)
+			cs.clients[name] = client
+		}
+	}
+
+	if succeeded {
+		client.Succeeded++
+	} else {
+		client.Failed++
+	}
+	metrics.LeechClients.WithLabelValues(name, strconv.FormatBool(succeeded)).Inc()
+}
+
+// electExternalIPLocked elects the external IP address reported by most peers, and logs and
+// exports it whenever it changes. cs.mu must be held.
+func (cs *clientStats) electExternalIPLocked() {
+	var externalIP string
+	var votes uint64
+	for ip, n := range cs.externalIPs {
+		if n > votes || (n == votes && ip < externalIP) {
+			externalIP, votes = ip, n
+		}
+	}
+	if votes < externalIPMinimumVote || externalIP == cs.externalIP {
+		return
+	}
+
+	cs.externalIP = externalIP
+	sinkLogger.Info("learned our external IP address from peers", "ip", externalIP, "votes", votes)
+	metrics.LeechExternalIP.Reset()
+	metrics.LeechExternalIP.WithLabelValues(externalIP).Set(1)
+}
+
+// snapshot returns a copy of the per-client stats, and the external IP address reported by most
+// peers (nil unless at least externalIPMinimumVote of them agree).
+func (cs *clientStats) snapshot() (map[string]ClientStats, net.IP) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	clients := make(map[string]ClientStats, len(cs.clients))
+	for name, client := range cs.clients {
+		clients[name] = *client
+	}
+
+	if cs.externalIP == "" {
+		return clients, nil
+	}
+	return clients, net.ParseIP(cs.externalIP)
+}
+
+// clientName strips the version off the "v" of an extension handshake, so that stats are
+// aggregated by client rather than by release: "qBittorrent/4.5.2" and "Transmission 3.00" become
+// "qBittorrent" and "Transmission".
+func clientName(v string) string {
+	fields := strings.FieldsFunc(v, func(r rune) bool {
+		return r == ' ' || r == '/'
+	})
+
+	var name []string
+	for _, field := range fields {
+		version := strings.TrimPrefix(strings.TrimPrefix(field, "v"), "V")
+		if version != "" && unicode.IsDigit(rune(version[0])) {
+			break
+		}
+		name = append(name, field)
+	}
+
+	if len(name) == 0 {
+		return v
+	}
+	return strings.Join(name, " ")
+}
@@ -0,0 +1,80 @@
+package metadata
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+func TestClientName(t *testing.T) {
+	cases := map[string]string{
+		"qBittorrent/4.5.2":            "qBittorrent",
+		"Transmission 3.00":            "Transmission",
+		"µTorrent 3.5.5":               "µTorrent",
+		"libTorrent (Rakshasa) 0.13.8": "libTorrent (Rakshasa)",
+		"Deluge v2.1.1":                "Deluge",
+		"vuze":                         "vuze",
+		"1.0":                          "1.0",
+	}
+
+	for v, expected := range cases {
+		if name := clientName(v); name != expected {
+			t.Errorf("expected %q for %q, got %q", expected, v, name)
+		}
+	}
+}
+
+func TestClientStatsAggregatesByClient(t *testing.T) {
+	cs := newClientStats()
+	cs.record(LeechStats{Client: "qBittorrent/4.5.2"}, true)
+	cs.record(LeechStats{Client: "qBittorrent/4.6.0"}, false)
+	cs.record(LeechStats{}, false) // never got as far as the extension handshake
+
+	clients, _ := cs.snapshot()
+	if len(clients) != 1 || clients["qBittorrent"] != (ClientStats{Succeeded: 1, Failed: 1}) {
+		t.Errorf("unexpected client stats %+v", clients)
+	}
+
+	for i := 0; i < maxTrackedClients+10; i++ {
+		cs.record(LeechStats{Client: "Client" + strconv.Itoa(i)}, true)
+	}
+	clients, _ = cs.snapshot()
+	if len(clients) != maxTrackedClients+1 || clients[otherClients].Succeeded == 0 {
+		t.Errorf("expected overflowing clients to be counted as %q, got %d clients", otherClients, len(clients))
+	}
+}
+
+func TestClientStatsElectsExternalIP(t *testing.T) {
+	cs := newClientStats()
+	ours, liar := net.IPv4(203, 0, 113, 1), net.IPv4(198, 51, 100, 1)
+
+	cs.record(LeechStats{YourIP: ours}, true)
+	if _, ip := cs.snapshot(); ip != nil {
+		t.Errorf("expected a single vote not to be enough, got %v", ip)
+	}
+
+	cs.record(LeechStats{YourIP: liar}, false)
+	cs.record(LeechStats{YourIP: ours}, false)
+	if _, ip := cs.snapshot(); !ip.Equal(ours) {
+		t.Errorf("expected %v to be elected, got %v", ours, ip)
+	}
+
+	// The elected address is exported, alone.
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %v", err)
+	}
+	var exported []string
+	for _, family := range families {
+		if family.GetName() == "magnetico_leech_external_ip_info" {
+			for _, metric := range family.GetMetric() {
+				exported = append(exported, metric.GetLabel()[0].GetValue())
+			}
+		}
+	}
+	if len(exported) != 1 || exported[0] != ours.String() {
+		t.Errorf("expected %v to be exported, got %v", ours, exported)
+	}
+}
@@ -0,0 +1,335 @@
+package metadata
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// ErrorClass is a coarse classification of the reason a metadata fetch failed.
+type ErrorClass string
+
+const (
+	ErrorClassConnectRefused   ErrorClass = "connect_refused"
+	ErrorClassConnectTimeout   ErrorClass = "connect_timeout"
+	ErrorClassConnect          ErrorClass = "connect"
+	ErrorClassHandshake        ErrorClass = "handshake"
+	ErrorClassRejected         ErrorClass = "rejected"
+	ErrorClassInfoHashMismatch ErrorClass = "infohash_mismatch"
+	ErrorClassInvalidMetadata  ErrorClass = "invalid_metadata"
+	ErrorClassTimeout          ErrorClass = "timeout"
+	ErrorClassCancelled        ErrorClass = "cancelled"
+	ErrorClassOther            ErrorClass = "other"
+)
+
+// classifyError maps an error returned by a Leech to an ErrorClass.
+func classifyError(err error) ErrorClass {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCancelled
+
+	case errors.Is(err, ErrConnect):
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrorClassConnectRefused
+		}
+		if isTimeout(err) {
+			return ErrorClassConnectTimeout
+		}
+		return ErrorClassConnect
+
+	case errors.Is(err, ErrRejected):
+		return ErrorClassRejected
+
+	case errors.Is(err, ErrInfoHashMismatch):
+		return ErrorClassInfoHashMismatch
+
+	case isTimeout(err):
+		return ErrorClassTimeout
+
+	case errors.Is(err, ErrMSEHandshake), errors.Is(err, ErrBtHandshake), errors.Is(err, ErrExHandshake):
+		return ErrorClassHandshake
+
+	case errors.Is(err, ErrInvalidInfo), errors.Is(err, ErrNegativeFileSize):
+		return ErrorClassInvalidMetadata
+
+	default:
+		return ErrorClassOther
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// FailureStore persists the entries of a FailureCache across restarts.
+type FailureStore interface {
+	GetFailedInfoHashes(ctx context.Context, limit int) ([]persistence.FailedInfoHash, error)
+	SaveFailedInfoHashes(ctx context.Context, failures []persistence.FailedInfoHash) error
+	DeleteFailedInfoHashes(ctx context.Context, infoHashes [][]byte) error
+	DeleteFailedInfoHashesBefore(ctx context.Context, retryAfter int64) error
+	TrimFailedInfoHashes(ctx context.Context, keep int) error
+}
+
+// failureFlushInterval is how often a FailureCache writes the changes of its entries to its store.
+const failureFlushInterval = time.Second
+
+type failureEntry struct {
+	infoHash   [20]byte
+	failures   int
+	lastError  ErrorClass
+	lastFailed time.Time
+	retryAfter time.Time
+}
+
+// FailureCache remembers info hashes whose metadata could not be fetched from any of their peers,
+// so that they are not leeched again until an exponentially growing backoff has elapsed.
+//
+// An entry outlives its backoff by maxDelay, so that an info hash that fails again shortly after
+// being retried keeps backing off further instead of starting over.
+//
+// Changes are written to the store in the background, in batches, as the leeches that record
+// failures must not wait for the database, which the crawler writes torrents to as well.
+type FailureCache struct {
+	mu         sync.Mutex
+	entries    map[[20]byte]*list.Element // of *failureEntry
+	order      *list.List                 // of *failureEntry, the least recently failed first
+	maxEntries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	nowFunc    func() time.Time
+
+	store FailureStore // optional
+	// pending holds the changes not written to the store yet: the failure record to save of each
+	// info hash, or nil if it is to be deleted.
+	pending map[[20]byte]*persistence.FailedInfoHash
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewFailureCache creates a FailureCache that holds at most maxEntries info hashes, backing off
+// baseDelay after the first failure and doubling it after each consecutive failure up to
+// maxDelay. If store is not nil, the cache is loaded from and written back to it, until Close.
+func NewFailureCache(maxEntries int, baseDelay, maxDelay time.Duration, store FailureStore) (*FailureCache, error) {
+	fc := new(FailureCache)
+	fc.entries = make(map[[20]byte]*list.Element)
+	fc.order = list.New()
+	fc.maxEntries = maxEntries
+	fc.baseDelay = baseDelay
+	fc.maxDelay = maxDelay
+	fc.nowFunc = time.Now
+
+	if store == nil {
+		return fc, nil
+	}
+
+	if err := store.DeleteFailedInfoHashesBefore(context.Background(), fc.nowFunc().Add(-maxDelay).Unix()); err != nil {
+		return nil, err
+	}
+	// The entries that do not fit are dropped from the store too, as they would be evicted.
+	if err := store.TrimFailedInfoHashes(context.Background(), maxEntries); err != nil {
+		return nil, err
+	}
+
+	failures, err := store.GetFailedInfoHashes(context.Background(), maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	// Most recent first, so the least recent ends up at the front.
+	for _, failure := range failures {
+		entry := &failureEntry{
+			failures:   failure.Failures,
+			lastError:  ErrorClass(failure.LastError),
+			lastFailed: time.Unix(failure.LastFailedAt, 0),
+			retryAfter: time.Unix(failure.RetryAfter, 0),
+		}
+		copy(entry.infoHash[:], failure.InfoHash)
+		fc.entries[entry.infoHash] = fc.order.PushFront(entry)
+	}
+
+	fc.store = store
+	fc.pending = make(map[[20]byte]*persistence.FailedInfoHash)
+	fc.stop = make(chan struct{})
+	fc.stopped = make(chan struct{})
+	go fc.writeBack()
+
+	return fc, nil
+}
+
+// ShouldSkip reports whether the info hash is still backing off from a previous failure.
+func (fc *FailureCache) ShouldSkip(infoHash [20]byte) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	element, exists := fc.entries[infoHash]
+	return exists && fc.nowFunc().Before(element.Value.(*failureEntry).retryAfter)
+}
+
+// RecordFailure registers a failed metadata fetch for the info hash and extends its backoff.
+func (fc *FailureCache) RecordFailure(infoHash [20]byte, err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	now := fc.nowFunc()
+	var entry *failureEntry
+	if element, exists := fc.entries[infoHash]; exists {
+		entry = element.Value.(*failureEntry)
+		fc.order.MoveToBack(element)
+	} else {
+		fc.pruneLocked(now)
+		entry = &failureEntry{infoHash: infoHash}
+		fc.entries[infoHash] = fc.order.PushBack(entry)
+	}
+
+	entry.failures++
+	entry.lastError = classifyError(err)
+	entry.lastFailed = now
+	entry.retryAfter = now.Add(fc.backoff(entry.failures))
+
+	fc.saveLocked(entry)
+}
+
+// Forget removes the info hash from the cache, e.g. after its metadata has been fetched.
+func (fc *FailureCache) Forget(infoHash [20]byte) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if element, exists := fc.entries[infoHash]; exists {
+		fc.removeLocked(element)
+	}
+}
+
+// Len returns the number of info hashes in the cache.
+func (fc *FailureCache) Len() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.entries)
+}
+
+// Close writes the pending changes to the store, and stops writing them: the changes made
+// afterwards, by leeches still winding down, are lost.
+func (fc *FailureCache) Close() {
+	if fc.store == nil {
+		return
+	}
+	close(fc.stop)
+	<-fc.stopped
+	if err := fc.flush(); err != nil {
+		sinkLogger.Error("could not write the failed info hashes", "err", err)
+	}
+}
+
+func (fc *FailureCache) backoff(failures int) time.Duration {
+	delay := fc.baseDelay
+	for i := 1; i < failures && delay < fc.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > fc.maxDelay {
+		delay = fc.maxDelay
+	}
+	return delay
+}
+
+// pruneLocked makes room for an entry: it evicts the least recently failed entries as long as
+// their backoff has elapsed more than maxDelay ago and, if the cache is still full, the least
+// recently failed entry regardless. Expired entries behind one that is not wait for their turn,
+// which costs nothing but memory as ShouldSkip ignores them. fc.mu must be held.
+func (fc *FailureCache) pruneLocked(now time.Time) {
+	for element := fc.order.Front(); element != nil; element = fc.order.Front() {
+		entry := element.Value.(*failureEntry)
+		if !now.After(entry.retryAfter.Add(fc.maxDelay)) && len(fc.entries) < fc.maxEntries {
+			return
+		}
+		fc.removeLocked(element)
+	}
+}
+
+// removeLocked removes the entry of element from the cache, and from the store. fc.mu must be held.
+func (fc *FailureCache) removeLocked(element *list.Element) {
+	entry := fc.order.Remove(element).(*failureEntry)
+	delete(fc.entries, entry.infoHash)
+	if fc.store != nil {
+		fc.pending[entry.infoHash] = nil
+	}
+}
+
+// saveLocked queues the entry to be saved to the store. fc.mu must be held.
+func (fc *FailureCache) saveLocked(entry *failureEntry) {
+	if fc.store != nil {
+		fc.pending[entry.infoHash] = &persistence.FailedInfoHash{
+			InfoHash:     entry.infoHash[:],
+			Failures:     entry.failures,
+			LastError:    string(entry.lastError),
+			LastFailedAt: entry.lastFailed.Unix(),
+			RetryAfter:   entry.retryAfter.Unix(),
+		}
+	}
+}
+
+// writeBack flushes the pending changes every failureFlushInterval, until Close.
+func (fc *FailureCache) writeBack() {
+	defer close(fc.stopped)
+
+	ticker := time.NewTicker(failureFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fc.stop:
+			return
+		case <-ticker.C:
+			if err := fc.flush(); err != nil {
+				sinkLogger.Error("could not write the failed info hashes", "err", err)
+			}
+		}
+	}
+}
+
+// flush writes the pending changes to the store. If the database is busy, they are kept for the
+// next flush, unless superseded in the meantime; otherwise they are dropped, which costs at most a
+// few leeches after a restart.
+func (fc *FailureCache) flush() error {
+	fc.mu.Lock()
+	pending := fc.pending
+	fc.pending = make(map[[20]byte]*persistence.FailedInfoHash)
+	fc.mu.Unlock()
+
+	var saves []persistence.FailedInfoHash
+	var deletes [][]byte
+	for infoHash, failure := range pending {
+		if failure != nil {
+			saves = append(saves, *failure)
+		} else {
+			deletes = append(deletes, bytes.Clone(infoHash[:]))
+		}
+	}
+
+	var err error
+	if len(deletes) > 0 {
+		err = fc.store.DeleteFailedInfoHashes(context.Background(), deletes)
+	}
+	if err == nil && len(saves) > 0 {
+		err = fc.store.SaveFailedInfoHashes(context.Background(), saves)
+	}
+
+	if persistence.IsBusy(err) || errors.Is(err, context.DeadlineExceeded) {
+		fc.mu.Lock()
+		for infoHash, failure := range pending {
+			if _, superseded := fc.pending[infoHash]; !superseded {
+				fc.pending[infoHash] = failure
+			}
+		}
+		fc.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// countingFailureStore counts the batches written to a FailureStore, and fails the next ones with
+// failWith as long as it is not nil.
+type countingFailureStore struct {
+	FailureStore
+	saves, deletes int
+	failWith       error
+}
+
+func (s *countingFailureStore) SaveFailedInfoHashes(ctx context.Context, failures []persistence.FailedInfoHash) error {
+	if s.failWith != nil {
+		return s.failWith
+	}
+	s.saves++
+	return s.FailureStore.SaveFailedInfoHashes(ctx, failures)
+}
+
+func (s *countingFailureStore) DeleteFailedInfoHashes(ctx context.Context, infoHashes [][]byte) error {
+	if s.failWith != nil {
+		return s.failWith
+	}
+	s.deletes++
+	return s.FailureStore.DeleteFailedInfoHashes(ctx, infoHashes)
+}
+
+// stopWritingBack stops the background writes of fc, for the test to flush it when it sees fit.
+func stopWritingBack(fc *FailureCache) {
+	close(fc.stop)
+	<-fc.stopped
+}
+
+func storedFailures(t *testing.T, store FailureStore) map[[20]byte]persistence.FailedInfoHash {
+	failures, err := store.GetFailedInfoHashes(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("could not get the failed info hashes: %v", err)
+	}
+	stored := make(map[[20]byte]persistence.FailedInfoHash)
+	for _, failure := range failures {
+		stored[[20]byte(failure.InfoHash)] = failure
+	}
+	return stored
+}
+
+func TestFailureCacheBacksOffExponentially(t *testing.T) {
+	fc, _ := NewFailureCache(10, time.Minute, 3*time.Minute, nil)
+	now := time.Unix(1000, 0)
+	fc.nowFunc = func() time.Time { return now }
+	infoHash := [20]byte{1}
+
+	if fc.ShouldSkip(infoHash) {
+		t.Fatalf("expected an unknown info hash not to be skipped")
+	}
+
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		fc.RecordFailure(infoHash, fmt.Errorf("%w dial %w", ErrConnect, syscall.ECONNREFUSED))
+
+		now = now.Add(expected - time.Second)
+		if !fc.ShouldSkip(infoHash) {
+			t.Errorf("expected info hash to be skipped before %v elapsed", expected)
+		}
+		now = now.Add(time.Second)
+		if fc.ShouldSkip(infoHash) {
+			t.Errorf("expected info hash not to be skipped after %v elapsed", expected)
+		}
+	}
+
+	fc.Forget(infoHash)
+	if fc.Len() != 0 {
+		t.Errorf("expected the cache to be empty, got %d entries", fc.Len())
+	}
+}
+
+func TestFailureCacheEvictsWhenFull(t *testing.T) {
+	fc, _ := NewFailureCache(2, time.Minute, time.Hour, nil)
+	now := time.Unix(1000, 0)
+	fc.nowFunc = func() time.Time { return now }
+
+	for i := byte(0); i < 3; i++ {
+		fc.RecordFailure([20]byte{i}, ErrInfoHashMismatch)
+		now = now.Add(time.Second)
+	}
+
+	if fc.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", fc.Len())
+	}
+	if fc.ShouldSkip([20]byte{0}) {
+		t.Errorf("expected the oldest failure to be evicted")
+	}
+}
+
+func TestFailureCachePersists(t *testing.T) {
+	store := persistence.NewMemoryDatabase()
+	fc, err := NewFailureCache(10, time.Hour, 24*time.Hour, store)
+	if err != nil {
+		t.Fatalf("could not create failure cache: %v", err)
+	}
+
+	infoHash := [20]byte{1}
+	fc.RecordFailure(infoHash, ErrRejected)
+	fc.Close()
+
+	saved := storedFailures(t, store)[infoHash]
+	if saved.Failures != 1 || saved.LastError != string(ErrorClassRejected) {
+		t.Errorf("unexpected saved failure %+v", saved)
+	}
+
+	reloaded, err := NewFailureCache(10, time.Hour, 24*time.Hour, store)
+	if err != nil {
+		t.Fatalf("could not reload failure cache: %v", err)
+	}
+	if !reloaded.ShouldSkip(infoHash) {
+		t.Errorf("expected the reloaded cache to skip the info hash")
+	}
+
+	reloaded.Forget(infoHash)
+	reloaded.Close()
+	if stored := storedFailures(t, store); len(stored) != 0 {
+		t.Errorf("expected the failure to be deleted from the store, got %v", stored)
+	}
+}
+
+func TestFailureCacheWritesInBatches(t *testing.T) {
+	store := &countingFailureStore{FailureStore: persistence.NewMemoryDatabase()}
+	fc, err := NewFailureCache(3, time.Hour, 24*time.Hour, store)
+	if err != nil {
+		t.Fatalf("could not create failure cache: %v", err)
+	}
+	stopWritingBack(fc)
+
+	for i := byte(0); i < 4; i++ {
+		fc.RecordFailure([20]byte{i}, ErrRejected)
+		fc.RecordFailure([20]byte{i}, ErrRejected)
+	}
+	fc.Forget([20]byte{3})
+
+	// The writes wait for the database while it is busy.
+	store.failWith = fmt.Errorf("tx.Commit %w", context.DeadlineExceeded)
+	if err = fc.flush(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the flush to time out, got %v", err)
+	}
+	store.failWith = nil
+	if err = fc.flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+
+	if store.saves != 1 || store.deletes != 1 {
+		t.Errorf("expected a batch of saves and one of deletions, got %d and %d", store.saves, store.deletes)
+	}
+	stored := storedFailures(t, store)
+	if len(stored) != 2 || stored[[20]byte{1}].Failures != 2 || stored[[20]byte{2}].Failures != 2 {
+		t.Errorf("expected the failures of the info hashes still in the cache only, got %v", stored)
+	}
+}
+
+func TestFailureCacheLoadsTheMostRecentFailures(t *testing.T) {
+	store := persistence.NewMemoryDatabase()
+	now := time.Now()
+	var failures []persistence.FailedInfoHash
+	for i := byte(0); i < 3; i++ {
+		failures = append(failures, persistence.FailedInfoHash{
+			InfoHash:     bytes.Repeat([]byte{i}, 20),
+			Failures:     1,
+			LastError:    string(ErrorClassRejected),
+			LastFailedAt: now.Add(time.Duration(i) * time.Minute).Unix(),
+			RetryAfter:   now.Add(time.Hour).Unix(),
+		})
+	}
+	if err := store.SaveFailedInfoHashes(context.Background(), failures); err != nil {
+		t.Fatalf("could not save the failed info hashes: %v", err)
+	}
+
+	fc, err := NewFailureCache(2, time.Hour, 24*time.Hour, store)
+	if err != nil {
+		t.Fatalf("could not create failure cache: %v", err)
+	}
+	defer fc.Close()
+
+	if fc.Len() != 2 || fc.ShouldSkip([20]byte{}) {
+		t.Errorf("expected the 2 most recent failures only to be loaded, got %d", fc.Len())
+	}
+	if stored := storedFailures(t, store); len(stored) != 2 {
+		t.Errorf("expected the least recent failure to be deleted from the store, got %v", stored)
+	}
+
+	// The least recently failed entry is evicted first, from the store too.
+	fc.RecordFailure([20]byte{9}, ErrRejected)
+	if err = fc.flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	stored := storedFailures(t, store)
+	if _, exists := stored[[20]byte(bytes.Repeat([]byte{1}, 20))]; exists || len(stored) != 2 {
+		t.Errorf("expected the evicted failure to be deleted from the store, got %v", stored)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{fmt.Errorf("%w dial %w", ErrConnect, syscall.ECONNREFUSED), ErrorClassConnectRefused},
+		{fmt.Errorf("%w dial %w", ErrConnect, os.ErrDeadlineExceeded), ErrorClassConnectTimeout},
+		{fmt.Errorf("%w readExactly rHandshake %w", ErrBtHandshake, io.EOF), ErrorClassHandshake},
+		{fmt.Errorf("%w readExMessage %w", ErrReadPiece, os.ErrDeadlineExceeded), ErrorClassTimeout},
+		{fmt.Errorf("%w: %w", ErrReadPiece, context.DeadlineExceeded), ErrorClassTimeout},
+		{fmt.Errorf("%w: %w", ErrExHandshake, context.Canceled), ErrorClassCancelled},
+		{ErrRejected, ErrorClassRejected},
+		{ErrInfoHashMismatch, ErrorClassInfoHashMismatch},
+		{fmt.Errorf("%w: validateInfo %w", ErrInvalidInfo, errors.New("pieces has invalid length")), ErrorClassInvalidMetadata},
+		{ErrPieceTooBig, ErrorClassOther},
+	}
+
+	for _, c := range cases {
+		if class := classifyError(c.err); class != c.class {
+			t.Errorf("expected %q to be classified as %s, got %s", c.err, c.class, class)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// File attributes defined by BEP 47.
+const (
+	AttrPadding    = 'p'
+	AttrExecutable = 'x'
+	AttrHidden     = 'h'
+	AttrSymlink    = 'l'
+)
+
+// BitComet used to pad files long before BEP 47, naming them like so.
+const legacyPaddingFilePrefix = "_____padding_file_"
+
+// extendedInfo holds the fields of the info dictionary that metainfo.Info does not decode.
+type extendedInfo struct {
+	Attr  string             `bencode:"attr,omitempty"` // single-file torrents
+	Files []extendedFileInfo `bencode:"files,omitempty"`
+
+	// Added by BEP 52.
+	MetaVersion int            `bencode:"meta version,omitempty"`
+	FileTree    map[string]any `bencode:"file tree,omitempty"`
+}
+
+type extendedFileInfo struct {
+	Attr string `bencode:"attr,omitempty"`
+}
+
+// isV2 reports whether the info dictionary describes a v2 (or hybrid) torrent.
+func (ext *extendedInfo) isV2() bool {
+	return ext.MetaVersion == 2
+}
+
+// parseInfo decodes the raw bencoded info dictionary.
+func parseInfo(rawInfo []byte) (*metainfo.Info, *extendedInfo, error) {
+	info := new(metainfo.Info)
+	if err := bencode.Unmarshal(rawInfo, info); err != nil {
+		return nil, nil, err
+	}
+
+	ext := new(extendedInfo)
+	if err := bencode.Unmarshal(rawInfo, ext); err != nil {
+		return nil, nil, err
+	}
+
+	return info, ext, nil
+}
+
+// parseDetails returns the torrent-wide properties of the info dictionary.
+func parseDetails(info *metainfo.Info, ext *extendedInfo, files []persistence.File) persistence.TorrentDetails {
+	pieceCount := info.NumPieces()
+	// v2-only torrents have no pieces string; each of their files starts at a piece boundary.
+	if pieceCount == 0 && ext.isV2() && info.PieceLength > 0 {
+		for _, file := range files {
+			pieceCount += int((file.Size + info.PieceLength - 1) / info.PieceLength)
+		}
+	}
+
+	return persistence.TorrentDetails{
+		PieceLength: info.PieceLength,
+		PieceCount:  pieceCount,
+		Private:     info.Private != nil && *info.Private,
+		Source:      info.Source,
+	}
+}
+
+// parseFiles returns the files of the info dictionary, leaving padding files out.
+//
+// The file tree of v2 torrents is preferred over the file list, as hybrid torrents pad the latter
+// for the sake of v1 clients.
+func parseFiles(info *metainfo.Info, ext *extendedInfo) ([]persistence.File, error) {
+	if ext.isV2() {
+		var files []persistence.File
+		if err := walkFileTree(ext.FileTree, nil, &files); err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.New("empty file tree")
+		}
+		return files, nil
+	}
+
+	var files []persistence.File
+	// If there is only one file, there won't be a Files slice. That's why we need to add it here
+	if len(info.Files) == 0 {
+		files = append(files, persistence.File{
+			Size: info.Length,
+			Path: info.Name,
+			Attr: ext.Attr,
+		})
+		return files, nil
+	}
+
+	for i, file := range info.Files {
+		var attr string
+		if i < len(ext.Files) {
+			attr = ext.Files[i].Attr
+		}
+		if isPaddingFile(attr, file.Path) {
+			continue
+		}
+
+		files = append(files, persistence.File{
+			Size: file.Length,
+			Path: file.DisplayPath(info),
+			Attr: attr,
+		})
+	}
+
+	return files, nil
+}
+
+// walkFileTree flattens a BEP 52 file tree, in which directories are dictionaries keyed by the
+// names of their children, and files are dictionaries holding a single empty key:
+//
+//	{"dir": {"file.txt": {"": {"length": 42, "pieces root": ...}}}}
+func walkFileTree(tree map[string]any, path []string, files *[]persistence.File) error {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := tree[name].(map[string]any)
+		if !ok {
+			return fmt.Errorf("file tree node %q is not a dictionary", name)
+		}
+
+		if name != "" {
+			if err := walkFileTree(node, append(path, name), files); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(path) == 0 {
+			return errors.New("file tree has a file without a name")
+		}
+		length, ok := node["length"].(int64)
+		if !ok {
+			return fmt.Errorf("file %q has no length", strings.Join(path, "/"))
+		}
+		attr, _ := node["attr"].(string)
+		if isPaddingFile(attr, path) {
+			continue
+		}
+
+		*files = append(*files, persistence.File{
+			Size: length,
+			Path: strings.Join(path, "/"),
+			Attr: attr,
+		})
+	}
+
+	return nil
+}
+
+// isPaddingFile reports whether a file exists only to align the next one to a piece boundary.
+func isPaddingFile(attr string, path []string) bool {
+	if strings.ContainsRune(attr, AttrPadding) {
+		return true
+	}
+	return len(path) > 0 && strings.HasPrefix(path[len(path)-1], legacyPaddingFilePrefix)
+}
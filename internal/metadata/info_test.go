@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilesSkipsPaddingFiles(t *testing.T) {
+	rawInfo := []byte("d" +
+		"5:filesl" +
+		"d6:lengthi10e4:pathl5:a.txtee" +
+		"d4:attr1:p6:lengthi6e4:pathl4:.pad1:6ee" +
+		"d6:lengthi4e4:pathl22:_____padding_file_0___ee" +
+		"d4:attr1:x6:lengthi20e4:pathl3:bin3:runee" +
+		"e" +
+		"4:name4:test12:piece lengthi16e6:pieces40:0123456789012345678901234567890123456789" +
+		"7:privatei1e6:source4:TEST" +
+		"e")
+
+	info, ext, err := parseInfo(rawInfo)
+	if err != nil {
+		t.Fatalf("could not parse info: %v", err)
+	}
+
+	files, err := parseFiles(info, ext)
+	if err != nil {
+		t.Fatalf("could not parse files: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %+v", files)
+	}
+	if files[0].Path != "a.txt" || files[1].Path != "bin/run" || files[1].Attr != "x" {
+		t.Errorf("unexpected files %+v", files)
+	}
+
+	details := parseDetails(info, ext, files)
+	if details.PieceLength != 16 || details.PieceCount != 2 || !details.Private || details.Source != "TEST" {
+		t.Errorf("unexpected details %+v", details)
+	}
+}
+
+func TestParseV2FileTree(t *testing.T) {
+	rawInfo := []byte("d" +
+		"9:file treed" +
+		"5:a.txtd0:d4:attr1:x6:lengthi10eee" +
+		"3:dird" +
+		"5:b.txtd0:d6:lengthi40000e11:pieces root32:" + strings.Repeat("r", 32) + "ee" +
+		"e" +
+		"e" +
+		"12:meta versioni2e" +
+		"4:name4:test12:piece lengthi16384e" +
+		"e")
+
+	info, ext, err := parseInfo(rawInfo)
+	if err != nil {
+		t.Fatalf("could not parse info: %v", err)
+	}
+	if err = validateInfo(info, ext); err != nil {
+		t.Fatalf("expected a valid v2 info dictionary, got %v", err)
+	}
+
+	files, err := parseFiles(info, ext)
+	if err != nil {
+		t.Fatalf("could not parse files: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %+v", files)
+	}
+	if files[0].Path != "a.txt" || files[0].Size != 10 || files[0].Attr != "x" {
+		t.Errorf("unexpected first file %+v", files[0])
+	}
+	if files[1].Path != "dir/b.txt" || files[1].Size != 40000 {
+		t.Errorf("unexpected second file %+v", files[1])
+	}
+
+	// a.txt spans one piece and dir/b.txt three, as v2 files never share pieces.
+	if details := parseDetails(info, ext, files); details.PieceCount != 4 {
+		t.Errorf("expected 4 pieces, got %d", details.PieceCount)
+	}
+}
+
+func TestValidateV2InfoRejectsBadPieceLength(t *testing.T) {
+	rawInfo := []byte("d9:file treed5:a.txtd0:d6:lengthi10eeee12:meta versioni2e4:name1:a12:piece lengthi1000ee")
+
+	info, ext, err := parseInfo(rawInfo)
+	if err != nil {
+		t.Fatalf("could not parse info: %v", err)
+	}
+	if validateInfo(info, ext) == nil {
+		t.Errorf("expected a piece length that is not a power of two to be rejected")
+	}
+}
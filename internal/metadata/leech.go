@@ -2,29 +2,124 @@ package metadata
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
-
-	"github.com/t-richards/magnetico/internal/persistence"
 )
 
 const MaxMetadataSize = 10 * 1024 * 1024
 
+// Errors reported to LeechEventHandlers.OnError. Each of them wraps the underlying cause (if any),
+// so that callers can classify failures with errors.Is.
+var (
+	ErrConnect             = errors.New("connect")
+	ErrMSEHandshake        = errors.New("doMSEHandshake")
+	ErrBtHandshake         = errors.New("doBtHandshake")
+	ErrCorruptHandshake    = errors.New("corrupt BitTorrent handshake received")
+	ErrNoExtensionProtocol = errors.New("peer does not support the extension protocol")
+	ErrExHandshake         = errors.New("doExHandshake")
+	ErrMetadataSize        = errors.New("metadata too big or its size is less than or equal zero")
+	ErrNoUTMetadata        = errors.New("ut_metadata is not an uint8")
+	ErrRequestPieces       = errors.New("requestPieces")
+	ErrReadPiece           = errors.New("readUmMessage")
+	ErrDecodePiece         = errors.New("could not decode ext msg in the loop")
+	ErrRejected            = errors.New("remote peer rejected sending metadata")
+	ErrPieceTooBig         = errors.New("metadataPiece > 16kiB")
+	ErrPieceIncomplete     = errors.New("metadataPiece < 16 kiB but incomplete")
+	ErrMetadataOverflow    = errors.New("metadataReceived > metadataSize")
+	ErrInfoHashMismatch    = errors.New("infohash mismatch")
+	ErrInvalidInfo         = errors.New("invalid info dictionary")
+	ErrNegativeFileSize    = errors.New("file size less than zero")
+)
+
+// LeechOptions configure how a Leech reaches its peer.
+type LeechOptions struct {
+	Timeouts   LeechTimeouts
+	Encryption EncryptionPolicy
+	Dialer     *Dialer // nil dials TCP only
+}
+
+// LeechStats describe the connection of a Leech to its peer, whatever the outcome of the fetch.
+type LeechStats struct {
+	Transport Transport // of the last connection; empty if the peer could not be connected to
+	Encrypted bool      // whether the last connection is RC4 encrypted
+
+	// Advertised by the peer in its extension handshake, if it got that far.
+	Client     string // "v", the name and version of the client
+	YourIP     net.IP // "yourip", our IP address as seen by the peer
+	Reqq       int    // "reqq", the number of outstanding requests the peer accepts
+	ListenPort int    // "p", the port the peer listens on
+}
+
+// LeechTimeouts bound the phases of a metadata fetch. The context passed to Leech.Do bounds the
+// fetch as a whole.
+type LeechTimeouts struct {
+	Connect   time.Duration // dialing the peer
+	Handshake time.Duration // the BitTorrent and the extension handshakes
+	Piece     time.Duration // receiving each metadata piece
+}
+
 type rootDict struct {
 	M            mDict `bencode:"m"`
 	MetadataSize int   `bencode:"metadata_size"`
 }
 
+// Fields of the extension handshake that are not required to fetch the metadata. They are decoded
+// leniently, as clients disagree on their types more often than one would hope.
+type exHandshakeExtras struct {
+	client     string
+	yourIP     net.IP
+	reqq       int
+	listenPort int
+}
+
+// maxClientLength caps the length of the client names we keep.
+const maxClientLength = 64
+
+// defaultReqq is the number of outstanding requests assumed of peers that do not advertise reqq,
+// following libtorrent as BEP 10 suggests.
+const defaultReqq = 250
+
+func parseExHandshakeExtras(dump []byte) exHandshakeExtras {
+	var extras exHandshakeExtras
+
+	var dict map[string]any
+	// The dictionary has already been decoded once, so an error here is not worth failing over;
+	// whatever has been decoded before it is kept.
+	_ = bencode.Unmarshal(dump, &dict)
+
+	if v, ok := dict["v"].(string); ok {
+		v = strings.ToValidUTF8(strings.TrimSpace(v), "")
+		if len(v) > maxClientLength {
+			v = strings.ToValidUTF8(v[:maxClientLength], "")
+		}
+		extras.client = v
+	}
+	if yourIP, ok := dict["yourip"].(string); ok && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		extras.yourIP = net.IP(yourIP)
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		extras.reqq = int(reqq)
+	}
+	if p, ok := dict["p"].(int64); ok && 0 < p && p < 65536 {
+		extras.listenPort = int(p)
+	}
+
+	return extras
+}
+
 type mDict struct {
 	UTMetadata int `bencode:"ut_metadata"`
 }
@@ -35,16 +130,29 @@ type extDict struct {
 }
 
 type Leech struct {
-	infoHash [20]byte
-	peerAddr *net.TCPAddr
-	ev       LeechEventHandlers
+	infoHash   [20]byte
+	peerAddr   *net.TCPAddr
+	timeouts   LeechTimeouts
+	encryption EncryptionPolicy
+	dialer     *Dialer
+	ev         LeechEventHandlers
+
+	transport Transport
+	encrypted bool
 
-	conn     *net.TCPConn
-	clientID [20]byte
+	ctx        context.Context
+	conn       net.Conn // guarded by deadlineMx, as watchContext may access it concurrently
+	clientID   [20]byte
+	deadlineMx sync.Mutex
 
 	ut_metadata                    uint8
 	metadataReceived, metadataSize uint
 	metadata                       []byte
+	extras                         exHandshakeExtras
+
+	// nextPiece is the next metadata piece to request, and outstanding the number of requests
+	// that have not been answered yet, which is kept below the reqq of the peer.
+	nextPiece, outstanding int
 
 	connClosed bool
 }
@@ -54,10 +162,13 @@ type LeechEventHandlers struct {
 	OnError   func([20]byte, error) // must be supplied. args: infohash, error
 }
 
-func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, ev LeechEventHandlers) *Leech {
+func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, opts LeechOptions, ev LeechEventHandlers) *Leech {
 	l := new(Leech)
 	l.infoHash = infoHash
 	l.peerAddr = peerAddr
+	l.timeouts = opts.Timeouts
+	l.encryption = opts.Encryption
+	l.dialer = opts.Dialer
 	copy(l.clientID[:], clientID)
 	l.ev = ev
 
@@ -75,6 +186,33 @@ func (l *Leech) writeAll(b []byte) error {
 	return nil
 }
 
+// doMSEHandshake wraps the connection in Message Stream Encryption, offering cryptoProvide.
+func (l *Leech) doMSEHandshake(cryptoProvide uint32) error {
+	conn, err := mseInitiate(l.conn, l.infoHash, cryptoProvide)
+	if err != nil {
+		return err
+	}
+
+	l.deadlineMx.Lock()
+	l.conn = conn
+	l.deadlineMx.Unlock()
+
+	l.encrypted = conn.(*mseConn).enc != nil
+	return nil
+}
+
+// Stats returns the stats of the Leech. It must not be called before Do has returned.
+func (l *Leech) Stats() LeechStats {
+	return LeechStats{
+		Transport:  l.transport,
+		Encrypted:  l.encrypted,
+		Client:     l.extras.client,
+		YourIP:     l.extras.yourIP,
+		Reqq:       l.extras.reqq,
+		ListenPort: l.extras.listenPort,
+	}
+}
+
 func (l *Leech) doBtHandshake() error {
 	lHandshake := []byte(fmt.Sprintf(
 		"\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x01%s%s",
@@ -89,21 +227,21 @@ func (l *Leech) doBtHandshake() error {
 
 	err := l.writeAll(lHandshake)
 	if err != nil {
-		return errors.New("writeAll lHandshake " + err.Error())
+		return fmt.Errorf("writeAll lHandshake %w", err)
 	}
 
 	rHandshake, err := l.readExactly(68)
 	if err != nil {
-		return errors.New("readExactly rHandshake " + err.Error())
+		return fmt.Errorf("readExactly rHandshake %w", err)
 	}
 	if !bytes.HasPrefix(rHandshake, []byte("\x13BitTorrent protocol")) {
-		return fmt.Errorf("corrupt BitTorrent handshake received")
+		return ErrCorruptHandshake
 	}
 
 	// TODO: maybe check for the infohash sent by the remote peer to double check?
 
 	if (rHandshake[25] & 0x10) == 0 {
-		return fmt.Errorf("peer does not support the extension protocol")
+		return ErrNoExtensionProtocol
 	}
 
 	return nil
@@ -112,49 +250,56 @@ func (l *Leech) doBtHandshake() error {
 func (l *Leech) doExHandshake() error {
 	err := l.writeAll([]byte("\x00\x00\x00\x1a\x14\x00d1:md11:ut_metadatai1eee"))
 	if err != nil {
-		return errors.New("writeAll lHandshake " + err.Error())
+		return fmt.Errorf("writeAll lHandshake %w", err)
 	}
 
 	rExMessage, err := l.readExMessage()
 	if err != nil {
-		return errors.New("readExMessage " + err.Error())
+		return fmt.Errorf("readExMessage %w", err)
 	}
 
 	// Extension Handshake has the Extension Message ID = 0x00
 	if rExMessage[1] != 0 {
-		return errors.New("first extension message is not an extension handshake " + err.Error())
+		return errors.New("first extension message is not an extension handshake")
 	}
 
 	rRootDict := new(rootDict)
 	err = bencode.Unmarshal(rExMessage[2:], rRootDict)
 	if err != nil {
-		return errors.New("unmarshal rExMessage " + err.Error())
+		return fmt.Errorf("unmarshal rExMessage %w", err)
 	}
 
 	if !(0 < rRootDict.MetadataSize && rRootDict.MetadataSize < MaxMetadataSize) {
-		return fmt.Errorf("metadata too big or its size is less than or equal zero")
+		return ErrMetadataSize
 	}
 
 	if !(0 < rRootDict.M.UTMetadata && rRootDict.M.UTMetadata < 255) {
-		return fmt.Errorf("ut_metadata is not an uint8")
+		return ErrNoUTMetadata
 	}
 
 	l.ut_metadata = uint8(rRootDict.M.UTMetadata) // Save the ut_metadata code the remote peer uses
 	l.metadataSize = uint(rRootDict.MetadataSize)
 	l.metadata = make([]byte, l.metadataSize)
+	l.extras = parseExHandshakeExtras(rExMessage[2:])
 
 	return nil
 }
 
-func (l *Leech) requestAllPieces() error {
-	// Request all the pieces of metadata
+// requestPieces requests as many of the remaining pieces of metadata as the peer accepts to have
+// outstanding.
+func (l *Leech) requestPieces() error {
+	reqq := l.extras.reqq
+	if reqq == 0 {
+		reqq = defaultReqq
+	}
+
 	nPieces := int(math.Ceil(float64(l.metadataSize) / math.Pow(2, 14)))
-	for piece := 0; piece < nPieces; piece++ {
+	for ; l.nextPiece < nPieces && l.outstanding < reqq; l.nextPiece++ {
 		// __request_metadata_piece(piece)
 		// ...............................
 		extDictDump, err := bencode.Marshal(extDict{
 			MsgType: 0,
-			Piece:   piece,
+			Piece:   l.nextPiece,
 		})
 		if err != nil { // ASSERT
 			panic(errors.New("marshal extDict " + err.Error()))
@@ -167,8 +312,9 @@ func (l *Leech) requestAllPieces() error {
 			extDictDump,
 		)))
 		if err != nil {
-			return errors.New("writeAll piece request " + err.Error())
+			return fmt.Errorf("writeAll piece request %w", err)
 		}
+		l.outstanding++
 	}
 
 	return nil
@@ -178,7 +324,7 @@ func (l *Leech) requestAllPieces() error {
 func (l *Leech) readMessage() ([]byte, error) {
 	rLengthB, err := l.readExactly(4)
 	if err != nil {
-		return nil, errors.New("readExactly rLengthB " + err.Error())
+		return nil, fmt.Errorf("readExactly rLengthB %w", err)
 	}
 
 	rLength := uint(binary.BigEndian.Uint32(rLengthB))
@@ -193,7 +339,7 @@ func (l *Leech) readMessage() ([]byte, error) {
 
 	rMessage, err := l.readExactly(rLength)
 	if err != nil {
-		return nil, errors.New("readExactly rMessage " + err.Error())
+		return nil, fmt.Errorf("readExactly rMessage %w", err)
 	}
 
 	return rMessage, nil
@@ -206,7 +352,7 @@ func (l *Leech) readExMessage() ([]byte, error) {
 	for {
 		rMessage, err := l.readMessage()
 		if err != nil {
-			return nil, errors.New("readMessage " + err.Error())
+			return nil, fmt.Errorf("readMessage %w", err)
 		}
 
 		// Every extension message has at least 2 bytes.
@@ -229,7 +375,7 @@ func (l *Leech) readUmMessage() ([]byte, error) {
 	for {
 		rExMessage, err := l.readExMessage()
 		if err != nil {
-			return nil, errors.New("readExMessage " + err.Error())
+			return nil, fmt.Errorf("readExMessage %w", err)
 		}
 
 		if rExMessage[1] == 0x01 {
@@ -238,87 +384,168 @@ func (l *Leech) readUmMessage() ([]byte, error) {
 	}
 }
 
-func (l *Leech) connect(deadline time.Time) error {
+// connect connects to the peer over the first transport that works, or over the one that worked
+// last time when reconnecting.
+func (l *Leech) connect() error {
+	transports := l.dialer.transports()
+	if l.transport != "" {
+		transports = []Transport{l.transport}
+	}
+
 	var err error
+	for _, transport := range transports {
+		var conn net.Conn
+		conn, err = l.dialer.dial(l.ctx, transport, l.peerAddr, l.timeouts.Connect)
+		if err != nil {
+			if l.ctx.Err() != nil {
+				break
+			}
+			continue
+		}
 
-	x, err := net.DialTimeout("tcp4", l.peerAddr.String(), 1*time.Second)
-	if err != nil {
-		return errors.New("dial " + err.Error())
+		l.deadlineMx.Lock()
+		l.conn = conn
+		l.connClosed = false
+		l.deadlineMx.Unlock()
+
+		l.transport = transport
+		return nil
 	}
-	l.conn = x.(*net.TCPConn)
 
-	// > If sec == 0, operating system discards any unsent or unacknowledged data [after Close()
-	// > has been called].
-	err = l.conn.SetLinger(0)
-	if err != nil {
-		if err := l.conn.Close(); err != nil {
-			log.Panicf("couldn't close leech connection! %v", err)
+	return err
+}
+
+// connectAndHandshake connects to the peer and does the BitTorrent handshake, once for every
+// attempt the encryption policy makes, until one of them succeeds.
+func (l *Leech) connectAndHandshake() error {
+	var err error
+	for _, cryptoProvide := range l.encryption.attempts() {
+		l.closeConn()
+		l.encrypted = false
+
+		err = l.connect()
+		if err != nil {
+			// Whether encrypted or not, a peer we cannot connect to is not worth trying again.
+			return fmt.Errorf("%w %w", ErrConnect, err)
 		}
-		return errors.New("SetLinger " + err.Error())
-	}
 
-	err = l.conn.SetNoDelay(true)
-	if err != nil {
-		if err := l.conn.Close(); err != nil {
-			log.Panicf("couldn't close leech connection! %v", err)
+		err = l.setPhaseDeadline(l.timeouts.Handshake)
+		if err != nil {
+			return fmt.Errorf("%w %w", ErrBtHandshake, err)
 		}
-		return errors.New("NODELAY " + err.Error())
-	}
 
-	err = l.conn.SetDeadline(deadline)
-	if err != nil {
-		if err := l.conn.Close(); err != nil {
-			log.Panicf("couldn't close leech connection! %v", err)
+		if cryptoProvide != 0 {
+			err = l.doMSEHandshake(cryptoProvide)
+			if err != nil {
+				err = fmt.Errorf("%w %w", ErrMSEHandshake, err)
+			}
+		}
+		if err == nil {
+			err = l.doBtHandshake()
+			if err != nil {
+				err = fmt.Errorf("%w %w", ErrBtHandshake, err)
+			}
+		}
+
+		// A peer that does not support the extension protocol will not support it any better
+		// when spoken to differently.
+		if err == nil || errors.Is(err, ErrNoExtensionProtocol) || l.ctx.Err() != nil {
+			return err
 		}
-		return errors.New("SetDeadline " + err.Error())
 	}
 
+	return err
+}
+
+// setPhaseDeadline sets the deadline of the connection to timeout from now, or to the deadline of
+// the context if that comes sooner.
+func (l *Leech) setPhaseDeadline(timeout time.Duration) error {
+	l.deadlineMx.Lock()
+	defer l.deadlineMx.Unlock()
+
+	// Checking the context while holding the lock guarantees that we never push the deadline back
+	// after watchContext has cut the connection short.
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := l.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	if err := l.conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("SetDeadline %w", err)
+	}
 	return nil
 }
 
+// watchContext is a goroutine! It interrupts any pending read or write on the connection as soon
+// as the context is done, until stop is closed.
+func (l *Leech) watchContext(stop <-chan struct{}) {
+	select {
+	case <-l.ctx.Done():
+		l.deadlineMx.Lock()
+		if l.conn != nil {
+			_ = l.conn.SetDeadline(time.Unix(1, 0))
+		}
+		l.deadlineMx.Unlock()
+
+	case <-stop:
+	}
+}
+
 func (l *Leech) closeConn() {
-	if l.connClosed {
+	if l.conn == nil || l.connClosed {
 		return
 	}
 
 	if err := l.conn.Close(); err != nil {
-		log.Panicf("couldn't close leech connection! %v", err)
+		leechLogger.Debug("could not close the connection", "peer", l.peerAddr, "err", err)
 		return
 	}
 
 	l.connClosed = true
 }
 
-func (l *Leech) Do(deadline time.Time) {
-	err := l.connect(deadline)
-	if err != nil {
-		l.OnError(errors.New("connect " + err.Error()))
-		return
-	}
+// Do fetches the metadata and reports the outcome to the event handlers. Cancelling ctx aborts
+// the fetch at any point.
+func (l *Leech) Do(ctx context.Context) {
+	l.ctx = ctx
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go l.watchContext(stopWatching)
 	defer l.closeConn()
 
-	err = l.doBtHandshake()
+	err := l.connectAndHandshake()
 	if err != nil {
-		l.OnError(errors.New("doBtHandshake " + err.Error()))
+		l.OnError(err)
 		return
 	}
 
 	err = l.doExHandshake()
 	if err != nil {
-		l.OnError(errors.New("doExHandshake " + err.Error()))
+		l.OnError(fmt.Errorf("%w %w", ErrExHandshake, err))
 		return
 	}
 
-	err = l.requestAllPieces()
+	err = l.requestPieces()
 	if err != nil {
-		l.OnError(errors.New("requestAllPieces " + err.Error()))
+		l.OnError(fmt.Errorf("%w %w", ErrRequestPieces, err))
 		return
 	}
 
 	for l.metadataReceived < l.metadataSize {
+		err = l.setPhaseDeadline(l.timeouts.Piece)
+		if err != nil {
+			l.OnError(fmt.Errorf("%w %w", ErrReadPiece, err))
+			return
+		}
+
 		rUmMessage, err := l.readUmMessage()
 		if err != nil {
-			l.OnError(errors.New("readUmMessage " + err.Error()))
+			l.OnError(fmt.Errorf("%w %w", ErrReadPiece, err))
 			return
 		}
 
@@ -327,12 +554,12 @@ func (l *Leech) Do(deadline time.Time) {
 		rExtDict := new(extDict)
 		err = bencode.NewDecoder(rMessageBuf).Decode(rExtDict)
 		if err != nil {
-			l.OnError(errors.New("could not decode ext msg in the loop " + err.Error()))
+			l.OnError(fmt.Errorf("%w %w", ErrDecodePiece, err))
 			return
 		}
 
 		if rExtDict.MsgType == 2 { // reject
-			l.OnError(fmt.Errorf("remote peer rejected sending metadata"))
+			l.OnError(ErrRejected)
 			return
 		}
 
@@ -347,7 +574,7 @@ func (l *Leech) Do(deadline time.Time) {
 			// Hence...
 			//   ... if the length of @metadataPiece is more than 16kiB, we err.
 			if len(metadataPiece) > 16*1024 {
-				l.OnError(fmt.Errorf("metadataPiece > 16kiB"))
+				l.OnError(ErrPieceTooBig)
 				return
 			}
 
@@ -359,12 +586,19 @@ func (l *Leech) Do(deadline time.Time) {
 			// ... if the length of @metadataPiece is less than 16kiB AND metadata is NOT
 			// complete then we err.
 			if len(metadataPiece) < 16*1024 && l.metadataReceived != l.metadataSize {
-				l.OnError(fmt.Errorf("metadataPiece < 16 kiB but incomplete"))
+				l.OnError(ErrPieceIncomplete)
 				return
 			}
 
 			if l.metadataReceived > l.metadataSize {
-				l.OnError(fmt.Errorf("metadataReceived > metadataSize"))
+				l.OnError(ErrMetadataOverflow)
+				return
+			}
+
+			l.outstanding--
+			err = l.requestPieces()
+			if err != nil {
+				l.OnError(fmt.Errorf("%w %w", ErrRequestPieces, err))
 				return
 			}
 		}
@@ -374,46 +608,48 @@ func (l *Leech) Do(deadline time.Time) {
 	// error.
 	l.closeConn()
 
-	// Verify the checksum
+	// Verify the checksum. BEP 52 truncates the SHA-256 info hash of v2 torrents to 20 bytes
+	// wherever the protocol has no room for more, such as the DHT and the BitTorrent handshake.
 	sha1Sum := sha1.Sum(l.metadata)
-	if !bytes.Equal(sha1Sum[:], l.infoHash[:]) {
-		l.OnError(fmt.Errorf("infohash mismatch"))
+	sha256Sum := sha256.Sum256(l.metadata)
+	if !bytes.Equal(sha1Sum[:], l.infoHash[:]) && !bytes.Equal(sha256Sum[:20], l.infoHash[:]) {
+		l.OnError(ErrInfoHashMismatch)
 		return
 	}
 
 	// Check the info dictionary
-	info := new(metainfo.Info)
-	err = bencode.Unmarshal(l.metadata, info)
+	info, ext, err := parseInfo(l.metadata)
 	if err != nil {
-		l.OnError(errors.New("unmarshal info " + err.Error()))
+		l.OnError(fmt.Errorf("%w: unmarshal info %w", ErrInvalidInfo, err))
 		return
 	}
-	err = validateInfo(info)
+	err = validateInfo(info, ext)
 	if err != nil {
-		l.OnError(errors.New("validateInfo " + err.Error()))
+		l.OnError(fmt.Errorf("%w: validateInfo %w", ErrInvalidInfo, err))
 		return
 	}
 
-	var files []persistence.File
-	// If there is only one file, there won't be a Files slice. That's why we need to add it here
-	if len(info.Files) == 0 {
-		files = append(files, persistence.File{
-			Size: info.Length,
-			Path: info.Name,
-		})
-	} else {
-		for _, file := range info.Files {
-			files = append(files, persistence.File{
-				Size: file.Length,
-				Path: file.DisplayPath(info),
-			})
-		}
+	// Hybrid torrents are identified by their v1 info hash, even when we have been looking them up
+	// by their v2 one; v2-only torrents have no choice but the truncated one.
+	infoHash := l.infoHash[:]
+	var infoHashV2 []byte
+	if ext.isV2() {
+		infoHashV2 = sha256Sum[:]
+	}
+	if len(info.Pieces) > 0 {
+		infoHash = sha1Sum[:]
+	}
+
+	files, err := parseFiles(info, ext)
+	if err != nil {
+		l.OnError(fmt.Errorf("%w: parseFiles %w", ErrInvalidInfo, err))
+		return
 	}
 
 	var totalSize uint64
 	for _, file := range files {
 		if file.Size < 0 {
-			l.OnError(fmt.Errorf("file size less than zero"))
+			l.OnError(ErrNegativeFileSize)
 			return
 		}
 
@@ -421,16 +657,33 @@ func (l *Leech) Do(deadline time.Time) {
 	}
 
 	l.ev.OnSuccess(Metadata{
-		InfoHash:     l.infoHash[:],
-		Name:         info.Name,
-		TotalSize:    totalSize,
-		DiscoveredOn: time.Now().Unix(),
-		Files:        files,
+		InfoHash:       infoHash,
+		InfoHashV2:     infoHashV2,
+		Name:           info.Name,
+		TotalSize:      totalSize,
+		DiscoveredOn:   time.Now().Unix(),
+		Files:          files,
+		Info:           l.metadata,
+		TorrentDetails: parseDetails(info, ext, files),
 	})
 }
 
-// COPIED FROM anacrolix/torrent.
-func validateInfo(info *metainfo.Info) error {
+// COPIED FROM anacrolix/torrent, and extended for v2 torrents.
+func validateInfo(info *metainfo.Info, ext *extendedInfo) error {
+	if ext.isV2() {
+		// BEP 52: "It must be a power of two and at least 16KiB."
+		if info.PieceLength < 16*1024 || info.PieceLength&(info.PieceLength-1) != 0 {
+			return errors.New("piece length is not a power of two of at least 16KiB")
+		}
+		if len(ext.FileTree) == 0 {
+			return errors.New("missing file tree")
+		}
+		// Hybrid torrents carry a v1 pieces string too, which the checks below apply to.
+		if len(info.Pieces) == 0 {
+			return nil
+		}
+	}
+
 	if len(info.Pieces)%20 != 0 {
 		return errors.New("pieces has invalid length")
 	}
@@ -453,6 +706,10 @@ func (l *Leech) readExactly(n uint) ([]byte, error) {
 }
 
 func (l *Leech) OnError(err error) {
+	// Errors caused by the context being done are reported as such, whatever the phase.
+	if ctxErr := l.ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		err = fmt.Errorf("%w: %w", err, ctxErr)
+	}
 	l.ev.OnError(l.infoHash, err)
 }
 
@@ -1,10 +1,21 @@
 package metadata
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
 )
 
 var operationsTestInstances = []struct {
@@ -42,3 +53,343 @@ func TestDecoder(t *testing.T) {
 		}
 	}
 }
+
+// fakePeer is an in-process peer that serves the given info dictionary over BEP 9, or misbehaves
+// as instructed.
+type fakePeer struct {
+	listener   net.Listener
+	metadata   []byte
+	reject     bool // reply to every piece request with a reject message
+	stall      bool // never reply to the extension handshake
+	mse        bool // accept MSE handshakes
+	requireMSE bool // hang up on plaintext handshakes
+	reqq       int  // advertise reqq, and hang up on leeches that exceed it
+
+	// maxOutstanding is the highest number of requests the leech had outstanding at once.
+	maxOutstanding atomic.Int32
+}
+
+func newFakePeer(t *testing.T, metadata []byte) *fakePeer {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Skipping due to an error during initialization! %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	return &fakePeer{listener: listener, metadata: metadata}
+}
+
+func (p *fakePeer) addr() *net.TCPAddr {
+	// uTP listeners have UDP addresses, but leeches address all peers alike.
+	addr, err := net.ResolveTCPAddr("tcp4", p.listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// serve serves the connections of leeches one after the other, until the listener is closed.
+func (p *fakePeer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.handle(conn)
+	}
+}
+
+func (p *fakePeer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	protocol, err := r.Peek(20)
+	if err != nil {
+		return
+	}
+	if string(protocol) == "\x13BitTorrent protocol" {
+		if p.requireMSE {
+			return
+		}
+		conn = &mseConn{Conn: conn, r: r}
+	} else {
+		if !p.mse {
+			return
+		}
+		conn, err = mseRespond(conn, r, sha1.Sum(p.metadata))
+		if err != nil {
+			return
+		}
+	}
+
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	// Echo the handshake back, as it advertises the extension protocol already.
+	if _, err := conn.Write(handshake); err != nil {
+		return
+	}
+
+	if _, err := readTestMessage(conn); err != nil || p.stall {
+		// Keep the connection open until the leech hangs up.
+		_, _ = io.Copy(io.Discard, conn)
+		return
+	}
+
+	exHandshake := map[string]any{
+		"m":             map[string]int{"ut_metadata": 3},
+		"metadata_size": len(p.metadata),
+		"v":             "FakePeer/1.0",
+		"yourip":        string(net.IPv4(127, 0, 0, 1).To4()),
+		"p":             6881,
+	}
+	if p.reqq > 0 {
+		exHandshake["reqq"] = p.reqq
+	}
+	exHandshakeDump, _ := bencode.Marshal(exHandshake)
+	writeTestMessage(conn, append([]byte{20, 0}, exHandshakeDump...))
+
+	for {
+		requests, err := p.readRequests(conn)
+		if err != nil {
+			return
+		}
+		for _, request := range requests {
+			p.reply(conn, request)
+		}
+	}
+}
+
+// readRequests returns the requests the leech sent in a row, waiting for the leech to stop
+// sending if the peer advertises reqq.
+func (p *fakePeer) readRequests(conn net.Conn) ([][]byte, error) {
+	request, err := readTestMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	requests := [][]byte{request}
+
+	for p.reqq > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		request, err = readTestMessage(conn)
+		if err != nil {
+			break
+		}
+		requests = append(requests, request)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if n := int32(len(requests)); n > p.maxOutstanding.Load() {
+		p.maxOutstanding.Store(n)
+	}
+	if p.reqq > 0 && len(requests) > p.reqq {
+		return nil, errors.New("reqq exceeded")
+	}
+	return requests, nil
+}
+
+func (p *fakePeer) reply(conn net.Conn, request []byte) {
+	var rExtDict extDict
+	if err := bencode.Unmarshal(request[2:], &rExtDict); err != nil {
+		return
+	}
+
+	if p.reject {
+		reply, _ := bencode.Marshal(extDict{MsgType: 2, Piece: rExtDict.Piece})
+		writeTestMessage(conn, append([]byte{20, 1}, reply...))
+		return
+	}
+
+	start := rExtDict.Piece * 16 * 1024
+	end := start + 16*1024
+	if end > len(p.metadata) {
+		end = len(p.metadata)
+	}
+	reply, _ := bencode.Marshal(extDict{MsgType: 1, Piece: rExtDict.Piece})
+	reply = append(append([]byte{20, 1}, reply...), p.metadata[start:end]...)
+	writeTestMessage(conn, reply)
+}
+
+func readTestMessage(conn net.Conn) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint32(length))
+	_, err := io.ReadFull(conn, message)
+	return message, err
+}
+
+func writeTestMessage(conn net.Conn, message []byte) {
+	_, _ = conn.Write(append(toBigEndian(uint(len(message)), 4), message...))
+}
+
+func testInfo(t *testing.T) ([20]byte, []byte) {
+	info, err := bencode.Marshal(metainfo.Info{
+		Name:        "test.txt",
+		PieceLength: 16 * 1024,
+		Pieces:      make([]byte, 20),
+		Length:      100,
+	})
+	if err != nil {
+		t.Fatalf("could not marshal info: %v", err)
+	}
+	return sha1.Sum(info), info
+}
+
+var testTimeouts = LeechTimeouts{
+	Connect:   time.Second,
+	Handshake: time.Second,
+	Piece:     time.Second,
+}
+
+func doTestLeech(ctx context.Context, infoHash [20]byte, encryption EncryptionPolicy, peer *fakePeer) (*Metadata, error) {
+	md, _, err := doTestLeechWith(ctx, infoHash, LeechOptions{
+		Timeouts:   testTimeouts,
+		Encryption: encryption,
+	}, peer)
+	return md, err
+}
+
+func doTestLeechWith(ctx context.Context, infoHash [20]byte, opts LeechOptions, peer *fakePeer) (*Metadata, LeechStats, error) {
+	var md *Metadata
+	var leechErr error
+	leech := NewLeech(infoHash, peer.addr(), randomID(), opts, LeechEventHandlers{
+		OnSuccess: func(m Metadata) { md = &m },
+		OnError:   func(_ [20]byte, err error) { leechErr = err },
+	})
+	leech.Do(ctx)
+	return md, leech.Stats(), leechErr
+}
+
+func TestLeechFetchesMetadata(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	md, err := doTestLeech(context.Background(), infoHash, PreferPlaintext, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if md.Name != "test.txt" || md.TotalSize != 100 || len(md.Files) != 1 {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	if !bytes.Equal(md.Info, info) {
+		t.Errorf("expected the raw info dictionary to be kept")
+	}
+}
+
+func TestLeechReportsRejection(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	peer.reject = true
+	go peer.serve()
+
+	_, err := doTestLeech(context.Background(), infoHash, PreferPlaintext, peer)
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+}
+
+func TestLeechReportsInfoHashMismatch(t *testing.T) {
+	_, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	_, err := doTestLeech(context.Background(), [20]byte{1}, PreferPlaintext, peer)
+	if !errors.Is(err, ErrInfoHashMismatch) {
+		t.Errorf("expected ErrInfoHashMismatch, got %v", err)
+	}
+}
+
+func TestLeechCancellation(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	peer.stall = true
+	go peer.serve()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := doTestLeech(ctx, infoHash, PreferPlaintext, peer)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if !errors.Is(err, ErrExHandshake) {
+		t.Errorf("expected ErrExHandshake, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= testTimeouts.Handshake {
+		t.Errorf("expected cancellation to cut the handshake short, took %v", elapsed)
+	}
+}
+
+func TestLeechFetchesV2Metadata(t *testing.T) {
+	info := []byte("d9:file treed8:test.txtd0:d6:lengthi100eeee12:meta versioni2e4:name8:test.txt12:piece lengthi16384ee")
+	v2InfoHash := sha256.Sum256(info)
+	var infoHash [20]byte
+	copy(infoHash[:], v2InfoHash[:20])
+
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	md, err := doTestLeech(context.Background(), infoHash, PreferPlaintext, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(md.InfoHash, infoHash[:]) || !bytes.Equal(md.InfoHashV2, v2InfoHash[:]) {
+		t.Errorf("unexpected info hashes %x and %x", md.InfoHash, md.InfoHashV2)
+	}
+	if md.TotalSize != 100 || len(md.Files) != 1 || md.Files[0].Path != "test.txt" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+}
+
+func TestLeechRecordsExtensionHandshake(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	_, stats, err := doTestLeechWith(context.Background(), infoHash, LeechOptions{Timeouts: testTimeouts}, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Client != "FakePeer/1.0" || !stats.YourIP.Equal(net.IPv4(127, 0, 0, 1)) || stats.ListenPort != 6881 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.Reqq != 0 {
+		t.Errorf("expected no reqq, got %d", stats.Reqq)
+	}
+}
+
+func TestLeechRespectsReqq(t *testing.T) {
+	// 2000 pieces take 40000 bytes, hence 3 metadata pieces.
+	info, err := bencode.Marshal(metainfo.Info{
+		Name:        "test.txt",
+		PieceLength: 16 * 1024,
+		Pieces:      make([]byte, 2000*20),
+		Length:      2000 * 16 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("could not marshal info: %v", err)
+	}
+
+	peer := newFakePeer(t, info)
+	peer.reqq = 1
+	go peer.serve()
+
+	md, stats, err := doTestLeechWith(context.Background(), sha1.Sum(info), LeechOptions{Timeouts: testTimeouts}, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(md.Info, info) {
+		t.Errorf("expected the raw info dictionary to be fetched")
+	}
+	if stats.Reqq != 1 {
+		t.Errorf("expected reqq 1, got %d", stats.Reqq)
+	}
+	if n := peer.maxOutstanding.Load(); n != 1 {
+		t.Errorf("expected at most 1 outstanding request, got %d", n)
+	}
+}
@@ -0,0 +1,257 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+)
+
+// Message Stream Encryption (also known as Protocol Encryption) obfuscates BitTorrent connections
+// with a Diffie-Hellman key exchange followed by an RC4 stream. Many peers refuse plaintext
+// connections altogether.
+//
+// https://wiki.vuze.com/w/Message_Stream_Encryption
+
+// EncryptionPolicy decides whether leeches use Message Stream Encryption.
+type EncryptionPolicy int
+
+const (
+	// PreferPlaintext connects in plaintext, and retries with encryption if the peer hangs up
+	// during the handshake.
+	PreferPlaintext EncryptionPolicy = iota
+	// PreferEncrypted connects with encryption, and retries in plaintext if the encrypted
+	// handshake fails.
+	PreferEncrypted
+	// RequireEncrypted only ever connects with RC4 encryption.
+	RequireEncrypted
+)
+
+// crypto_provide and crypto_select bits.
+const (
+	msePlaintext uint32 = 0x01
+	mseRC4       uint32 = 0x02
+)
+
+const (
+	mseKeyLen = 96  // length of the public keys and of the shared secret
+	mseMaxPad = 512 // maximum length of the random paddings
+)
+
+var (
+	mseP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+
+	// Verification constant.
+	mseVC = make([]byte, 8)
+)
+
+// attempts returns the crypto_provide of every connection attempt the policy makes, in order,
+// where zero stands for a plaintext connection.
+func (p EncryptionPolicy) attempts() []uint32 {
+	switch p {
+	case PreferEncrypted:
+		return []uint32{mseRC4 | msePlaintext, 0}
+	case RequireEncrypted:
+		return []uint32{mseRC4}
+	default:
+		return []uint32{0, mseRC4 | msePlaintext}
+	}
+}
+
+// mseConn is a net.Conn past the MSE handshake. If RC4 was selected, everything written to and
+// read from it is encrypted and decrypted on the fly; otherwise it is plaintext, save for the
+// handshake.
+type mseConn struct {
+	net.Conn
+	r        io.Reader // buffered, as we may have read past the handshake
+	enc, dec *rc4.Cipher
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	// Never encrypt the caller's buffer in place.
+	encrypted := make([]byte, len(b))
+	c.enc.XORKeyStream(encrypted, b)
+	n, err := c.Conn.Write(encrypted)
+	return n, err
+}
+
+// mseInitiate performs the initiating side of the MSE handshake on conn, offering cryptoProvide,
+// and returns the resulting connection.
+func mseInitiate(conn net.Conn, infoHash [20]byte, cryptoProvide uint32) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	xa, ya, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFull(conn, append(ya, msePad()...)); err != nil {
+		return nil, fmt.Errorf("write Ya %w", err)
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	yb := make([]byte, mseKeyLen)
+	if _, err = io.ReadFull(r, yb); err != nil {
+		return nil, fmt.Errorf("read Yb %w", err)
+	}
+	secret := mseSecret(yb, xa)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//         ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	enc := mseCipher("keyA", secret, infoHash)
+	dec := mseCipher("keyB", secret, infoHash)
+
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	var payload bytes.Buffer
+	payload.Write(mseVC)
+	_ = binary.Write(&payload, binary.BigEndian, cryptoProvide)
+	_ = binary.Write(&payload, binary.BigEndian, uint16(0)) // len(PadC)
+	_ = binary.Write(&payload, binary.BigEndian, uint16(0)) // len(IA)
+	encrypted := make([]byte, payload.Len())
+	enc.XORKeyStream(encrypted, payload.Bytes())
+
+	var step3 bytes.Buffer
+	step3.Write(mseHash([]byte("req1"), secret))
+	step3.Write(req2)
+	step3.Write(encrypted)
+	if err = writeFull(conn, step3.Bytes()); err != nil {
+		return nil, fmt.Errorf("write req %w", err)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	//
+	// PadB is of unknown length, so we look for the encrypted VC to find where it ends.
+	encryptedVC := make([]byte, len(mseVC))
+	mseCipher("keyB", secret, infoHash).XORKeyStream(encryptedVC, mseVC)
+	if err = mseSync(r, encryptedVC, mseMaxPad+len(encryptedVC)); err != nil {
+		return nil, fmt.Errorf("sync VC %w", err)
+	}
+	dec.XORKeyStream(make([]byte, len(mseVC)), mseVC)
+
+	header := make([]byte, 6)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read crypto_select %w", err)
+	}
+	dec.XORKeyStream(header, header)
+
+	cryptoSelect := binary.BigEndian.Uint32(header[:4])
+	padDLen := int(binary.BigEndian.Uint16(header[4:]))
+	if padDLen > mseMaxPad {
+		return nil, errors.New("padD too long")
+	}
+	padD := make([]byte, padDLen)
+	if _, err = io.ReadFull(r, padD); err != nil {
+		return nil, fmt.Errorf("read padD %w", err)
+	}
+	dec.XORKeyStream(padD, padD)
+
+	switch {
+	case cryptoSelect&cryptoProvide == 0 || (cryptoSelect != mseRC4 && cryptoSelect != msePlaintext):
+		return nil, fmt.Errorf("peer selected unoffered crypto method %#x", cryptoSelect)
+
+	case cryptoSelect == msePlaintext:
+		return &mseConn{Conn: conn, r: r}, nil
+
+	default:
+		return &mseConn{Conn: conn, r: r, enc: enc, dec: dec}, nil
+	}
+}
+
+// mseKeyPair returns a random private key, and the matching public key padded to mseKeyLen bytes.
+func mseKeyPair() (*big.Int, []byte, error) {
+	private := make([]byte, 20)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(private)
+	y := new(big.Int).Exp(mseG, x, mseP)
+	return x, y.FillBytes(make([]byte, mseKeyLen)), nil
+}
+
+func mseSecret(y []byte, x *big.Int) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(y), x, mseP)
+	return s.FillBytes(make([]byte, mseKeyLen))
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 cipher keyed with HASH(name, S, SKEY), having discarded the first 1024
+// bytes of its keystream as the specification mandates.
+func mseCipher(name string, secret []byte, infoHash [20]byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(mseHash([]byte(name), secret, infoHash[:]))
+	if err != nil { // ASSERT
+		panic(err)
+	}
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// msePad returns random padding of random length.
+func msePad() []byte {
+	pad := make([]byte, mrand.Intn(mseMaxPad+1))
+	_, _ = rand.Read(pad)
+	return pad
+}
+
+// mseSync consumes r up to and including marker, giving up after limit bytes.
+func mseSync(r *bufio.Reader, marker []byte, limit int) error {
+	var window []byte
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errors.New("marker not found")
+}
+
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) != 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// mseRespond performs the receiving side of the MSE handshake on conn, whose buffered reader is r,
+// selecting RC4 whenever the initiator provides it.
+func mseRespond(conn net.Conn, r *bufio.Reader, infoHash [20]byte) (net.Conn, error) {
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	xb, yb, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFull(conn, append(yb, msePad()...)); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(ya, xb)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, ...)
+	if err = mseSync(r, mseHash([]byte("req1"), secret), mseMaxPad+20); err != nil {
+		return nil, err
+	}
+	req23 := make([]byte, 20)
+	if _, err = io.ReadFull(r, req23); err != nil {
+		return nil, err
+	}
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	if !bytes.Equal(req2, req23) {
+		return nil, errors.New("unknown SKEY")
+	}
+
+	dec := mseCipher("keyA", secret, infoHash)
+	enc := mseCipher("keyB", secret, infoHash)
+
+	header := make([]byte, 14)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, errors.New("bad VC")
+	}
+	cryptoProvide := binary.BigEndian.Uint32(header[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:])+2) // PadC, len(IA)
+	if _, err = io.ReadFull(r, padC); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	ia := make([]byte, binary.BigEndian.Uint16(padC[len(padC)-2:]))
+	if _, err = io.ReadFull(r, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	cryptoSelect := msePlaintext
+	if cryptoProvide&mseRC4 != 0 {
+		cryptoSelect = mseRC4
+	}
+	var reply bytes.Buffer
+	reply.Write(mseVC)
+	_ = binary.Write(&reply, binary.BigEndian, cryptoSelect)
+	_ = binary.Write(&reply, binary.BigEndian, uint16(0))
+	encrypted := make([]byte, reply.Len())
+	enc.XORKeyStream(encrypted, reply.Bytes())
+	if err = writeFull(conn, encrypted); err != nil {
+		return nil, err
+	}
+
+	if cryptoSelect == msePlaintext {
+		return &mseConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), r)}, nil
+	}
+	return &mseConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), r), enc: enc, dec: dec}, nil
+}
+
+func TestMSERoundTrip(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Skipping due to an error during initialization! %v", err)
+	}
+	defer listener.Close()
+
+	infoHash := [20]byte{1, 2, 3}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		wrapped, err := mseRespond(conn, bufio.NewReader(conn), infoHash)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(wrapped, io.LimitReader(wrapped, 5))
+	}()
+
+	conn, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+
+	wrapped, err := mseInitiate(conn, infoHash, mseRC4)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if wrapped.(*mseConn).enc == nil {
+		t.Errorf("expected RC4 to be selected")
+	}
+
+	message := []byte("hello")
+	if _, err = wrapped.Write(message); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	echo := make([]byte, len(message))
+	if _, err = io.ReadFull(wrapped, echo); err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if !bytes.Equal(echo, message) {
+		t.Errorf("expected the echo %q, got %q", message, echo)
+	}
+}
+
+func TestLeechFallsBackToEncryption(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	peer.mse = true
+	peer.requireMSE = true
+	go peer.serve()
+
+	md, err := doTestLeech(context.Background(), infoHash, PreferPlaintext, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(md.Info, info) {
+		t.Errorf("expected the raw info dictionary to be fetched")
+	}
+}
+
+func TestLeechPrefersEncryption(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	peer.mse = true
+	go peer.serve()
+
+	_, stats, err := doTestLeechWith(context.Background(), infoHash, LeechOptions{
+		Timeouts:   testTimeouts,
+		Encryption: PreferEncrypted,
+	}, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stats.Encrypted {
+		t.Errorf("expected the connection to be encrypted")
+	}
+}
+
+func TestLeechFallsBackToPlaintext(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	if _, err := doTestLeech(context.Background(), infoHash, PreferEncrypted, peer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLeechRequiresEncryption(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	_, err := doTestLeech(context.Background(), infoHash, RequireEncrypted, peer)
+	if !errors.Is(err, ErrMSEHandshake) {
+		t.Errorf("expected ErrMSEHandshake, got %v", err)
+	}
+}
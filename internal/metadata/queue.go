@@ -0,0 +1,218 @@
+package metadata
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+// pendingInfoHash is an info hash waiting for a free leech slot, along with every peer we have
+// been told about so far.
+type pendingInfoHash struct {
+	infoHash  [20]byte
+	peerAddrs []net.TCPAddr
+	sightings int
+	firstSeen time.Time
+
+	index int // position in pendingHeap, maintained by container/heap.
+}
+
+// pendingHeap orders pending info hashes so that the most frequently sighted ones come first,
+// and among those the ones that have been waiting the longest.
+type pendingHeap []*pendingInfoHash
+
+func (h pendingHeap) Len() int { return len(h) }
+
+func (h pendingHeap) Less(i, j int) bool {
+	if h[i].sightings != h[j].sightings {
+		return h[i].sightings > h[j].sightings
+	}
+	return h[i].firstSeen.Before(h[j].firstSeen)
+}
+
+func (h pendingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *pendingHeap) Push(x any) {
+	p := x.(*pendingInfoHash)
+	p.index = len(*h)
+	*h = append(*h, p)
+}
+
+func (h *pendingHeap) Pop() any {
+	old := *h
+	n := len(old)
+	p := old[n-1]
+	old[n-1] = nil
+	p.index = -1
+	*h = old[:n-1]
+	return p
+}
+
+// QueueStats are cumulative counters of the pending info hash queue.
+type QueueStats struct {
+	Queued  uint64 // info hashes accepted into the queue
+	Merged  uint64 // sightings merged into an info hash that was already queued
+	Dropped uint64 // info hashes rejected because the queue was full
+	Expired uint64 // info hashes that waited longer than the maximum age
+}
+
+// infoHashQueue is a bounded, deduplicating priority queue of info hashes whose metadata is yet
+// to be fetched.
+type infoHashQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	heap    pendingHeap
+	byHash  map[[20]byte]*pendingInfoHash
+	maxLen  int
+	maxAge  time.Duration
+	closed  bool
+	nowFunc func() time.Time
+
+	queued, merged, dropped, expired atomic.Uint64
+}
+
+func newInfoHashQueue(maxLen int, maxAge time.Duration) *infoHashQueue {
+	q := new(infoHashQueue)
+	q.cond = sync.NewCond(&q.mu)
+	q.byHash = make(map[[20]byte]*pendingInfoHash)
+	q.maxLen = maxLen
+	q.maxAge = maxAge
+	q.nowFunc = time.Now
+	return q
+}
+
+// push adds an info hash to the queue, or merges peerAddrs into it if it is already queued.
+// It returns false if the info hash was dropped because the queue is full.
+func (q *infoHashQueue) push(infoHash [20]byte, peerAddrs []net.TCPAddr) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	if p, exists := q.byHash[infoHash]; exists {
+		p.sightings++
+		p.peerAddrs = mergePeerAddrs(p.peerAddrs, peerAddrs)
+		heap.Fix(&q.heap, p.index)
+		q.merged.Add(1)
+		metrics.SinkQueueEvents.WithLabelValues("merged").Inc()
+		return true
+	}
+
+	if len(q.heap) >= q.maxLen {
+		q.expireLocked()
+	}
+	// A newcomer has a single sighting and is the youngest entry, hence it would be the lowest
+	// priority item in the queue anyway.
+	if len(q.heap) >= q.maxLen {
+		q.dropped.Add(1)
+		metrics.SinkQueueEvents.WithLabelValues("dropped").Inc()
+		return false
+	}
+
+	p := &pendingInfoHash{
+		infoHash:  infoHash,
+		peerAddrs: mergePeerAddrs(nil, peerAddrs),
+		sightings: 1,
+		firstSeen: q.nowFunc(),
+	}
+	heap.Push(&q.heap, p)
+	q.byHash[infoHash] = p
+	q.queued.Add(1)
+	metrics.SinkQueueEvents.WithLabelValues("queued").Inc()
+	q.cond.Signal()
+
+	return true
+}
+
+// pop blocks until an info hash is available, and returns it. It returns false once the queue is
+// closed.
+func (q *infoHashQueue) pop() (*pendingInfoHash, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return nil, false
+		}
+
+		q.expireLocked()
+		if len(q.heap) > 0 {
+			p := heap.Pop(&q.heap).(*pendingInfoHash)
+			delete(q.byHash, p.infoHash)
+			return p, true
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// expireLocked removes every info hash that has been waiting for longer than maxAge. q.mu must be
+// held.
+func (q *infoHashQueue) expireLocked() {
+	if q.maxAge <= 0 {
+		return
+	}
+
+	deadline := q.nowFunc().Add(-q.maxAge)
+	for i := 0; i < len(q.heap); {
+		p := q.heap[i]
+		if p.firstSeen.Before(deadline) {
+			heap.Remove(&q.heap, i)
+			delete(q.byHash, p.infoHash)
+			q.expired.Add(1)
+			metrics.SinkQueueEvents.WithLabelValues("expired").Inc()
+			// heap.Remove moved another item into position i, so look at it again.
+			continue
+		}
+		i++
+	}
+}
+
+func (q *infoHashQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.heap)
+}
+
+func (q *infoHashQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *infoHashQueue) stats() QueueStats {
+	return QueueStats{
+		Queued:  q.queued.Load(),
+		Merged:  q.merged.Load(),
+		Dropped: q.dropped.Load(),
+		Expired: q.expired.Load(),
+	}
+}
+
+// mergePeerAddrs appends the addresses in src that are not already in dst.
+func mergePeerAddrs(dst []net.TCPAddr, src []net.TCPAddr) []net.TCPAddr {
+	for _, addr := range src {
+		seen := false
+		for _, existing := range dst {
+			if existing.Port == addr.Port && existing.IP.Equal(addr.IP) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			dst = append(dst, addr)
+		}
+	}
+	return dst
+}
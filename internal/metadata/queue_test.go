@@ -0,0 +1,160 @@
+package metadata
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+func testPeer(port int) net.TCPAddr {
+	return net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestQueueDeduplicatesAndMergesPeers(t *testing.T) {
+	q := newInfoHashQueue(10, 0)
+	infoHash := [20]byte{1}
+
+	q.push(infoHash, []net.TCPAddr{testPeer(1), testPeer(2)})
+	q.push(infoHash, []net.TCPAddr{testPeer(2), testPeer(3)})
+
+	if q.len() != 1 {
+		t.Fatalf("expected 1 queued info hash, got %d", q.len())
+	}
+
+	p, ok := q.pop()
+	if !ok {
+		t.Fatalf("expected pop to succeed")
+	}
+	if p.sightings != 2 {
+		t.Errorf("expected 2 sightings, got %d", p.sightings)
+	}
+	if len(p.peerAddrs) != 3 {
+		t.Errorf("expected 3 distinct peers, got %v", p.peerAddrs)
+	}
+
+	stats := q.stats()
+	if stats.Queued != 1 || stats.Merged != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestQueuePrioritizesSightingsThenAge(t *testing.T) {
+	q := newInfoHashQueue(10, 0)
+	now := time.Unix(1000, 0)
+	q.nowFunc = func() time.Time { return now }
+
+	older, newer, popular := [20]byte{1}, [20]byte{2}, [20]byte{3}
+	q.push(older, []net.TCPAddr{testPeer(1)})
+	now = now.Add(time.Second)
+	q.push(newer, []net.TCPAddr{testPeer(1)})
+	now = now.Add(time.Second)
+	q.push(popular, []net.TCPAddr{testPeer(1)})
+	q.push(popular, []net.TCPAddr{testPeer(2)})
+
+	for _, expected := range [][20]byte{popular, older, newer} {
+		p, _ := q.pop()
+		if p.infoHash != expected {
+			t.Errorf("expected %x, got %x", expected, p.infoHash)
+		}
+	}
+}
+
+func TestQueueDropsWhenFull(t *testing.T) {
+	q := newInfoHashQueue(1, 0)
+
+	if !q.push([20]byte{1}, []net.TCPAddr{testPeer(1)}) {
+		t.Errorf("expected first push to succeed")
+	}
+	if q.push([20]byte{2}, []net.TCPAddr{testPeer(1)}) {
+		t.Errorf("expected second push to be dropped")
+	}
+	if q.stats().Dropped != 1 {
+		t.Errorf("expected 1 dropped info hash, got %d", q.stats().Dropped)
+	}
+}
+
+func TestQueueExpiresOldEntries(t *testing.T) {
+	q := newInfoHashQueue(1, time.Minute)
+	now := time.Unix(1000, 0)
+	q.nowFunc = func() time.Time { return now }
+
+	q.push([20]byte{1}, []net.TCPAddr{testPeer(1)})
+	now = now.Add(2 * time.Minute)
+
+	// The stale entry makes room for the new one.
+	if !q.push([20]byte{2}, []net.TCPAddr{testPeer(1)}) {
+		t.Errorf("expected push to succeed after expiry")
+	}
+	if q.stats().Expired != 1 {
+		t.Errorf("expected 1 expired info hash, got %d", q.stats().Expired)
+	}
+
+	p, _ := q.pop()
+	if p.infoHash != [20]byte{2} {
+		t.Errorf("expected the fresh info hash, got %x", p.infoHash)
+	}
+}
+
+func TestQueuePopReturnsAfterClose(t *testing.T) {
+	q := newInfoHashQueue(1, 0)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pop()
+		done <- ok
+	}()
+
+	q.close()
+	if <-done {
+		t.Errorf("expected pop to fail on a closed queue")
+	}
+}
+
+// queueEvents returns the values of the queue event counters exported to Prometheus, by event.
+func queueEvents(t *testing.T) map[string]float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %v", err)
+	}
+	events := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "magnetico_sink_queue_events_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			events[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	return events
+}
+
+func TestQueueExportsItsCounters(t *testing.T) {
+	before := queueEvents(t)
+
+	q := newInfoHashQueue(1, time.Minute)
+	now := time.Unix(1000, 0)
+	q.nowFunc = func() time.Time { return now }
+	q.push([20]byte{1}, []net.TCPAddr{testPeer(1)})
+	q.push([20]byte{1}, []net.TCPAddr{testPeer(2)})
+	q.push([20]byte{2}, []net.TCPAddr{testPeer(1)})
+	now = now.Add(2 * time.Minute)
+	q.push([20]byte{3}, []net.TCPAddr{testPeer(1)})
+
+	after := queueEvents(t)
+	stats := q.stats()
+	for event, n := range map[string]uint64{
+		"queued":  stats.Queued,
+		"merged":  stats.Merged,
+		"dropped": stats.Dropped,
+		"expired": stats.Expired,
+	} {
+		if after[event]-before[event] != float64(n) {
+			t.Errorf("expected %d %s info hashes to be exported, got %v", n, event, after[event]-before[event])
+		}
+	}
+	if stats != (QueueStats{Queued: 2, Merged: 1, Dropped: 1, Expired: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
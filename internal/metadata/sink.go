@@ -1,18 +1,34 @@
 package metadata
 
 import (
-	"log"
+	"context"
+	"encoding/hex"
+	"errors"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/t-richards/magnetico/internal/dht"
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/metrics"
 	"github.com/t-richards/magnetico/internal/persistence"
+	"github.com/t-richards/magnetico/internal/stats"
+)
+
+var (
+	leechLogger = logging.For(logging.Leech)
+	sinkLogger  = logging.For(logging.Sink)
 )
 
 type Metadata struct {
+	// InfoHash is the SHA-1 info hash of v1 and hybrid torrents, and the truncated SHA-256 info
+	// hash of v2-only torrents.
 	InfoHash []byte
+	// InfoHashV2 is the full SHA-256 info hash of v2 and hybrid torrents, nil otherwise.
+	InfoHashV2 []byte
 	// Name should be thought of "Title" of the torrent. For single-file torrents, it is the name
 	// of the file, and for multi-file torrents, it is the name of the root directory.
 	Name         string
@@ -20,21 +36,58 @@ type Metadata struct {
 	DiscoveredOn int64
 	// Files must be populated for both single-file and multi-file torrents!
 	Files []persistence.File
+	// Info is the raw bencoded info dictionary, as verified against InfoHash.
+	Info []byte
+
+	persistence.TorrentDetails
 }
 
 type Sink struct {
 	PeerID      []byte
 	deadline    time.Duration
+	leechOpts   LeechOptions
 	maxNLeeches int
 	drain       chan Metadata
 
-	incomingInfoHashes   map[[20]byte][]net.TCPAddr
-	incomingInfoHashesMx sync.Mutex
+	// queue holds the info hashes waiting for one of the maxNLeeches workers to pick them up.
+	queue *infoHashQueue
+
+	// failures remembers the info hashes that could not be fetched from any of their peers. May be
+	// nil.
+	failures *FailureCache
+
+	// inFlightInfoHashes are the info hashes that a worker is currently leeching.
+	inFlightInfoHashes   map[[20]byte]struct{}
+	inFlightInfoHashesMx sync.Mutex
+
+	// fetches counts the successful fetches by transport, and encryptedFetches those of them
+	// over an encrypted connection.
+	fetches          map[Transport]uint64
+	encryptedFetches uint64
+	fetchesMx        sync.Mutex
+
+	clients *clientStats
 
-	terminated  bool
+	// ctx is cancelled upon termination, aborting every leech in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	terminated  atomic.Bool
 	termination chan any
+}
+
+// SinkStats is a snapshot of the Sink's queue and workers.
+type SinkStats struct {
+	QueueStats
+
+	QueueLength int // info hashes currently waiting in the queue
+	InFlight    int // info hashes currently being leeched
 
-	deleted int
+	Fetches          map[Transport]uint64 // successful fetches by transport
+	EncryptedFetches uint64               // successful fetches over an encrypted connection
+
+	Clients    map[string]ClientStats // outcomes by the client of the peer
+	ExternalIP net.IP                 // as reported by most peers; nil if unknown
 }
 
 func randomID() []byte {
@@ -71,95 +124,209 @@ func randomDigit() byte {
 	return byte(rand.Intn(max-min) + min)
 }
 
-func NewSink(deadline time.Duration, maxNLeeches int) *Sink {
+// NewSink creates a Sink that fetches metadata using at most maxNLeeches concurrent leeches, each
+// of which gives up on a peer after deadline or after any of the timeouts of leechOpts.
+// Info hashes that arrive while all leeches are busy wait in a queue of at most queueSize
+// entries, for at most queueMaxAge (zero means forever). Info hashes that fail are recorded in
+// failures, unless it is nil.
+func NewSink(deadline time.Duration, leechOpts LeechOptions, maxNLeeches int, queueSize int, queueMaxAge time.Duration, failures *FailureCache) *Sink {
 	ms := new(Sink)
 
 	ms.PeerID = randomID()
 	ms.deadline = deadline
+	ms.leechOpts = leechOpts
 	ms.maxNLeeches = maxNLeeches
 	ms.drain = make(chan Metadata, 10)
-	ms.incomingInfoHashes = make(map[[20]byte][]net.TCPAddr)
+	ms.queue = newInfoHashQueue(queueSize, queueMaxAge)
+	ms.failures = failures
+	ms.inFlightInfoHashes = make(map[[20]byte]struct{})
+	ms.fetches = make(map[Transport]uint64)
+	ms.clients = newClientStats()
 	ms.termination = make(chan any)
+	ms.ctx, ms.cancel = context.WithCancel(context.Background())
 
-	go func() {
-		for range time.Tick(deadline) {
-			ms.deleted = 0
-		}
-	}()
+	for i := 0; i < maxNLeeches; i++ {
+		go ms.work()
+	}
 
 	return ms
 }
 
+// Sink queues the info hash of res for metadata fetching. It never blocks: if the queue is full,
+// the info hash is dropped (and counted as such).
 func (ms *Sink) Sink(res dht.Result) {
-	if ms.terminated {
-		log.Panicln("Trying to Sink() an already closed Sink!")
+	if ms.terminated.Load() {
+		panic("Trying to Sink() an already closed Sink!")
 	}
-	ms.incomingInfoHashesMx.Lock()
-	defer ms.incomingInfoHashesMx.Unlock()
 
-	// cap the max # of leeches
-	if len(ms.incomingInfoHashes) >= ms.maxNLeeches {
+	infoHash := res.InfoHash()
+	peerAddrs := res.PeerAddrs()
+	if len(peerAddrs) == 0 {
 		return
 	}
 
-	infoHash := res.InfoHash()
-	peerAddrs := res.PeerAddrs()
+	ms.inFlightInfoHashesMx.Lock()
+	_, inFlight := ms.inFlightInfoHashes[infoHash]
+	ms.inFlightInfoHashesMx.Unlock()
+	if inFlight {
+		return
+	}
+
+	ms.queue.push(infoHash, peerAddrs)
+	metrics.SinkQueueLength.Set(float64(ms.queue.len()))
+}
+
+// Stats returns a snapshot of the queue counters and the current number of queued and in-flight
+// info hashes.
+func (ms *Sink) Stats() SinkStats {
+	ms.inFlightInfoHashesMx.Lock()
+	inFlight := len(ms.inFlightInfoHashes)
+	ms.inFlightInfoHashesMx.Unlock()
+
+	ms.fetchesMx.Lock()
+	fetches := make(map[Transport]uint64, len(ms.fetches))
+	for transport, n := range ms.fetches {
+		fetches[transport] = n
+	}
+	encryptedFetches := ms.encryptedFetches
+	ms.fetchesMx.Unlock()
+
+	clients, externalIP := ms.clients.snapshot()
+
+	return SinkStats{
+		QueueStats:       ms.queue.stats(),
+		QueueLength:      ms.queue.len(),
+		InFlight:         inFlight,
+		Fetches:          fetches,
+		EncryptedFetches: encryptedFetches,
+		Clients:          clients,
+		ExternalIP:       externalIP,
+	}
+}
+
+// work is a goroutine! It pops info hashes off the queue and tries their peers one after another
+// until the metadata is fetched or the peers are exhausted.
+func (ms *Sink) work() {
+	for {
+		pending, ok := ms.queue.pop()
+		if !ok {
+			return
+		}
+		metrics.SinkQueueLength.Set(float64(ms.queue.len()))
+
+		ms.inFlightInfoHashesMx.Lock()
+		ms.inFlightInfoHashes[pending.infoHash] = struct{}{}
+		ms.inFlightInfoHashesMx.Unlock()
+		metrics.SinkInFlight.Inc()
+
+		ms.leech(pending)
+
+		ms.inFlightInfoHashesMx.Lock()
+		delete(ms.inFlightInfoHashes, pending.infoHash)
+		ms.inFlightInfoHashesMx.Unlock()
+		metrics.SinkInFlight.Dec()
+	}
+}
+
+func (ms *Sink) leech(pending *pendingInfoHash) {
+	var lastErr error
+	for i := range pending.peerAddrs {
+		if ms.terminated.Load() {
+			return
+		}
+
+		succeeded := false
+		var leechErr error
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(ms.ctx, ms.deadline)
+		leech := NewLeech(pending.infoHash, &pending.peerAddrs[i], ms.PeerID, ms.leechOpts, LeechEventHandlers{
+			OnSuccess: func(md Metadata) {
+				succeeded = true
+				ms.flush(md)
+			},
+			OnError: func(_ [20]byte, err error) {
+				leechErr = err
+			},
+		})
+		leech.Do(ctx)
+		cancel()
+
+		ms.clients.record(leech.Stats(), succeeded)
+		observeLeech(start, succeeded, leechErr)
+
+		if leechErr != nil {
+			lastErr = leechErr
+			leechLogger.Debug("could not fetch metadata", "infohash", hex.EncodeToString(pending.infoHash[:]),
+				"peer", &pending.peerAddrs[i], "err", leechErr)
+		}
+		if succeeded {
+			sinkLogger.Debug("fetched metadata", "infohash", hex.EncodeToString(pending.infoHash[:]),
+				"peer", &pending.peerAddrs[i], "transport", leech.Stats().Transport)
+			ms.countFetch(leech.Stats())
+			if ms.failures != nil {
+				ms.failures.Forget(pending.infoHash)
+			}
+			return
+		}
+	}
 
-	if _, exists := ms.incomingInfoHashes[infoHash]; exists {
+	// Being cut short by our own termination says nothing about the info hash.
+	if errors.Is(lastErr, context.Canceled) {
 		return
-	} else if len(peerAddrs) > 0 {
-		peer := peerAddrs[0]
-		ms.incomingInfoHashes[infoHash] = peerAddrs[1:]
+	}
+	if ms.failures != nil && lastErr != nil {
+		ms.failures.RecordFailure(pending.infoHash, lastErr)
+	}
+}
+
+func observeLeech(start time.Time, succeeded bool, err error) {
+	metrics.LeechDuration.WithLabelValues(strconv.FormatBool(succeeded)).Observe(time.Since(start).Seconds())
+	if succeeded {
+		metrics.LeechOutcomes.WithLabelValues("success").Inc()
+		stats.Default.RecordLeech("")
+	} else {
+		class := string(classifyError(err))
+		metrics.LeechOutcomes.WithLabelValues(class).Inc()
+		stats.Default.RecordLeech(class)
+	}
+}
 
-		go NewLeech(infoHash, &peer, ms.PeerID, LeechEventHandlers{
-			OnSuccess: ms.flush,
-			OnError:   ms.onLeechError,
-		}).Do(time.Now().Add(ms.deadline))
+func (ms *Sink) countFetch(stats LeechStats) {
+	ms.fetchesMx.Lock()
+	defer ms.fetchesMx.Unlock()
+
+	ms.fetches[stats.Transport]++
+	if stats.Encrypted {
+		ms.encryptedFetches++
 	}
+	metrics.LeechFetches.WithLabelValues(string(stats.Transport), strconv.FormatBool(stats.Encrypted)).Inc()
 }
 
 func (ms *Sink) Drain() <-chan Metadata {
-	if ms.terminated {
-		log.Panicln("Trying to Drain() an already closed Sink!")
+	if ms.terminated.Load() {
+		panic("Trying to Drain() an already closed Sink!")
 	}
 	return ms.drain
 }
 
+// Terminate stops the workers and aborts the leeches in progress. The drain channel is left open,
+// as workers might still be racing to flush into it.
 func (ms *Sink) Terminate() {
-	ms.terminated = true
+	ms.terminated.Store(true)
+	ms.queue.close()
+	ms.cancel()
 	close(ms.termination)
-	close(ms.drain)
 }
 
 func (ms *Sink) flush(result Metadata) {
-	if ms.terminated {
+	if ms.terminated.Load() {
 		return
 	}
 
-	ms.drain <- result
-	// Delete the infoHash from ms.incomingInfoHashes ONLY AFTER once we've flushed the
-	// metadata!
-	ms.incomingInfoHashesMx.Lock()
-	defer ms.incomingInfoHashesMx.Unlock()
-
-	var infoHash [20]byte
-	copy(infoHash[:], result.InfoHash)
-	delete(ms.incomingInfoHashes, infoHash)
-}
-
-func (ms *Sink) onLeechError(infoHash [20]byte, err error) {
-	ms.incomingInfoHashesMx.Lock()
-	defer ms.incomingInfoHashesMx.Unlock()
-
-	if len(ms.incomingInfoHashes[infoHash]) > 0 {
-		peer := ms.incomingInfoHashes[infoHash][0]
-		ms.incomingInfoHashes[infoHash] = ms.incomingInfoHashes[infoHash][1:]
-		go NewLeech(infoHash, &peer, ms.PeerID, LeechEventHandlers{
-			OnSuccess: ms.flush,
-			OnError:   ms.onLeechError,
-		}).Do(time.Now().Add(ms.deadline))
-	} else {
-		ms.deleted++
-		delete(ms.incomingInfoHashes, infoHash)
+	// The worker removes the info hash from ms.inFlightInfoHashes only after this returns, that
+	// is ONLY AFTER we've flushed the metadata!
+	select {
+	case ms.drain <- result:
+	case <-ms.termination:
 	}
 }
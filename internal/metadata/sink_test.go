@@ -0,0 +1,57 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+// fetchesExported returns the values of the fetch counters exported to Prometheus, by transport and
+// encryption.
+func fetchesExported(t *testing.T) map[string]float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %v", err)
+	}
+	fetches := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "magnetico_leech_fetches_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var transport, encrypted string
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "transport":
+					transport = label.GetValue()
+				case "encrypted":
+					encrypted = label.GetValue()
+				}
+			}
+			fetches[transport+" "+encrypted] = metric.GetCounter().GetValue()
+		}
+	}
+	return fetches
+}
+
+func TestSinkCountsFetches(t *testing.T) {
+	ms := NewSink(time.Second, LeechOptions{}, 1, 1, 0, nil)
+	defer ms.Terminate()
+
+	before := fetchesExported(t)
+	ms.countFetch(LeechStats{Transport: TransportTCP})
+	ms.countFetch(LeechStats{Transport: TransportTCP, Encrypted: true})
+	ms.countFetch(LeechStats{Transport: TransportUTP, Encrypted: true})
+	after := fetchesExported(t)
+
+	stats := ms.Stats()
+	if stats.Fetches[TransportTCP] != 2 || stats.Fetches[TransportUTP] != 1 || stats.EncryptedFetches != 2 {
+		t.Errorf("unexpected fetches %v, %d of them encrypted", stats.Fetches, stats.EncryptedFetches)
+	}
+	for _, labels := range []string{"tcp false", "tcp true", "utp true"} {
+		if after[labels]-before[labels] != 1 {
+			t.Errorf("expected 1 fetch to be exported as %q, got %v", labels, after[labels]-before[labels])
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/anacrolix/utp"
+)
+
+// Transport is the protocol a leech reaches its peer over.
+type Transport string
+
+const (
+	TransportTCP Transport = "tcp"
+	TransportUTP Transport = "utp" // BEP 29
+)
+
+// TransportStrategy decides which transports leeches try, and in which order.
+type TransportStrategy int
+
+const (
+	// TCPOnly never uses uTP.
+	TCPOnly TransportStrategy = iota
+	// UTPOnly never uses TCP.
+	UTPOnly
+	// PreferTCP tries TCP first, and uTP if the peer cannot be connected to over TCP.
+	PreferTCP
+	// PreferUTP tries uTP first, and TCP if the peer cannot be connected to over uTP.
+	PreferUTP
+)
+
+func (s TransportStrategy) transports() []Transport {
+	switch s {
+	case UTPOnly:
+		return []Transport{TransportUTP}
+	case PreferTCP:
+		return []Transport{TransportTCP, TransportUTP}
+	case PreferUTP:
+		return []Transport{TransportUTP, TransportTCP}
+	default:
+		return []Transport{TransportTCP}
+	}
+}
+
+func (s TransportStrategy) usesUTP() bool {
+	return s != TCPOnly
+}
+
+// Dialer connects leeches to their peers over the transports of its strategy.
+//
+// All the uTP connections of a Dialer are multiplexed over a single UDP socket, rather than each
+// leech binding a port of its own. It is not the socket of the DHT indexer, which reads and writes
+// its datagrams through raw system calls.
+type Dialer struct {
+	strategy  TransportStrategy
+	utpSocket *utp.Socket // nil unless the strategy uses uTP
+}
+
+// NewDialer creates a Dialer that follows strategy, binding its uTP socket (if any) to utpAddr.
+func NewDialer(strategy TransportStrategy, utpAddr string) (*Dialer, error) {
+	d := new(Dialer)
+	d.strategy = strategy
+
+	if strategy.usesUTP() {
+		var err error
+		d.utpSocket, err = utp.NewSocket("udp4", utpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("could not create the uTP socket %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+// Close closes the uTP socket of the Dialer, aborting all of its connections.
+func (d *Dialer) Close() error {
+	if d == nil || d.utpSocket == nil {
+		return nil
+	}
+	return d.utpSocket.Close()
+}
+
+// transports returns the transports to try in order. A nil Dialer only dials TCP.
+func (d *Dialer) transports() []Transport {
+	if d == nil {
+		return TCPOnly.transports()
+	}
+	return d.strategy.transports()
+}
+
+func (d *Dialer) dial(ctx context.Context, transport Transport, addr *net.TCPAddr, timeout time.Duration) (net.Conn, error) {
+	if transport == TransportUTP {
+		if d == nil || d.utpSocket == nil { // ASSERT
+			panic("dialing uTP without a uTP socket")
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := d.utpSocket.DialContext(ctx, "udp4", addr.String())
+		if err != nil {
+			return nil, fmt.Errorf("dial uTP %w", err)
+		}
+		return conn, nil
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	x, err := dialer.DialContext(ctx, "tcp4", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("dial %w", err)
+	}
+	conn := x.(*net.TCPConn)
+
+	// > If sec == 0, operating system discards any unsent or unacknowledged data [after Close()
+	// > has been called].
+	err = conn.SetLinger(0)
+	if err != nil {
+		if err := conn.Close(); err != nil {
+			leechLogger.Debug("could not close the connection", "peer", addr, "err", err)
+		}
+		return nil, fmt.Errorf("SetLinger %w", err)
+	}
+
+	err = conn.SetNoDelay(true)
+	if err != nil {
+		if err := conn.Close(); err != nil {
+			leechLogger.Debug("could not close the connection", "peer", addr, "err", err)
+		}
+		return nil, fmt.Errorf("NODELAY %w", err)
+	}
+
+	return conn, nil
+}
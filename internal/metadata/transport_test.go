@@ -0,0 +1,115 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/utp"
+)
+
+// newFakeUTPPeer is like newFakePeer, but the peer is only reachable over uTP.
+func newFakeUTPPeer(t *testing.T, metadata []byte) *fakePeer {
+	socket, err := utp.NewSocket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Skipping due to an error during initialization! %v", err)
+	}
+	t.Cleanup(func() { socket.Close() })
+
+	return &fakePeer{listener: socket, metadata: metadata}
+}
+
+func newTestDialer(t *testing.T, strategy TransportStrategy) *Dialer {
+	dialer, err := NewDialer(strategy, "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Skipping due to an error during initialization! %v", err)
+	}
+	t.Cleanup(func() { dialer.Close() })
+	return dialer
+}
+
+func TestTransportStrategies(t *testing.T) {
+	cases := map[TransportStrategy][]Transport{
+		TCPOnly:   {TransportTCP},
+		UTPOnly:   {TransportUTP},
+		PreferTCP: {TransportTCP, TransportUTP},
+		PreferUTP: {TransportUTP, TransportTCP},
+	}
+
+	for strategy, expected := range cases {
+		transports := strategy.transports()
+		if len(transports) != len(expected) {
+			t.Errorf("expected %v for strategy %d, got %v", expected, strategy, transports)
+			continue
+		}
+		for i := range expected {
+			if transports[i] != expected[i] {
+				t.Errorf("expected %v for strategy %d, got %v", expected, strategy, transports)
+			}
+		}
+	}
+
+	var dialer *Dialer
+	if transports := dialer.transports(); len(transports) != 1 || transports[0] != TransportTCP {
+		t.Errorf("expected a nil dialer to dial TCP only, got %v", transports)
+	}
+}
+
+func TestLeechFetchesMetadataOverUTP(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakeUTPPeer(t, info)
+	go peer.serve()
+
+	md, stats, err := doTestLeechWith(context.Background(), infoHash, LeechOptions{
+		Timeouts: testTimeouts,
+		Dialer:   newTestDialer(t, UTPOnly),
+	}, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if md.Name != "test.txt" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	if stats.Transport != TransportUTP {
+		t.Errorf("expected the fetch to go over uTP, got %q", stats.Transport)
+	}
+}
+
+func TestLeechFallsBackToUTP(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakeUTPPeer(t, info)
+	go peer.serve()
+
+	// Nothing listens on the TCP port of the same number, so the connection is refused at once.
+	_, stats, err := doTestLeechWith(context.Background(), infoHash, LeechOptions{
+		Timeouts: testTimeouts,
+		Dialer:   newTestDialer(t, PreferTCP),
+	}, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Transport != TransportUTP {
+		t.Errorf("expected the fetch to fall back to uTP, got %q", stats.Transport)
+	}
+}
+
+func TestLeechReportsTCPTransport(t *testing.T) {
+	infoHash, info := testInfo(t)
+	peer := newFakePeer(t, info)
+	go peer.serve()
+
+	start := time.Now()
+	_, stats, err := doTestLeechWith(context.Background(), infoHash, LeechOptions{
+		Timeouts: testTimeouts,
+		Dialer:   newTestDialer(t, PreferTCP),
+	}, peer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Transport != TransportTCP || stats.Encrypted {
+		t.Errorf("expected a plaintext TCP fetch, got %+v", stats)
+	}
+	if elapsed := time.Since(start); elapsed >= testTimeouts.Connect {
+		t.Errorf("expected uTP not to be tried, took %v", elapsed)
+	}
+}
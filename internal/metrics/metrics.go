@@ -0,0 +1,208 @@
+// Package metrics holds the Prometheus metrics of the crawler, the leeches, the database and the
+// web interface, which the web interface serves on /metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "magnetico"
+
+// Registry holds every metric below, along with the Go runtime and process ones.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// DHT.
+var (
+	// DHTMessages counts the DHT messages received ("in") and sent ("out"), by their type ("q",
+	// "r" or "e") and query, which is deduced from the contents of responses.
+	DHTMessages = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dht",
+		Name:      "messages_total",
+		Help:      "DHT messages by direction, type and query.",
+	}, []string{"direction", "type", "query"})
+
+	// DHTSendsThrottled counts the sends that the kernel refused because we are sending too fast.
+	DHTSendsThrottled = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dht",
+		Name:      "sends_throttled_total",
+		Help:      "DHT messages that could not be sent due to congestion.",
+	})
+
+	// DHTSendsDropped counts the sends that failed for any other reason.
+	DHTSendsDropped = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dht",
+		Name:      "sends_dropped_total",
+		Help:      "DHT messages that could not be sent due to an error.",
+	})
+
+	// DHTResultsDropped counts the indexing results dropped because the crawler could not keep up.
+	DHTResultsDropped = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dht",
+		Name:      "results_dropped_total",
+		Help:      "Discovered info hashes dropped because the output of the DHT manager was full.",
+	})
+
+	// RoutingTableSize is the number of nodes in the routing table of each indexing service.
+	RoutingTableSize = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "dht",
+		Name:      "routing_table_size",
+		Help:      "Nodes in the routing table, by the address of the indexing service.",
+	}, []string{"address"})
+)
+
+// Metadata sink and leeches.
+var (
+	// SinkQueueLength is the number of info hashes waiting for a leech.
+	SinkQueueLength = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "sink",
+		Name:      "queue_length",
+		Help:      "Info hashes waiting for a leech.",
+	})
+
+	// SinkInFlight is the number of info hashes being leeched.
+	SinkInFlight = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "sink",
+		Name:      "in_flight",
+		Help:      "Info hashes being leeched.",
+	})
+
+	// SinkQueueEvents counts what became of the info hashes offered to the queue: "queued",
+	// "merged" into one queued already, "dropped" because the queue was full, or "expired" while
+	// waiting.
+	SinkQueueEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "sink",
+		Name:      "queue_events_total",
+		Help:      "Info hashes offered to the queue, by what became of them: queued, merged, dropped or expired.",
+	}, []string{"event"})
+
+	// LeechOutcomes counts the leeches by their outcome: "success", or the class of their error.
+	LeechOutcomes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "leech",
+		Name:      "outcomes_total",
+		Help:      "Leeches by outcome: success, or the class of their error.",
+	}, []string{"outcome"})
+
+	// LeechFetches counts the metadata fetched, by transport and by whether the connection was
+	// encrypted.
+	LeechFetches = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "leech",
+		Name:      "fetches_total",
+		Help:      "Metadata fetched, by transport and whether the connection was encrypted.",
+	}, []string{"transport", "encrypted"})
+
+	// LeechClients counts the leeches that got as far as the extension handshake, by the client of
+	// the peer, which is "other" beyond the first few hundred clients, and by whether they
+	// succeeded.
+	LeechClients = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "leech",
+		Name:      "clients_total",
+		Help:      "Leeches that got as far as the extension handshake, by client of the peer and whether they succeeded.",
+	}, []string{"client", "succeeded"})
+
+	// LeechExternalIP is 1 for the external IP address that most peers reported seeing us at, once
+	// enough of them agree.
+	LeechExternalIP = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "leech",
+		Name:      "external_ip_info",
+		Help:      "The external IP address reported by most peers, as a label.",
+	}, []string{"ip"})
+
+	// LeechDuration observes how long leeches take, by whether they succeeded.
+	LeechDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "leech",
+		Name:      "duration_seconds",
+		Help:      "Duration of leeches, by whether they succeeded.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 10},
+	}, []string{"succeeded"})
+)
+
+// Database.
+var (
+	// TorrentsInserted counts the torrents added to the database.
+	TorrentsInserted = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "torrents_inserted_total",
+		Help:      "Torrents added to the database.",
+	})
+
+	// DBQueryDuration observes how long database operations take, by operation.
+	DBQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of database operations, by operation.",
+		Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+	}, []string{"operation"})
+
+	// DBLookupsAvoided counts the info hashes that the info hash filter ruled out, sparing a query.
+	DBLookupsAvoided = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "lookups_avoided_total",
+		Help:      "Info hashes ruled out by the info hash filter, sparing a query.",
+	})
+
+	// DBFilterFalsePositives counts the info hashes that the info hash filter failed to rule out
+	// although they were not in the database.
+	DBFilterFalsePositives = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "filter_false_positives_total",
+		Help:      "Info hashes absent from the database that the info hash filter failed to rule out.",
+	})
+
+	// DBPendingTorrents is the number of torrents waiting for the database to be writable again.
+	DBPendingTorrents = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "pending_torrents",
+		Help:      "Torrents waiting for the database to be writable again.",
+	})
+)
+
+// Web interface.
+var (
+	// HTTPRequestDuration observes how long HTTP requests take, by route pattern, method and status
+	// code.
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// ObserveDBQuery observes the duration of the database operation that started at start, as in:
+//
+//	defer metrics.ObserveDBQuery("GetTorrent", time.Now())
+func ObserveDBQuery(operation string, start time.Time) {
+	DBQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"context"
+)
+
+// Database stores the torrents that the crawler discovers, and answers the queries of the web
+// interface about them. NewSqlite3Database returns the default implementation, NewPostgresDatabase
+// one for deployments that outgrow a single file, and NewMemoryDatabase one that keeps everything
+// in memory, for tests and ephemeral runs.
+//
+// Methods that look a torrent up by info hash and find none return nil (or false) and no error.
+type Database interface {
+	// DoesTorrentExist reports whether the torrent of the info hash is stored, hidden or not. Hybrid
+	// torrents are found by their truncated v2 info hash too, which the DHT knows them by as well.
+	DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error)
+	// AddNewTorrent inserts a torrent along with its files and, if available, its raw bencoded
+	// info dictionary.
+	AddNewTorrent(ctx context.Context, torrent NewTorrent) error
+	// AddNewTorrents inserts torrents as AddNewTorrent does, atomically, and returns how many of
+	// them it inserted: torrents that exist already, and those that contain only empty files,
+	// are skipped.
+	AddNewTorrents(ctx context.Context, torrents []NewTorrent) (int, error)
+	// LoadInfoHashFilter speeds DoesTorrentExist and IsTorrentDeleted up with an in-memory filter
+	// of the info hashes stored and a set of those deleted, where the implementation benefits from
+	// them.
+	LoadInfoHashFilter(ctx context.Context, falsePositiveRate float64) error
+	Close() error
+
+	// GetDatabaseSize returns the size of the database, in bytes.
+	GetDatabaseSize(ctx context.Context) (int64, error)
+	// GetNumberOfTorrents returns an approximate number of the torrents that are not hidden.
+	GetNumberOfTorrents(ctx context.Context) (int, error)
+	// QueryTorrentsCount returns the number of torrents matching query, restricted to category
+	// unless it is empty.
+	QueryTorrentsCount(ctx context.Context, query string, category string) (int, error)
+	// QueryTorrents returns a page of at most MaxResults torrents matching query, restricted to
+	// category unless it is empty.
+	QueryTorrents(
+		ctx context.Context,
+		query string,
+		category string,
+		orderBy OrderingCriteria,
+		ascending bool,
+		offset int,
+	) ([]TorrentMetadata, error)
+	// GetTorrent returns the torrent of the info hash, unless it is hidden.
+	GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error)
+	// GetTorrentInfo returns the raw bencoded info dictionary of the torrent of the info hash,
+	// unless it was not stored or the torrent is hidden.
+	GetTorrentInfo(ctx context.Context, infoHash []byte) ([]byte, error)
+	// GetFiles returns the files of the torrent of the info hash.
+	GetFiles(ctx context.Context, infoHash []byte) ([]File, error)
+
+	// GetUnclassifiedTorrents returns at most limit torrents that have not been classified yet,
+	// along with their files.
+	GetUnclassifiedTorrents(ctx context.Context, limit int) ([]TorrentFiles, error)
+	// GetTorrentsAfter returns at most limit torrents whose ID is greater than afterID, in the
+	// order of their IDs, along with their files.
+	GetTorrentsAfter(ctx context.Context, afterID uint64, limit int) ([]TorrentFiles, error)
+	// SetContentDetails stores the content details of the torrents, atomically.
+	SetContentDetails(ctx context.Context, torrents []ClassifiedTorrent) error
+	// DeleteTorrents deletes the torrents of the IDs, along with their files and info
+	// dictionaries, atomically.
+	DeleteTorrents(ctx context.Context, ids []uint64) error
+
+	// DeleteTorrent deletes the torrent of the info hash on behalf of actor, and reports whether
+	// it existed.
+	DeleteTorrent(ctx context.Context, infoHash []byte, actor string) (bool, error)
+	// IsTorrentDeleted reports whether the torrent of the info hash was deleted by DeleteTorrent,
+	// so that the crawler does not index it again. Once LoadInfoHashFilter has been called, it
+	// answers from memory.
+	IsTorrentDeleted(ctx context.Context, infoHash []byte) (bool, error)
+	// SetTorrentHidden hides or unhides the torrent of the info hash on behalf of actor, and
+	// reports whether it exists.
+	SetTorrentHidden(ctx context.Context, infoHash []byte, hidden bool, actor string) (bool, error)
+	// SetTorrentFlagged flags the torrent of the info hash for the reason, or unflags it, on
+	// behalf of actor, and reports whether it exists.
+	SetTorrentFlagged(ctx context.Context, infoHash []byte, flagged bool, reason string, actor string) (bool, error)
+	// GetAuditLog returns the most recent limit entries of the audit log, which records the
+	// actions above, most recent first.
+	GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error)
+
+	// GetFailedInfoHashes returns the limit most recent info hashes recorded by
+	// SaveFailedInfoHashes, most recent first.
+	GetFailedInfoHashes(ctx context.Context, limit int) ([]FailedInfoHash, error)
+	// SaveFailedInfoHashes inserts or replaces the failure records of info hashes.
+	SaveFailedInfoHashes(ctx context.Context, failures []FailedInfoHash) error
+	// DeleteFailedInfoHashes deletes the failure records of info hashes.
+	DeleteFailedInfoHashes(ctx context.Context, infoHashes [][]byte) error
+	// DeleteFailedInfoHashesBefore deletes the failure records whose retry time is before
+	// retryAfter.
+	DeleteFailedInfoHashesBefore(ctx context.Context, retryAfter int64) error
+	// TrimFailedInfoHashes deletes every failure record but the keep most recent ones.
+	TrimFailedInfoHashes(ctx context.Context, keep int) error
+}
+
+// MemoryDSN is the data source name of Open for an in-memory database.
+const MemoryDSN = "memory"
+
+// Open opens the database of the data source name: MemoryDSN for an in-memory database, a
+// postgres:// URL for a PostgreSQL database, and the path of an SQLite database otherwise.
+func Open(dsn string, opts Options) (Database, error) {
+	if dsn == MemoryDSN {
+		return NewMemoryDatabase(), nil
+	} else if IsPostgresDSN(dsn) {
+		return NewPostgresDatabase(dsn, opts)
+	}
+	return NewSqlite3Database(dsn, opts)
+}
@@ -0,0 +1,275 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+)
+
+// forEachDatabase runs test against a new database of every implementation, which must all behave
+// the same.
+func forEachDatabase(t *testing.T, test func(t *testing.T, db Database)) {
+	t.Run("sqlite3", func(t *testing.T) {
+		test(t, newTestDatabase(t))
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryDatabase())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		test(t, newTestPostgresDatabase(t))
+	})
+}
+
+func TestAddNewTorrentsSkipsDuplicates(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db Database) {
+		if err := db.AddNewTorrent(context.Background(), testTorrent(0)); err != nil {
+			t.Fatalf("could not add the torrent: %v", err)
+		}
+
+		empty := testTorrent(3)
+		empty.Files = []File{{Size: 0, Path: "empty"}}
+		n, err := db.AddNewTorrents(context.Background(), []NewTorrent{testTorrent(0), testTorrent(1), testTorrent(2), testTorrent(1), empty})
+		if err != nil {
+			t.Fatalf("could not add the torrents: %v", err)
+		}
+		if n != 2 {
+			t.Errorf("expected 2 torrents to be inserted, got %d", n)
+		}
+
+		count, err := db.GetNumberOfTorrents(context.Background())
+		if err != nil {
+			t.Fatalf("could not count the torrents: %v", err)
+		}
+		if count != 3 {
+			t.Errorf("expected 3 torrents, got %d", count)
+		}
+
+		files, err := db.GetFiles(context.Background(), testTorrent(1).InfoHash)
+		if err != nil {
+			t.Fatalf("could not get the files: %v", err)
+		}
+		if len(files) != 5 {
+			t.Errorf("expected the files of the duplicate to be inserted once, got %d", len(files))
+		}
+		info, err := db.GetTorrentInfo(context.Background(), testTorrent(2).InfoHash)
+		if err != nil || string(info) != string(testTorrent(2).Info) {
+			t.Errorf("expected the info dictionary to be inserted, got %q (%v)", info, err)
+		}
+	})
+}
+
+// hybridTorrent returns testTorrent(n) as a hybrid torrent, which is stored under its v1 info hash.
+func hybridTorrent(n int) NewTorrent {
+	torrent := testTorrent(n)
+	infoHashV2 := sha256.Sum256(torrent.Info)
+	torrent.InfoHashV2 = infoHashV2[:]
+	return torrent
+}
+
+func TestDoesTorrentExistFindsHybrids(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		// The filter must hold the truncated v2 info hashes of the torrents inserted both before and
+		// after loading it.
+		if err := db.AddNewTorrent(ctx, hybridTorrent(0)); err != nil {
+			t.Fatalf("could not add the torrent: %v", err)
+		}
+		if err := db.LoadInfoHashFilter(ctx, 0.01); err != nil {
+			t.Fatalf("could not load the filter: %v", err)
+		}
+		if err := db.AddNewTorrent(ctx, hybridTorrent(1)); err != nil {
+			t.Fatalf("could not add the torrent: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			torrent := hybridTorrent(i)
+			for _, infoHash := range [][]byte{torrent.InfoHash, torrent.InfoHashV2[:20]} {
+				if exists, err := db.DoesTorrentExist(ctx, infoHash); err != nil || !exists {
+					t.Errorf("expected torrent %d to exist by %x, got %v (%v)", i, infoHash, exists, err)
+				}
+			}
+		}
+		if exists, err := db.DoesTorrentExist(ctx, hybridTorrent(2).InfoHashV2[:20]); err != nil || exists {
+			t.Errorf("expected torrent 2 not to exist, got %v (%v)", exists, err)
+		}
+
+		if _, err := db.DeleteTorrent(ctx, hybridTorrent(0).InfoHash, "alice"); err != nil {
+			t.Fatalf("could not delete the torrent: %v", err)
+		}
+		if exists, err := db.DoesTorrentExist(ctx, hybridTorrent(0).InfoHashV2[:20]); err != nil || exists {
+			t.Errorf("expected the deleted torrent not to exist, got %v (%v)", exists, err)
+		}
+	})
+}
+
+func TestAddNewTorrentsIsAtomic(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db Database) {
+		invalid := testTorrent(1)
+		invalid.InfoHash = nil // violates NOT NULL
+		if _, err := db.AddNewTorrents(context.Background(), []NewTorrent{testTorrent(0), invalid}); err == nil {
+			t.Fatalf("expected the batch to fail")
+		}
+
+		if exists, err := db.DoesTorrentExist(context.Background(), testTorrent(0).InfoHash); err != nil || exists {
+			t.Errorf("expected the batch to be rolled back, got %v (%v)", exists, err)
+		}
+	})
+}
+
+func TestQueryTorrents(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db Database) {
+		names := []string{"ubuntu-22.04-desktop-amd64.iso", "Ubuntu 20.04 Server", "debian-12-amd64"}
+		for i, name := range names {
+			torrent := testTorrent(i)
+			torrent.Name = name
+			torrent.Files = torrent.Files[:i+1]
+			if err := db.AddNewTorrent(context.Background(), torrent); err != nil {
+				t.Fatalf("could not add the torrent: %v", err)
+			}
+		}
+
+		for _, c := range []struct {
+			query string
+			count int
+		}{
+			{"ubuntu", 2},
+			{"UBUNTU 22", 1},
+			{"desktop amd64", 1},
+			{"amd64", 2},
+			{"amd64 desktop", 0}, // words are matched in sequence
+			{"ubu", 0},
+			{"", 0},
+		} {
+			count, err := db.QueryTorrentsCount(context.Background(), c.query, "")
+			if err != nil {
+				t.Fatalf("%q: could not count the torrents: %v", c.query, err)
+			}
+			if count != c.count {
+				t.Errorf("%q: expected %d torrents, got %d", c.query, c.count, count)
+			}
+		}
+
+		torrents, err := db.QueryTorrents(context.Background(), "amd64", "", ByTotalSize, false, 0)
+		if err != nil {
+			t.Fatalf("could not query the torrents: %v", err)
+		}
+		if len(torrents) != 2 || torrents[0].Name != names[2] || torrents[1].Name != names[0] {
+			t.Errorf("expected the torrents from the largest, got %+v", torrents)
+		}
+
+		torrents, err = db.QueryTorrents(context.Background(), "amd64", "", ByName, true, 1)
+		if err != nil {
+			t.Fatalf("could not query the torrents: %v", err)
+		}
+		if len(torrents) != 1 || torrents[0].Name != names[0] {
+			t.Errorf("expected the second torrent by name, got %+v", torrents)
+		}
+	})
+}
+
+func TestModeration(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		infoHash := testTorrent(0).InfoHash
+		if err := db.AddNewTorrent(ctx, testTorrent(0)); err != nil {
+			t.Fatalf("could not add the torrent: %v", err)
+		}
+
+		if ok, err := db.SetTorrentHidden(ctx, infoHash, true, "alice"); !ok || err != nil {
+			t.Fatalf("could not hide the torrent: %v (%v)", ok, err)
+		}
+		if torrent, _ := db.GetTorrent(ctx, infoHash); torrent != nil {
+			t.Errorf("expected the hidden torrent not to be found")
+		}
+		if exists, _ := db.DoesTorrentExist(ctx, infoHash); !exists {
+			t.Errorf("expected the hidden torrent to still exist")
+		}
+
+		if ok, err := db.SetTorrentHidden(ctx, infoHash, false, "alice"); !ok || err != nil {
+			t.Fatalf("could not unhide the torrent: %v (%v)", ok, err)
+		}
+		if ok, err := db.SetTorrentFlagged(ctx, infoHash, true, "fake", "bob"); !ok || err != nil {
+			t.Fatalf("could not flag the torrent: %v (%v)", ok, err)
+		}
+		torrent, _ := db.GetTorrent(ctx, infoHash)
+		if torrent == nil || !torrent.Flagged || torrent.FlagReason != "fake" {
+			t.Errorf("expected the torrent to be flagged as fake, got %+v", torrent)
+		}
+
+		if ok, err := db.DeleteTorrent(ctx, infoHash, "bob"); !ok || err != nil {
+			t.Fatalf("could not delete the torrent: %v (%v)", ok, err)
+		}
+		if ok, err := db.DeleteTorrent(ctx, infoHash, "bob"); ok || err != nil {
+			t.Errorf("expected no torrent to delete, got %v (%v)", ok, err)
+		}
+		if deleted, err := db.IsTorrentDeleted(ctx, infoHash); !deleted || err != nil {
+			t.Errorf("expected the torrent to be known as deleted, got %v (%v)", deleted, err)
+		}
+		if deleted, err := db.IsTorrentDeleted(ctx, testTorrent(1).InfoHash); deleted || err != nil {
+			t.Errorf("expected another torrent not to be known as deleted, got %v (%v)", deleted, err)
+		}
+
+		entries, err := db.GetAuditLog(ctx, 3)
+		if err != nil {
+			t.Fatalf("could not get the audit log: %v", err)
+		}
+		actions := []string{ActionDelete, ActionFlag, ActionUnhide}
+		if len(entries) != len(actions) {
+			t.Fatalf("expected %d audit entries, got %+v", len(actions), entries)
+		}
+		for i, action := range actions {
+			if entries[i].Action != action {
+				t.Errorf("expected entry %d to be %s, got %+v", i, action, entries[i])
+			}
+		}
+	})
+}
+
+func TestFailedInfoHashes(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		var failures []FailedInfoHash
+		for i := 0; i < 4; i++ {
+			infoHash := sha256.Sum256([]byte{byte(i)})
+			failures = append(failures, FailedInfoHash{
+				InfoHash:     infoHash[:20],
+				Failures:     i + 1,
+				LastError:    "rejected",
+				LastFailedAt: int64(1000 + i),
+				RetryAfter:   int64(2000 + i),
+			})
+		}
+		if err := db.SaveFailedInfoHashes(ctx, failures); err != nil {
+			t.Fatalf("could not save the failed info hashes: %v", err)
+		}
+		failures[3].Failures = 10
+		if err := db.SaveFailedInfoHashes(ctx, failures[3:]); err != nil {
+			t.Fatalf("could not update the failed info hash: %v", err)
+		}
+
+		got, err := db.GetFailedInfoHashes(ctx, 2)
+		if err != nil {
+			t.Fatalf("could not get the failed info hashes: %v", err)
+		}
+		if len(got) != 2 || got[0].Failures != 10 || got[1].Failures != 3 {
+			t.Errorf("expected the 2 most recent failures, most recent first, got %+v", got)
+		}
+
+		if err = db.DeleteFailedInfoHashes(ctx, [][]byte{failures[3].InfoHash}); err != nil {
+			t.Fatalf("could not delete the failed info hash: %v", err)
+		}
+		if err = db.TrimFailedInfoHashes(ctx, 2); err != nil {
+			t.Fatalf("could not trim the failed info hashes: %v", err)
+		}
+		if got, _ = db.GetFailedInfoHashes(ctx, 10); len(got) != 2 || got[0].Failures != 3 || got[1].Failures != 2 {
+			t.Errorf("expected the 2 most recent failures to be kept, got %+v", got)
+		}
+
+		if err = db.DeleteFailedInfoHashesBefore(ctx, 2002); err != nil {
+			t.Fatalf("could not delete the expired failed info hashes: %v", err)
+		}
+		if got, _ = db.GetFailedInfoHashes(ctx, 10); len(got) != 1 || got[0].Failures != 3 {
+			t.Errorf("expected the failure retried after 2002 to be kept, got %+v", got)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package persistence
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// IsBusy reports whether err is due to another connection holding a lock for longer than the busy
+// timeout (SQLITE_BUSY or SQLITE_LOCKED), or, on PostgreSQL, to a lock timeout, a deadlock or a
+// serialization failure. Such errors are transient: the operation that failed may succeed if
+// retried later.
+func IsBusy(err error) bool {
+	switch primaryCode(err) {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+
+	switch postgresCode(err) {
+	case "55P03", "40P01", "40001": // lock_not_available, deadlock_detected, serialization_failure
+		return true
+	default:
+		return false
+	}
+}
+
+// IsFatal reports whether err is due to the database being corrupt, unreadable or unwritable
+// (SQLITE_CORRUPT, SQLITE_NOTADB, SQLITE_IOERR, SQLITE_FULL, SQLITE_READONLY or SQLITE_CANTOPEN;
+// on PostgreSQL, errors of the insufficient resources, system error and internal error classes,
+// and read-only transactions), in which case no further write is likely to succeed.
+func IsFatal(err error) bool {
+	switch primaryCode(err) {
+	case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_FULL,
+		sqlite3.SQLITE_READONLY, sqlite3.SQLITE_CANTOPEN:
+		return true
+	}
+
+	code := postgresCode(err)
+	switch {
+	case strings.HasPrefix(code, "53"), strings.HasPrefix(code, "58"), strings.HasPrefix(code, "XX"):
+		return true
+	case code == "25006": // read_only_sql_transaction
+		return true
+	default:
+		return false
+	}
+}
+
+// primaryCode returns the primary result code of the SQLite error in err's chain, stripped of its
+// extended bits (SQLITE_BUSY for SQLITE_BUSY_SNAPSHOT, say), or zero if there is none.
+func primaryCode(err error) int {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return 0
+	}
+	return sqliteErr.Code() & 0xff
+}
+
+// postgresCode returns the SQLSTATE of the PostgreSQL error in err's chain, or an empty string if
+// there is none.
+func postgresCode(err error) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return ""
+	}
+	return pgErr.Code
+}
@@ -0,0 +1,47 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsBusy(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "magnetico.db")
+	locker, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer locker.Close()
+	tx, err := locker.Begin()
+	if err != nil {
+		t.Fatalf("could not begin a transaction: %v", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+	if _, err = tx.Exec("CREATE TABLE t (x);"); err != nil {
+		t.Fatalf("could not take the write lock: %v", err)
+	}
+
+	// Without a busy timeout, the write fails straight away.
+	conn, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE u (x);")
+	if err == nil {
+		t.Fatalf("expected the write to fail")
+	}
+
+	if !IsBusy(err) || !IsBusy(fmt.Errorf("tx.Exec %w", err)) {
+		t.Errorf("expected %v to be a busy error", err)
+	}
+	if IsFatal(err) {
+		t.Errorf("expected %v not to be a fatal error", err)
+	}
+	if IsBusy(errors.New("database is locked")) {
+		t.Errorf("expected errors other than SQLite's not to be busy errors")
+	}
+}
@@ -0,0 +1,224 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/willf/bloom"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+// minFilterCapacity is the number of info hashes the filter is sized for at the very least, so that
+// the first few hours of crawling an empty database do not require rebuilding it over and over.
+const minFilterCapacity = 1 << 20
+
+// infoHashFilter is a Bloom filter of the info hashes in the database, including the truncated v2
+// info hashes of hybrid torrents. As it has no false
+// negatives, DoesTorrentExist need not query the database about the info hashes it does not contain,
+// which are the vast majority of those the crawler samples.
+type infoHashFilter struct {
+	mu                sync.RWMutex
+	filter            *bloom.BloomFilter
+	capacity          uint // the number of info hashes filter is sized for
+	n                 uint // the number of info hashes added to filter
+	falsePositiveRate float64
+
+	// rebuilding is set while a filter of a larger capacity is being filled from the database, and
+	// pending holds the info hashes added meanwhile, which the new filter might miss.
+	rebuilding bool
+	pending    [][]byte
+	// rebuilds tracks the rebuilds running in the background, which Close waits for.
+	rebuilds sync.WaitGroup
+
+	// deleted holds the info hashes of the torrents deleted by DeleteTorrent, exactly. Admins delete
+	// few torrents, so IsTorrentDeleted looks them up here rather than in the audit log for every
+	// info hash that the crawler samples.
+	deleted map[string]struct{}
+}
+
+// LoadInfoHashFilter loads the info hashes of the torrents in the database into a Bloom filter that
+// DoesTorrentExist consults before querying the database, and that the torrents inserted are added
+// to. falsePositiveRate is the share of the info hashes absent from the database that the filter
+// fails to rule out, and so cost a query still. As it reads every info hash, loading the filter is
+// not subject to the read timeout.
+func (db *sqlite3Database) LoadInfoHashFilter(ctx context.Context, falsePositiveRate float64) error {
+	f, err := loadInfoHashFilter(ctx, db.reader, falsePositiveRate)
+	if err != nil {
+		return err
+	}
+	db.filter = f
+	return nil
+}
+
+// loadInfoHashFilter returns a filter of the info hashes of the torrents in the database.
+func loadInfoHashFilter(ctx context.Context, reader *sql.DB, falsePositiveRate float64) (*infoHashFilter, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, errors.New("the false positive rate must be between 0 and 1")
+	}
+
+	var count uint
+	if err := reader.QueryRowContext(ctx, "SELECT count(*) FROM torrents;").Scan(&count); err != nil {
+		return nil, fmt.Errorf("sql.DB.QueryRow (count) %w", err)
+	}
+
+	f := new(infoHashFilter)
+	f.falsePositiveRate = falsePositiveRate
+	f.deleted = make(map[string]struct{})
+
+	// The condition on action must be spelled out for audit_log_deleted_index to apply.
+	rows, err := reader.QueryContext(ctx, "SELECT info_hash FROM audit_log WHERE action = 'delete';")
+	if err != nil {
+		return nil, fmt.Errorf("sql.DB.Query (audit_log) %w", err)
+	}
+	defer closeRows(rows)
+	var infoHash []byte
+	for rows.Next() {
+		if err = rows.Scan(&infoHash); err != nil {
+			return nil, fmt.Errorf("sql.Rows.Scan (audit_log) %w", err)
+		}
+		f.deleted[string(infoHash)] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("sql.Rows.Err (audit_log) %w", err)
+	}
+
+	if err := fillInfoHashFilter(ctx, reader, f, max(2*count, minFilterCapacity)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// fillInfoHashFilter replaces the filter of f with one sized for capacity info hashes, holding
+// those in the database. f keeps answering from its current filter meanwhile, and the info hashes
+// added to it meanwhile are added to the new one too before it takes over.
+func fillInfoHashFilter(ctx context.Context, reader *sql.DB, f *infoHashFilter, capacity uint) error {
+	start := time.Now()
+	filter := bloom.NewWithEstimates(capacity, f.falsePositiveRate)
+
+	// The info hashes added from now on are kept aside, as the query might not see them.
+	f.mu.Lock()
+	f.rebuilding = true
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.rebuilding, f.pending = false, nil
+		f.mu.Unlock()
+	}()
+
+	rows, err := reader.QueryContext(ctx, "SELECT info_hash, info_hash_v2 FROM torrents;")
+	if err != nil {
+		return fmt.Errorf("sql.DB.Query (info_hash) %w", err)
+	}
+	defer closeRows(rows)
+
+	var n uint
+	var infoHash, infoHashV2 []byte
+	for rows.Next() {
+		if err = rows.Scan(&infoHash, &infoHashV2); err != nil {
+			return fmt.Errorf("sql.Rows.Scan (info_hash) %w", err)
+		}
+		filter.Add(infoHash)
+		n++
+		if truncated := truncatedInfoHashV2(infoHash, infoHashV2); truncated != nil {
+			filter.Add(truncated)
+			n++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("sql.Rows.Err (info_hash) %w", err)
+	}
+
+	f.mu.Lock()
+	for _, infoHash := range f.pending {
+		filter.Add(infoHash)
+	}
+	n += uint(len(f.pending))
+	f.filter, f.capacity, f.n = filter, capacity, n
+	f.mu.Unlock()
+
+	logger.Info("loaded the info hash filter", "infohashes", n, "capacity", capacity,
+		"bytes", filter.Cap()/8, "duration", time.Since(start))
+	return nil
+}
+
+// mayContain returns false if the info hash is definitely not in the database.
+func (f *infoHashFilter) mayContain(infoHash []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.filter.Test(infoHash) {
+		return true
+	}
+	metrics.DBLookupsAvoided.Inc()
+	return false
+}
+
+// add adds the info hashes, and reports whether the filter has outgrown its capacity, beyond which
+// its false positive rate rises, and is not being rebuilt already.
+func (f *infoHashFilter) add(infoHashes [][]byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, infoHash := range infoHashes {
+		f.filter.Add(infoHash)
+	}
+	f.n += uint(len(infoHashes))
+	if f.rebuilding {
+		f.pending = append(f.pending, infoHashes...)
+		return false
+	}
+	if f.n > f.capacity {
+		// Claim the rebuild, so that a single one runs at a time.
+		f.rebuilding = true
+		return true
+	}
+	return false
+}
+
+// rebuild refills the filter in the background, sized for twice its capacity. Reading every info
+// hash takes a while on large databases, which inserting the torrents that outgrew the filter
+// must not wait for.
+func (f *infoHashFilter) rebuild(reader *sql.DB) {
+	f.mu.RLock()
+	capacity := 2 * f.capacity
+	f.mu.RUnlock()
+
+	f.rebuilds.Add(1)
+	go func() {
+		defer f.rebuilds.Done()
+		if err := fillInfoHashFilter(context.Background(), reader, f, capacity); err != nil {
+			logger.Error("could not rebuild the info hash filter", "err", err)
+		}
+	}()
+}
+
+// truncatedInfoHashV2 returns the v2 info hash of a hybrid torrent truncated to the length of a v1
+// info hash, which the DHT knows the torrent by too, or nil if the torrent is not hybrid. The
+// torrents that are v2 only are stored under their truncated v2 info hash already.
+func truncatedInfoHashV2(infoHash, infoHashV2 []byte) []byte {
+	if len(infoHashV2) < len(infoHash) || bytes.Equal(infoHashV2[:len(infoHash)], infoHash) {
+		return nil
+	}
+	return infoHashV2[:len(infoHash)]
+}
+
+// isDeleted reports whether the torrent of the info hash was deleted by DeleteTorrent.
+func (f *infoHashFilter) isDeleted(infoHash []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, deleted := f.deleted[string(infoHash)]
+	return deleted
+}
+
+// markDeleted records that the torrent of the info hash was deleted by DeleteTorrent.
+func (f *infoHashFilter) markDeleted(infoHash []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted[string(infoHash)] = struct{}{}
+}
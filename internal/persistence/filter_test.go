@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+func TestInfoHashFilter(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.AddNewTorrent(context.Background(), testTorrent(0)); err != nil {
+		t.Fatalf("could not add the torrent: %v", err)
+	}
+	if err := db.LoadInfoHashFilter(context.Background(), 0.01); err != nil {
+		t.Fatalf("could not load the filter: %v", err)
+	}
+
+	// Torrents inserted before and after loading the filter must not be ruled out.
+	if _, err := db.AddNewTorrents(context.Background(), []NewTorrent{testTorrent(1)}); err != nil {
+		t.Fatalf("could not add the torrent: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if exists, err := db.DoesTorrentExist(context.Background(), testTorrent(i).InfoHash); err != nil || !exists {
+			t.Errorf("expected torrent %d to exist, got %v (%v)", i, exists, err)
+		}
+	}
+
+	var ruledOut int
+	for i := 2; i < 1000; i++ {
+		if !db.filter.mayContain(testTorrent(i).InfoHash) {
+			ruledOut++
+		}
+		if exists, err := db.DoesTorrentExist(context.Background(), testTorrent(i).InfoHash); err != nil || exists {
+			t.Errorf("expected torrent %d not to exist, got %v (%v)", i, exists, err)
+		}
+	}
+	if ruledOut < 950 {
+		t.Errorf("expected most absent info hashes to be ruled out, got %d of 998", ruledOut)
+	}
+}
+
+func TestInfoHashFilterGrows(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.LoadInfoHashFilter(context.Background(), 0.01); err != nil {
+		t.Fatalf("could not load the filter: %v", err)
+	}
+	if err := fillInfoHashFilter(context.Background(), db.reader, db.filter, 2); err != nil {
+		t.Fatalf("could not fill the filter: %v", err)
+	}
+
+	torrents := []NewTorrent{testTorrent(0), testTorrent(1), testTorrent(2)}
+	if _, err := db.AddNewTorrents(context.Background(), torrents); err != nil {
+		t.Fatalf("could not add the torrents: %v", err)
+	}
+	db.filter.rebuilds.Wait()
+	if db.filter.capacity != 4 || db.filter.n != 3 {
+		t.Errorf("expected the filter to be rebuilt with 3 info hashes of 4, got %d of %d",
+			db.filter.n, db.filter.capacity)
+	}
+	for _, torrent := range torrents {
+		if !db.filter.mayContain(torrent.InfoHash) {
+			t.Errorf("expected %s to be in the rebuilt filter", torrent.Name)
+		}
+	}
+}
+
+func TestInfoHashFilterKeepsWhatIsAddedWhileRebuilding(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.LoadInfoHashFilter(context.Background(), 0.01); err != nil {
+		t.Fatalf("could not load the filter: %v", err)
+	}
+	if err := fillInfoHashFilter(context.Background(), db.reader, db.filter, 1); err != nil {
+		t.Fatalf("could not fill the filter: %v", err)
+	}
+	// The filter is bypassed so as to insert torrents without rebuilding it.
+	filter := db.filter
+	db.filter = nil
+	if _, err := db.AddNewTorrents(context.Background(), []NewTorrent{testTorrent(0), testTorrent(1)}); err != nil {
+		t.Fatalf("could not add the torrents: %v", err)
+	}
+	db.filter = filter
+
+	// Outgrowing the filter claims its rebuild, after which what is added goes into the current
+	// filter and is kept aside for the new one, whether the rebuild reads it from the database or
+	// not.
+	if !db.filter.add([][]byte{testTorrent(0).InfoHash, testTorrent(1).InfoHash}) {
+		t.Fatalf("expected the filter to need rebuilding")
+	}
+	if db.filter.add([][]byte{testTorrent(2).InfoHash}) {
+		t.Errorf("expected a single rebuild at a time")
+	}
+	if !db.filter.mayContain(testTorrent(2).InfoHash) {
+		t.Errorf("expected the info hash added while rebuilding to be in the current filter")
+	}
+	if err := fillInfoHashFilter(context.Background(), db.reader, db.filter, 8); err != nil {
+		t.Fatalf("could not rebuild the filter: %v", err)
+	}
+
+	if db.filter.capacity != 8 || db.filter.rebuilding || len(db.filter.pending) != 0 {
+		t.Errorf("expected the rebuilt filter to take over, got a capacity of %d", db.filter.capacity)
+	}
+	for i := 0; i < 3; i++ {
+		if !db.filter.mayContain(testTorrent(i).InfoHash) {
+			t.Errorf("expected torrent %d to be in the rebuilt filter", i)
+		}
+	}
+}
+
+func TestLoadInfoHashFilterRejectsInvalidRates(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, rate := range []float64{0, 1, -0.5} {
+		if err := db.LoadInfoHashFilter(context.Background(), rate); err == nil {
+			t.Errorf("expected a false positive rate of %v to be rejected", rate)
+		}
+	}
+}
+
+// queriesObserved returns the number of database operations observed under the name operation.
+func queriesObserved(t *testing.T, operation string) uint64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "magnetico_db_query_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == operation {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestInfoHashFilterHoldsDeletedInfoHashes(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	if _, err := db.AddNewTorrents(ctx, []NewTorrent{testTorrent(0), testTorrent(1), testTorrent(2)}); err != nil {
+		t.Fatalf("could not add the torrents: %v", err)
+	}
+	// Torrents deleted before and after loading the filter must both be found deleted.
+	if _, err := db.DeleteTorrent(ctx, testTorrent(0).InfoHash, "alice"); err != nil {
+		t.Fatalf("could not delete the torrent: %v", err)
+	}
+	if err := db.LoadInfoHashFilter(ctx, 0.01); err != nil {
+		t.Fatalf("could not load the filter: %v", err)
+	}
+	if _, err := db.DeleteTorrent(ctx, testTorrent(1).InfoHash, "alice"); err != nil {
+		t.Fatalf("could not delete the torrent: %v", err)
+	}
+
+	queries := queriesObserved(t, "IsTorrentDeleted")
+	for i, expected := range []bool{true, true, false, false} {
+		if deleted, err := db.IsTorrentDeleted(ctx, testTorrent(i).InfoHash); deleted != expected || err != nil {
+			t.Errorf("expected torrent %d to be deleted: %v, got %v (%v)", i, expected, deleted, err)
+		}
+	}
+	// The crawler asks about nearly every info hash it samples, which must not cost a query each.
+	if n := queriesObserved(t, "IsTorrentDeleted") - queries; n != 0 {
+		t.Errorf("expected the deleted info hashes to be looked up in memory, got %d queries", n)
+	}
+}
@@ -0,0 +1,512 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryDatabase is the in-memory implementation of Database. Its searches match the query as a
+// phrase of words, as SQLite's full-text search does, but rank every match equally.
+type memoryDatabase struct {
+	mu         sync.RWMutex
+	torrents   map[uint64]*memoryTorrent
+	byInfoHash map[string]*memoryTorrent
+	// byInfoHashV2 holds the hybrid torrents by their truncated v2 info hash, which the DHT knows
+	// them by too.
+	byInfoHashV2 map[string]*memoryTorrent
+	lastID       uint64
+	auditLog     []AuditEntry
+	deleted      map[string]struct{} // the info hashes of the torrents deleted by DeleteTorrent
+	failures     map[string]FailedInfoHash
+}
+
+type memoryTorrent struct {
+	TorrentMetadata
+	files  []File
+	info   []byte
+	words  []string // of the name, for searches
+	hidden bool
+}
+
+// NewMemoryDatabase returns an empty database that lives in memory, and so disappears when the
+// process exits.
+func NewMemoryDatabase() Database {
+	db := new(memoryDatabase)
+	db.torrents = make(map[uint64]*memoryTorrent)
+	db.byInfoHash = make(map[string]*memoryTorrent)
+	db.byInfoHashV2 = make(map[string]*memoryTorrent)
+	db.deleted = make(map[string]struct{})
+	db.failures = make(map[string]FailedInfoHash)
+	return db
+}
+
+func (db *memoryDatabase) DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, exists := db.byInfoHash[string(infoHash)]
+	if !exists {
+		_, exists = db.byInfoHashV2[string(infoHash)]
+	}
+	return exists, ctx.Err()
+}
+
+func (db *memoryDatabase) AddNewTorrent(ctx context.Context, torrent NewTorrent) error {
+	_, err := db.AddNewTorrents(ctx, []NewTorrent{torrent})
+	return err
+}
+
+func (db *memoryDatabase) AddNewTorrents(ctx context.Context, torrents []NewTorrent) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	// Check every torrent before inserting any, so that either all of them are inserted or none.
+	for _, torrent := range torrents {
+		if len(torrent.InfoHash) == 0 {
+			return 0, errors.New("torrent without an info hash")
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().Unix()
+	var inserted int
+	for _, torrent := range torrents {
+		var totalSize uint64
+		for _, file := range torrent.Files {
+			totalSize += uint64(file.Size)
+		}
+		// We do not accept torrents that contain only empty files.
+		if totalSize == 0 {
+			continue
+		}
+		if _, exists := db.byInfoHash[string(torrent.InfoHash)]; exists {
+			continue
+		}
+
+		db.lastID++
+		t := &memoryTorrent{
+			TorrentMetadata: TorrentMetadata{
+				ID:             db.lastID,
+				InfoHash:       bytes.Clone(torrent.InfoHash),
+				InfoHashV2:     bytes.Clone(torrent.InfoHashV2),
+				Name:           torrent.Name,
+				Size:           totalSize,
+				CreatedAt:      now,
+				UpdatedAt:      now,
+				NFiles:         uint(len(torrent.Files)),
+				HasInfo:        torrent.Info != nil,
+				TorrentDetails: torrent.TorrentDetails,
+				ContentDetails: torrent.ContentDetails,
+			},
+			files: append([]File(nil), torrent.Files...),
+			info:  bytes.Clone(torrent.Info),
+			words: words(torrent.Name),
+		}
+		db.torrents[t.ID] = t
+		db.byInfoHash[string(t.InfoHash)] = t
+		if truncated := truncatedInfoHashV2(t.InfoHash, t.InfoHashV2); truncated != nil {
+			db.byInfoHashV2[string(truncated)] = t
+		}
+		inserted++
+	}
+
+	return inserted, nil
+}
+
+// LoadInfoHashFilter does nothing, as looking info hashes up in memory is fast enough.
+func (db *memoryDatabase) LoadInfoHashFilter(context.Context, float64) error {
+	return nil
+}
+
+func (db *memoryDatabase) Close() error {
+	return nil
+}
+
+// GetDatabaseSize returns zero, as an in-memory database has no file.
+func (db *memoryDatabase) GetDatabaseSize(ctx context.Context) (int64, error) {
+	return 0, ctx.Err()
+}
+
+func (db *memoryDatabase) GetNumberOfTorrents(ctx context.Context) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var n int
+	for _, t := range db.torrents {
+		if !t.hidden {
+			n++
+		}
+	}
+	return n, ctx.Err()
+}
+
+func (db *memoryDatabase) QueryTorrentsCount(ctx context.Context, query string, category string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.search(query, category)), ctx.Err()
+}
+
+func (db *memoryDatabase) QueryTorrents(
+	ctx context.Context,
+	query string,
+	category string,
+	orderBy OrderingCriteria,
+	ascending bool,
+	offset int,
+) ([]TorrentMetadata, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	matches := db.search(query, category)
+	less := memoryOrderings[orderBy]
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if !ascending {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		} else if less(b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+
+	torrents := make([]TorrentMetadata, 0)
+	for i := offset; i < len(matches) && len(torrents) < MaxResults; i++ {
+		torrents = append(torrents, matches[i].TorrentMetadata)
+	}
+	return torrents, ctx.Err()
+}
+
+// memoryOrderings compare torrents by each of the criteria; relevance ranks every match equally.
+var memoryOrderings = map[OrderingCriteria]func(a, b *memoryTorrent) bool{
+	ByRelevance:  func(a, b *memoryTorrent) bool { return false },
+	ByName:       func(a, b *memoryTorrent) bool { return a.Name < b.Name },
+	ByTotalSize:  func(a, b *memoryTorrent) bool { return a.Size < b.Size },
+	ByDiscovered: func(a, b *memoryTorrent) bool { return a.CreatedAt < b.CreatedAt },
+	ByNFiles:     func(a, b *memoryTorrent) bool { return a.NFiles < b.NFiles },
+	ByUpdatedOn:  func(a, b *memoryTorrent) bool { return a.UpdatedAt < b.UpdatedAt },
+}
+
+// search returns the torrents whose name contains the words of query in sequence, restricted to
+// category unless it is empty, excluding those hidden. An empty query matches nothing.
+func (db *memoryDatabase) search(query string, category string) []*memoryTorrent {
+	queryWords := words(query)
+	if len(queryWords) == 0 {
+		return nil
+	}
+
+	var matches []*memoryTorrent
+	for _, t := range db.torrents {
+		if t.hidden || (category != "" && t.Category != category) {
+			continue
+		}
+		for i := 0; i+len(queryWords) <= len(t.words); i++ {
+			if equal(t.words[i:i+len(queryWords)], queryWords) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+func (db *memoryDatabase) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	t, exists := db.byInfoHash[string(infoHash)]
+	if !exists || t.hidden {
+		return nil, ctx.Err()
+	}
+	tm := t.TorrentMetadata
+	return &tm, ctx.Err()
+}
+
+func (db *memoryDatabase) GetTorrentInfo(ctx context.Context, infoHash []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	t, exists := db.byInfoHash[string(infoHash)]
+	if !exists || t.hidden {
+		return nil, ctx.Err()
+	}
+	return bytes.Clone(t.info), ctx.Err()
+}
+
+func (db *memoryDatabase) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	t, exists := db.byInfoHash[string(infoHash)]
+	if !exists {
+		return nil, ctx.Err()
+	}
+	return append([]File(nil), t.files...), ctx.Err()
+}
+
+func (db *memoryDatabase) GetUnclassifiedTorrents(ctx context.Context, limit int) ([]TorrentFiles, error) {
+	return db.getTorrentFiles(ctx, limit, func(t *memoryTorrent) bool {
+		return t.Category == ""
+	})
+}
+
+func (db *memoryDatabase) GetTorrentsAfter(ctx context.Context, afterID uint64, limit int) ([]TorrentFiles, error) {
+	return db.getTorrentFiles(ctx, limit, func(t *memoryTorrent) bool {
+		return t.ID > afterID
+	})
+}
+
+// getTorrentFiles returns at most limit of the torrents that match, in the order of their IDs.
+func (db *memoryDatabase) getTorrentFiles(ctx context.Context, limit int, match func(*memoryTorrent) bool) ([]TorrentFiles, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var matches []*memoryTorrent
+	for _, t := range db.torrents {
+		if match(t) {
+			matches = append(matches, t)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID < matches[j].ID
+	})
+
+	var torrents []TorrentFiles
+	for _, t := range matches[:min(len(matches), limit)] {
+		torrents = append(torrents, TorrentFiles{
+			ID:       t.ID,
+			InfoHash: bytes.Clone(t.InfoHash),
+			Name:     t.Name,
+			Files:    append([]File(nil), t.files...),
+		})
+	}
+	return torrents, ctx.Err()
+}
+
+func (db *memoryDatabase) SetContentDetails(ctx context.Context, torrents []ClassifiedTorrent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, torrent := range torrents {
+		if t, exists := db.torrents[torrent.ID]; exists {
+			t.ContentDetails = torrent.ContentDetails
+		}
+	}
+	return nil
+}
+
+func (db *memoryDatabase) DeleteTorrents(ctx context.Context, ids []uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range ids {
+		if t, exists := db.torrents[id]; exists {
+			db.remove(t)
+		}
+	}
+	return nil
+}
+
+func (db *memoryDatabase) DeleteTorrent(ctx context.Context, infoHash []byte, actor string) (bool, error) {
+	return db.moderate(ctx, infoHash, actor, ActionDelete, "", func(t *memoryTorrent) {
+		db.remove(t)
+		db.deleted[string(t.InfoHash)] = struct{}{}
+	})
+}
+
+// remove removes the torrent from the database; db.mu must be locked.
+func (db *memoryDatabase) remove(t *memoryTorrent) {
+	delete(db.torrents, t.ID)
+	delete(db.byInfoHash, string(t.InfoHash))
+	if truncated := truncatedInfoHashV2(t.InfoHash, t.InfoHashV2); truncated != nil {
+		delete(db.byInfoHashV2, string(truncated))
+	}
+}
+
+func (db *memoryDatabase) IsTorrentDeleted(ctx context.Context, infoHash []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, deleted := db.deleted[string(infoHash)]
+	return deleted, nil
+}
+
+func (db *memoryDatabase) SetTorrentHidden(ctx context.Context, infoHash []byte, hidden bool, actor string) (bool, error) {
+	action := ActionHide
+	if !hidden {
+		action = ActionUnhide
+	}
+	return db.moderate(ctx, infoHash, actor, action, "", func(t *memoryTorrent) {
+		t.hidden = hidden
+	})
+}
+
+func (db *memoryDatabase) SetTorrentFlagged(ctx context.Context, infoHash []byte, flagged bool, reason string, actor string) (bool, error) {
+	action := ActionFlag
+	if !flagged {
+		action, reason = ActionUnflag, ""
+	}
+	return db.moderate(ctx, infoHash, actor, action, reason, func(t *memoryTorrent) {
+		t.Flagged, t.FlagReason = flagged, reason
+	})
+}
+
+// moderate applies an action to the torrent of the given info hash, and records it in the audit
+// log, if the torrent exists.
+func (db *memoryDatabase) moderate(ctx context.Context, infoHash []byte, actor, action, reason string, apply func(*memoryTorrent)) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, exists := db.byInfoHash[string(infoHash)]
+	if !exists {
+		return false, nil
+	}
+	apply(t)
+
+	db.auditLog = append(db.auditLog, AuditEntry{
+		ID:        uint64(len(db.auditLog) + 1),
+		Actor:     actor,
+		Action:    action,
+		InfoHash:  bytes.Clone(infoHash),
+		Reason:    reason,
+		CreatedAt: time.Now().Unix(),
+	})
+	return true, nil
+}
+
+func (db *memoryDatabase) GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries := make([]AuditEntry, 0)
+	for i := len(db.auditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, db.auditLog[i])
+	}
+	return entries, ctx.Err()
+}
+
+func (db *memoryDatabase) GetFailedInfoHashes(ctx context.Context, limit int) ([]FailedInfoHash, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	failures := db.sortedFailuresLocked()
+	return failures[:min(limit, len(failures))], ctx.Err()
+}
+
+// sortedFailuresLocked returns the failure records most recent first. db.mu must be held.
+func (db *memoryDatabase) sortedFailuresLocked() []FailedInfoHash {
+	failures := make([]FailedInfoHash, 0, len(db.failures))
+	for _, failure := range db.failures {
+		failures = append(failures, failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].LastFailedAt != failures[j].LastFailedAt {
+			return failures[i].LastFailedAt > failures[j].LastFailedAt
+		}
+		return bytes.Compare(failures[i].InfoHash, failures[j].InfoHash) < 0
+	})
+	return failures
+}
+
+func (db *memoryDatabase) SaveFailedInfoHashes(ctx context.Context, failures []FailedInfoHash) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, failure := range failures {
+		failure.InfoHash = bytes.Clone(failure.InfoHash)
+		db.failures[string(failure.InfoHash)] = failure
+	}
+	return nil
+}
+
+func (db *memoryDatabase) DeleteFailedInfoHashes(ctx context.Context, infoHashes [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, infoHash := range infoHashes {
+		delete(db.failures, string(infoHash))
+	}
+	return nil
+}
+
+func (db *memoryDatabase) DeleteFailedInfoHashesBefore(ctx context.Context, retryAfter int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for infoHash, failure := range db.failures {
+		if failure.RetryAfter < retryAfter {
+			delete(db.failures, infoHash)
+		}
+	}
+	return nil
+}
+
+func (db *memoryDatabase) TrimFailedInfoHashes(ctx context.Context, keep int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	failures := db.sortedFailuresLocked()
+	for _, failure := range failures[min(keep, len(failures)):] {
+		delete(db.failures, string(failure.InfoHash))
+	}
+	return nil
+}
+
+// words splits s into lower-case words of letters and digits, as SQLite's full-text search does.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func equal(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
@@ -0,0 +1,339 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is a change to the schema of the database, along with the change that reverts it.
+// Migrations are files named after their version, e.g. 0001_create_universe.sql, and those that
+// revert them end in .down.sql instead.
+type Migration struct {
+	Version  int
+	Name     string
+	Checksum string // the hex-encoded SHA-256 of Up
+	Up       string
+	Down     string
+}
+
+// MigrationStatus is whether a migration has been applied to the database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt int64 // as a Unix time
+	// Modified is whether the migration was applied with another checksum: its file has been
+	// edited since.
+	Modified bool
+	// Unknown is whether the migration was applied by another version of magnetico, which has a
+	// file for it that this one lacks. Only its version and name are known.
+	Unknown bool
+}
+
+// Migrator is implemented by the databases whose schema is migrated, which the in-memory one is
+// not. They record the migrations applied in the schema_migrations table, and apply those they
+// lack as they open, unless Options.SkipMigrations.
+type Migrator interface {
+	// MigrationStatus returns the migrations that are known or applied, in the order of their
+	// versions.
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	// MigrateUp applies the migrations that have not been applied, in order, and returns them; if
+	// dryRun, it only returns them.
+	MigrateUp(ctx context.Context, dryRun bool) ([]Migration, error)
+	// MigrateDown reverts the last n migrations applied, last first, and returns them; if dryRun,
+	// it only returns them.
+	MigrateDown(ctx context.Context, n int, dryRun bool) ([]Migration, error)
+}
+
+// dialect is how the migrations of a database engine differ from those of the others.
+type dialect struct {
+	migrations embed.FS
+	dir        string
+
+	createTable     string
+	insertMigration string // version, name, checksum and applied_at
+	deleteMigration string // version
+	// lock, unless empty, is run first in migrating transactions, so that processes migrating the
+	// same database do so one after the other.
+	lock string
+	// legacyVersion returns the version of a database migrated before schema_migrations existed,
+	// or zero.
+	legacyVersion func(ctx context.Context, tx *sql.Tx) (int, error)
+	// setVersion, unless nil, is called with the latest version applied after migrating.
+	setVersion func(ctx context.Context, tx *sql.Tx, version int) error
+}
+
+// migrator migrates a database, all in one transaction, so that the schema is never left half
+// migrated.
+type migrator struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func (m migrator) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.inTransaction(ctx, false, func(tx *sql.Tx, known []Migration, applied map[int]MigrationStatus) error {
+		for _, migration := range known {
+			status, ok := applied[migration.Version]
+			if !ok {
+				status.Migration = migration
+			} else {
+				status.Modified = status.Checksum != migration.Checksum
+				status.Migration = migration
+				delete(applied, migration.Version)
+			}
+			statuses = append(statuses, status)
+		}
+		for _, status := range applied {
+			status.Unknown = true
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, err
+}
+
+func (m migrator) MigrateUp(ctx context.Context, dryRun bool) ([]Migration, error) {
+	var pending []Migration
+	err := m.inTransaction(ctx, !dryRun, func(tx *sql.Tx, known []Migration, applied map[int]MigrationStatus) error {
+		for _, migration := range known {
+			if status, ok := applied[migration.Version]; !ok {
+				pending = append(pending, migration)
+			} else if status.Checksum != migration.Checksum {
+				return fmt.Errorf("%s has been modified since it was applied", migration.Name)
+			}
+		}
+		if dryRun {
+			return nil
+		}
+
+		for _, migration := range pending {
+			logger.Info("applying migration", "name", migration.Name)
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return fmt.Errorf("sql.Tx.Exec (%s) %w", migration.Name, err)
+			}
+			_, err := tx.ExecContext(ctx, m.dialect.insertMigration,
+				migration.Version, migration.Name, migration.Checksum, time.Now().Unix())
+			if err != nil {
+				return fmt.Errorf("sql.Tx.Exec (INSERT INTO schema_migrations) %w", err)
+			}
+			applied[migration.Version] = MigrationStatus{Migration: migration, Applied: true}
+		}
+
+		return m.setVersion(ctx, tx, applied)
+	})
+	return pending, err
+}
+
+func (m migrator) MigrateDown(ctx context.Context, n int, dryRun bool) ([]Migration, error) {
+	var reverted []Migration
+	err := m.inTransaction(ctx, !dryRun, func(tx *sql.Tx, known []Migration, applied map[int]MigrationStatus) error {
+		if n < 0 || n > len(applied) {
+			return fmt.Errorf("cannot revert %d migrations, as %d are applied", n, len(applied))
+		}
+
+		byVersion := make(map[int]Migration, len(known))
+		for _, migration := range known {
+			byVersion[migration.Version] = migration
+		}
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for _, version := range versions[:n] {
+			migration, ok := byVersion[version]
+			if !ok {
+				return fmt.Errorf("%s is unknown to this version of magnetico", applied[version].Name)
+			} else if applied[version].Checksum != migration.Checksum {
+				return fmt.Errorf("%s has been modified since it was applied", migration.Name)
+			} else if migration.Down == "" {
+				return fmt.Errorf("%s cannot be reverted", migration.Name)
+			}
+			reverted = append(reverted, migration)
+		}
+		if dryRun {
+			return nil
+		}
+
+		for _, migration := range reverted {
+			logger.Info("reverting migration", "name", migration.Name)
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return fmt.Errorf("sql.Tx.Exec (%s) %w", migration.Name, err)
+			}
+			if _, err := tx.ExecContext(ctx, m.dialect.deleteMigration, migration.Version); err != nil {
+				return fmt.Errorf("sql.Tx.Exec (DELETE FROM schema_migrations) %w", err)
+			}
+			delete(applied, migration.Version)
+		}
+
+		return m.setVersion(ctx, tx, applied)
+	})
+	return reverted, err
+}
+
+// inTransaction calls f with the known migrations and those applied, by version, in a transaction
+// that is committed if commit and f succeeds, and rolled back otherwise.
+func (m migrator) inTransaction(
+	ctx context.Context,
+	commit bool,
+	f func(tx *sql.Tx, known []Migration, applied map[int]MigrationStatus) error,
+) error {
+	known, err := readMigrations(m.dialect.migrations, m.dialect.dir)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sql.DB.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if m.dialect.lock != "" {
+		if _, err = tx.ExecContext(ctx, m.dialect.lock); err != nil {
+			return fmt.Errorf("sql.Tx.Exec (lock) %w", err)
+		}
+	}
+
+	applied, err := m.readApplied(ctx, tx, known)
+	if err != nil {
+		return err
+	}
+
+	if err = f(tx, known, applied); err != nil {
+		return err
+	}
+	if !commit {
+		return nil
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("sql.Tx.Commit %w", err)
+	}
+	return nil
+}
+
+// readApplied returns the migrations applied, by version, creating the schema_migrations table if
+// need be. The migrations of a database migrated before the table existed are recorded as applied
+// with the checksums of the known ones.
+func (m migrator) readApplied(ctx context.Context, tx *sql.Tx, known []Migration) (map[int]MigrationStatus, error) {
+	if _, err := tx.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return nil, fmt.Errorf("sql.Tx.Exec (CREATE TABLE schema_migrations) %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, fmt.Errorf("sql.Tx.Query (schema_migrations) %w", err)
+	}
+	defer closeRows(rows)
+
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		status := MigrationStatus{Applied: true}
+		if err = rows.Scan(&status.Version, &status.Name, &status.Checksum, &status.AppliedAt); err != nil {
+			return nil, fmt.Errorf("sql.Rows.Scan (schema_migrations) %w", err)
+		}
+		applied[status.Version] = status
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("sql.Rows.Err (schema_migrations) %w", err)
+	}
+	if len(applied) > 0 {
+		return applied, nil
+	}
+
+	legacyVersion, err := m.dialect.legacyVersion(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, migration := range known {
+		if migration.Version > legacyVersion {
+			break
+		}
+		_, err = tx.ExecContext(ctx, m.dialect.insertMigration,
+			migration.Version, migration.Name, migration.Checksum, time.Now().Unix())
+		if err != nil {
+			return nil, fmt.Errorf("sql.Tx.Exec (INSERT INTO schema_migrations) %w", err)
+		}
+		applied[migration.Version] = MigrationStatus{Migration: migration, Applied: true, AppliedAt: time.Now().Unix()}
+	}
+
+	return applied, nil
+}
+
+func (m migrator) setVersion(ctx context.Context, tx *sql.Tx, applied map[int]MigrationStatus) error {
+	if m.dialect.setVersion == nil {
+		return nil
+	}
+
+	var version int
+	for v := range applied {
+		version = max(version, v)
+	}
+	return m.dialect.setVersion(ctx, tx, version)
+}
+
+// readMigrations returns the migrations in dir, in the order of their versions.
+func readMigrations(fsys embed.FS, dir string) ([]Migration, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("migrations.ReadDir %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		version, err := strconv.ParseInt(strings.Split(entry.Name(), "_")[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("strconv.ParseInt %w", err)
+		}
+		contents, err := fsys.ReadFile(dir + "/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("fs.ReadFile %w", err)
+		}
+
+		migration, ok := byVersion[int(version)]
+		if !ok {
+			migration = &Migration{Version: int(version)}
+			byVersion[int(version)] = migration
+		}
+		if strings.HasSuffix(entry.Name(), ".down.sql") {
+			migration.Down = string(contents)
+		} else if migration.Name != "" {
+			return nil, fmt.Errorf("%s and %s have the same version", migration.Name, entry.Name())
+		} else {
+			checksum := sha256.Sum256(contents)
+			migration.Name = entry.Name()
+			migration.Checksum = hex.EncodeToString(checksum[:])
+			migration.Up = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Name == "" {
+			return nil, fmt.Errorf("migration %d is only a down migration", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
@@ -0,0 +1,5 @@
+DROP INDEX files_torrent_id_index;
+DROP TABLE files;
+
+DROP INDEX info_hash_index;
+DROP TABLE torrents;
@@ -20,7 +20,7 @@ CREATE TABLE files (
     id INTEGER PRIMARY KEY,
     torrent_id INTEGER REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
     size INTEGER NOT NULL,
-    path TEXT NOT NULL,
+    path TEXT NOT NULL
 );
 
 -- Optimize lookups for files by torrent ID.
@@ -0,0 +1,5 @@
+DROP TRIGGER torrents_idx_au_t;
+DROP TRIGGER torrents_idx_ad_t;
+DROP TRIGGER torrents_idx_ai_t;
+
+DROP TABLE torrents_idx;
@@ -0,0 +1,2 @@
+DROP INDEX failed_info_hashes_retry_after_index;
+DROP TABLE failed_info_hashes;
@@ -0,0 +1,6 @@
+-- Store the verified, bencoded info dictionary of each torrent, compressed with zlib.
+-- Kept apart from the torrents table so that scanning torrents stays cheap.
+CREATE TABLE torrent_infos (
+    torrent_id INTEGER PRIMARY KEY REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+    info BLOB NOT NULL
+);
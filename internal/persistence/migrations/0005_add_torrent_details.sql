@@ -0,0 +1,9 @@
+-- Torrent-wide properties of the info dictionary. Torrents added before this migration have
+-- neither, hence the defaults.
+ALTER TABLE torrents ADD COLUMN piece_length INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN piece_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN private INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN source TEXT NOT NULL DEFAULT '';
+
+-- BEP 47 file attributes, such as "x" for executable files.
+ALTER TABLE files ADD COLUMN attr TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP INDEX info_hash_v2_index;
+ALTER TABLE torrents DROP COLUMN info_hash_v2;
@@ -0,0 +1,14 @@
+-- Restore the trigger that reindexes torrents on every update.
+DROP TRIGGER torrents_idx_au_t;
+CREATE TRIGGER torrents_idx_au_t AFTER UPDATE ON torrents BEGIN
+    INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
+    INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
+END;
+
+DROP INDEX torrents_category_index;
+
+ALTER TABLE torrents DROP COLUMN episode;
+ALTER TABLE torrents DROP COLUMN season;
+ALTER TABLE torrents DROP COLUMN codec;
+ALTER TABLE torrents DROP COLUMN resolution;
+ALTER TABLE torrents DROP COLUMN category;
@@ -0,0 +1,17 @@
+-- Content category and attributes, as assigned by the classifier. Torrents added before this
+-- migration have an empty category until they are backfilled.
+ALTER TABLE torrents ADD COLUMN category TEXT NOT NULL DEFAULT '';
+ALTER TABLE torrents ADD COLUMN resolution TEXT NOT NULL DEFAULT '';
+ALTER TABLE torrents ADD COLUMN codec TEXT NOT NULL DEFAULT '';
+ALTER TABLE torrents ADD COLUMN season INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN episode INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX torrents_category_index ON torrents (category);
+
+-- Only the name is indexed for search, so there is no point in reindexing torrents (such as while
+-- backfilling categories) unless it changes.
+DROP TRIGGER torrents_idx_au_t;
+CREATE TRIGGER torrents_idx_au_t AFTER UPDATE OF name ON torrents BEGIN
+    INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
+    INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
+END;
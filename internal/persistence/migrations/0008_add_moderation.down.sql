@@ -0,0 +1,9 @@
+DROP INDEX audit_log_created_at_index;
+DROP TABLE audit_log;
+
+-- Columns cannot be dropped while an index refers to them.
+DROP INDEX torrents_hidden_index;
+
+ALTER TABLE torrents DROP COLUMN flag_reason;
+ALTER TABLE torrents DROP COLUMN flagged;
+ALTER TABLE torrents DROP COLUMN hidden;
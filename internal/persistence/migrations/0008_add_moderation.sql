@@ -0,0 +1,21 @@
+-- Hidden torrents are kept (so that they are not indexed again when rediscovered) but never shown.
+-- Flagged torrents are shown, but marked for review.
+ALTER TABLE torrents ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN flagged INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN flag_reason TEXT NOT NULL DEFAULT '';
+
+-- Few torrents are ever hidden, so a partial index keeps counting them cheap.
+CREATE INDEX torrents_hidden_index ON torrents (id) WHERE hidden;
+
+-- Who did what to which torrent, and when. Deleted torrents are referred to by their info hash, as
+-- their rows are gone.
+CREATE TABLE audit_log (
+    id INTEGER PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    info_hash BLOB NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX audit_log_created_at_index ON audit_log (created_at);
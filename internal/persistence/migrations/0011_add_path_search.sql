@@ -0,0 +1,4 @@
+-- PostgreSQL searches the paths of files as well as the names of torrents from this version on.
+-- SQLite searches names only, as a full-text index of every path would about double the size of
+-- its single file; this migration only keeps the versions of both dialects in step.
+SELECT 1;
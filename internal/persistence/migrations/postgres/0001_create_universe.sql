@@ -0,0 +1,24 @@
+-- Create the primary torrents table.
+CREATE TABLE torrents (
+    -- Core info.
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    info_hash BYTEA NOT NULL UNIQUE, -- which indexes torrents by info hash
+    name TEXT NOT NULL,
+    total_size BIGINT NOT NULL,
+
+    -- Timestamps.
+    created_at BIGINT NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+-- Create the files table.
+CREATE TABLE files (
+    -- Core info.
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    torrent_id BIGINT REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+    size BIGINT NOT NULL,
+    path TEXT NOT NULL
+);
+
+-- Optimize lookups for files by torrent ID.
+CREATE INDEX files_torrent_id_index ON files (torrent_id);
@@ -0,0 +1,4 @@
+DROP INDEX torrents_name_tsv_index;
+ALTER TABLE torrents DROP COLUMN name_tsv;
+
+DROP FUNCTION search_words(text);
@@ -0,0 +1,13 @@
+-- search_words splits names and queries into words at punctuation and spaces, which SQLite's FTS5
+-- does but the parser of PostgreSQL does not always do: it would keep "ubuntu-22.04" as a single
+-- word, for instance.
+CREATE FUNCTION search_words(text) RETURNS text AS $$
+    SELECT regexp_replace($1, '[[:punct:][:space:]]+', ' ', 'g');
+$$ LANGUAGE SQL IMMUTABLE PARALLEL SAFE;
+
+-- The 'simple' configuration lowercases words, but neither stems them nor drops stop words, so that
+-- phrase queries match the same torrents as on SQLite.
+ALTER TABLE torrents ADD COLUMN name_tsv TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', search_words(name))) STORED;
+
+CREATE INDEX torrents_name_tsv_index ON torrents USING GIN (name_tsv);
@@ -0,0 +1,13 @@
+-- Info hashes whose metadata could not be fetched, so that we back off from them.
+CREATE TABLE failed_info_hashes (
+    info_hash BYTEA PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+
+    -- Timestamps.
+    last_failed_at BIGINT NOT NULL,
+    retry_after BIGINT NOT NULL
+);
+
+-- Optimize pruning of failures whose backoff has long elapsed.
+CREATE INDEX failed_info_hashes_retry_after_index ON failed_info_hashes (retry_after);
@@ -0,0 +1 @@
+DROP TABLE torrent_infos;
@@ -0,0 +1,6 @@
+ALTER TABLE files DROP COLUMN attr;
+
+ALTER TABLE torrents DROP COLUMN source;
+ALTER TABLE torrents DROP COLUMN private;
+ALTER TABLE torrents DROP COLUMN piece_count;
+ALTER TABLE torrents DROP COLUMN piece_length;
@@ -0,0 +1 @@
+ALTER TABLE torrents DROP COLUMN info_hash_v2;
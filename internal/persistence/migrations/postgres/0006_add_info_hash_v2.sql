@@ -0,0 +1,5 @@
+-- The full SHA-256 info hash of v2 and hybrid torrents (BEP 52). v1-only torrents have none.
+ALTER TABLE torrents ADD COLUMN info_hash_v2 BYTEA;
+
+-- Optimize lookups for torrents by v2 info hash. NULLs are distinct as far as UNIQUE is concerned.
+CREATE UNIQUE INDEX info_hash_v2_index ON torrents (info_hash_v2);
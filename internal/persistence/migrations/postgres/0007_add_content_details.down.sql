@@ -0,0 +1,5 @@
+ALTER TABLE torrents DROP COLUMN episode;
+ALTER TABLE torrents DROP COLUMN season;
+ALTER TABLE torrents DROP COLUMN codec;
+ALTER TABLE torrents DROP COLUMN resolution;
+ALTER TABLE torrents DROP COLUMN category;
@@ -0,0 +1,9 @@
+-- Content category and attributes, as assigned by the classifier. Torrents added before this
+-- migration have an empty category until they are backfilled.
+ALTER TABLE torrents ADD COLUMN category TEXT NOT NULL DEFAULT '';
+ALTER TABLE torrents ADD COLUMN resolution TEXT NOT NULL DEFAULT '';
+ALTER TABLE torrents ADD COLUMN codec TEXT NOT NULL DEFAULT '';
+ALTER TABLE torrents ADD COLUMN season INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE torrents ADD COLUMN episode INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX torrents_category_index ON torrents (category);
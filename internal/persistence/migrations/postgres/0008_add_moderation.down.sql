@@ -0,0 +1,5 @@
+DROP TABLE audit_log;
+
+ALTER TABLE torrents DROP COLUMN flag_reason;
+ALTER TABLE torrents DROP COLUMN flagged;
+ALTER TABLE torrents DROP COLUMN hidden;
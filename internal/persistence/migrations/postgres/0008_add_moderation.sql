@@ -0,0 +1,21 @@
+-- Hidden torrents are kept (so that they are not indexed again when rediscovered) but never shown.
+-- Flagged torrents are shown, but marked for review.
+ALTER TABLE torrents ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE torrents ADD COLUMN flagged BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE torrents ADD COLUMN flag_reason TEXT NOT NULL DEFAULT '';
+
+-- Few torrents are ever hidden, so a partial index keeps counting them cheap.
+CREATE INDEX torrents_hidden_index ON torrents (id) WHERE hidden;
+
+-- Who did what to which torrent, and when. Deleted torrents are referred to by their info hash, as
+-- their rows are gone.
+CREATE TABLE audit_log (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    info_hash BYTEA NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL
+);
+
+CREATE INDEX audit_log_created_at_index ON audit_log (created_at);
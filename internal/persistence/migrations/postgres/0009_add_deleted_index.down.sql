@@ -0,0 +1 @@
+DROP INDEX audit_log_deleted_index;
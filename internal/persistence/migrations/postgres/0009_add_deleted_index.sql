@@ -0,0 +1,3 @@
+-- Deleted torrents are looked up in the audit log whenever they are rediscovered, so that they are
+-- not indexed again.
+CREATE INDEX audit_log_deleted_index ON audit_log (info_hash) WHERE action = 'delete';
@@ -0,0 +1 @@
+DROP INDEX info_hash_v2_truncated_index;
@@ -0,0 +1,3 @@
+-- Hybrid torrents are stored under their v1 info hash, but are sighted on the DHT by their v2 info
+-- hash truncated to 20 bytes too, which DoesTorrentExist looks up with this expression.
+CREATE INDEX info_hash_v2_truncated_index ON torrents ((substr(info_hash_v2, 1, 20)));
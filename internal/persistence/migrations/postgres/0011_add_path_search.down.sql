@@ -0,0 +1,2 @@
+DROP INDEX files_path_tsv_index;
+ALTER TABLE files DROP COLUMN path_tsv;
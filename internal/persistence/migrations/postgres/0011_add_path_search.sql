@@ -0,0 +1,6 @@
+-- The paths of files are searched as well as the names of torrents, as large torrents are often
+-- named after their release rather than after the files they contain.
+ALTER TABLE files ADD COLUMN path_tsv TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', search_words(path))) STORED;
+
+CREATE INDEX files_path_tsv_index ON files USING GIN (path_tsv);
@@ -0,0 +1,325 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"reflect"
+	"testing"
+)
+
+// migratedDatabase is a database along with the connection its migrations run over, to inspect
+// its schema.
+type migratedDatabase struct {
+	Migrator
+	conn     *sql.DB
+	postgres bool
+}
+
+// forEachMigratedDatabase runs test against a new database of every implementation that is
+// migrated.
+func forEachMigratedDatabase(t *testing.T, test func(t *testing.T, db migratedDatabase)) {
+	t.Run("sqlite3", func(t *testing.T) {
+		db := newTestDatabase(t)
+		test(t, migratedDatabase{db, db.writer, false})
+	})
+	t.Run("postgres", func(t *testing.T) {
+		db := newTestPostgresDatabase(t).(*postgresDatabase)
+		test(t, migratedDatabase{db, db.pool, true})
+	})
+}
+
+// schema describes the tables, columns, indices, triggers and functions of the database, besides
+// schema_migrations, one per line.
+func (db migratedDatabase) schema(t *testing.T) []string {
+	query := `
+		SELECT type || ' ' || name || ': ' || IFNULL(sql, '')
+		FROM sqlite_master
+		WHERE name != 'schema_migrations'
+		ORDER BY 1;
+	`
+	if db.postgres {
+		query = `
+			SELECT 'column ' || table_name || '.' || column_name || ': ' || data_type || ' '
+				|| is_nullable || ' ' || COALESCE(column_default, '') || COALESCE(generation_expression, '')
+			FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name != 'schema_migrations'
+			UNION ALL
+			SELECT 'index ' || indexname || ': ' || indexdef
+			FROM pg_indexes
+			WHERE schemaname = current_schema() AND tablename != 'schema_migrations'
+			UNION ALL
+			SELECT 'function ' || proname
+			FROM pg_proc
+			WHERE pronamespace = current_schema()::regnamespace
+			ORDER BY 1;
+		`
+	}
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		t.Fatalf("could not query the schema: %v", err)
+	}
+	defer rows.Close()
+
+	var schema []string
+	for rows.Next() {
+		var line string
+		if err = rows.Scan(&line); err != nil {
+			t.Fatalf("could not scan the schema: %v", err)
+		}
+		schema = append(schema, line)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatalf("could not query the schema: %v", err)
+	}
+	return schema
+}
+
+// columns returns the names of the columns of table, in order.
+func (db migratedDatabase) columns(t *testing.T, table string) []string {
+	query := "SELECT name FROM pragma_table_info(?) ORDER BY cid;"
+	if db.postgres {
+		query = `
+			SELECT column_name
+			FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1
+			ORDER BY ordinal_position;
+		`
+	}
+
+	rows, err := db.conn.Query(query, table)
+	if err != nil {
+		t.Fatalf("could not query the columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			t.Fatalf("could not scan the columns of %s: %v", table, err)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// latestVersion returns the version of the last migration, which both dialects share.
+func latestVersion(t *testing.T) int {
+	known, err := readMigrations(migrations, "migrations")
+	if err != nil {
+		t.Fatalf("could not read the migrations: %v", err)
+	}
+	return known[len(known)-1].Version
+}
+
+func TestMigrationsCanBeReverted(t *testing.T) {
+	for dir, fsys := range map[string]embed.FS{"migrations": migrations, "migrations/postgres": postgresMigrations} {
+		known, err := readMigrations(fsys, dir)
+		if err != nil {
+			t.Fatalf("could not read the migrations in %s: %v", dir, err)
+		}
+		for i, migration := range known {
+			if migration.Version != i+1 {
+				t.Errorf("%s/%s: expected version %d", dir, migration.Name, i+1)
+			}
+			if migration.Down == "" {
+				t.Errorf("%s/%s: expected a down migration", dir, migration.Name)
+			}
+		}
+	}
+}
+
+// The first migration as released had a trailing comma after the last column of files, which
+// SQLite rejects, so no database could be created with it. Its fixed version is the one every
+// database records the checksum of, hence it must not change again, not even in its comments.
+const createUniverseChecksum = "33e13bdd49bde91357274a5de7a6fdc0b1b9f26978e1a887c4f2975a457c91e1"
+
+func TestCreateUniverseIsUnchanged(t *testing.T) {
+	known, err := readMigrations(migrations, "migrations")
+	if err != nil {
+		t.Fatalf("could not read the migrations: %v", err)
+	}
+	if known[0].Checksum != createUniverseChecksum {
+		t.Errorf("expected %s to be left as is, as databases record its checksum", known[0].Name)
+	}
+}
+
+func TestMigrationsSchema(t *testing.T) {
+	forEachMigratedDatabase(t, func(t *testing.T, db migratedDatabase) {
+		torrents := []string{"id", "info_hash", "name", "total_size", "created_at", "updated_at",
+			"piece_length", "piece_count", "private", "source", "info_hash_v2", "category",
+			"resolution", "codec", "season", "episode", "hidden", "flagged", "flag_reason"}
+		files := []string{"id", "torrent_id", "size", "path", "attr"}
+		if db.postgres {
+			// The words of names and paths, to search them.
+			torrents = append(torrents[:6], append([]string{"name_tsv"}, torrents[6:]...)...)
+			files = append(files[:4], append([]string{"path_tsv"}, files[4:]...)...)
+		}
+
+		for table, expected := range map[string][]string{
+			"torrents":           torrents,
+			"files":              files,
+			"failed_info_hashes": {"info_hash", "failures", "last_error", "last_failed_at", "retry_after"},
+			"torrent_infos":      {"torrent_id", "info"},
+			"audit_log":          {"id", "actor", "action", "info_hash", "reason", "created_at"},
+			"schema_migrations":  {"version", "name", "checksum", "applied_at"},
+		} {
+			if columns := db.columns(t, table); !reflect.DeepEqual(columns, expected) {
+				t.Errorf("%s: expected the columns %v, got %v", table, expected, columns)
+			}
+		}
+
+		statuses, err := db.MigrationStatus(context.Background())
+		if err != nil {
+			t.Fatalf("could not get the status of the migrations: %v", err)
+		}
+		if latest := latestVersion(t); len(statuses) != latest {
+			t.Errorf("expected %d migrations, got %d", latest, len(statuses))
+		}
+		for _, status := range statuses {
+			if !status.Applied || status.Modified || status.Unknown || status.AppliedAt == 0 {
+				t.Errorf("expected %s to be applied as is, got %+v", status.Name, status)
+			}
+		}
+	})
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	forEachMigratedDatabase(t, func(t *testing.T, db migratedDatabase) {
+		ctx := context.Background()
+		schema := db.schema(t)
+		latest := latestVersion(t)
+
+		// Reverting the last n migrations and applying them again leaves the schema as it was,
+		// for every n.
+		for n := 1; n <= latest; n++ {
+			reverted, err := db.MigrateDown(ctx, n, false)
+			if err != nil {
+				t.Fatalf("could not revert %d migrations: %v", n, err)
+			}
+			if len(reverted) != n || reverted[0].Version != latest || reverted[n-1].Version != latest+1-n {
+				t.Errorf("expected to revert migrations %d to %d, got %+v", latest, latest+1-n, reverted)
+			}
+
+			applied, err := db.MigrateUp(ctx, false)
+			if err != nil {
+				t.Fatalf("could not apply %d migrations again: %v", n, err)
+			}
+			if len(applied) != n {
+				t.Errorf("expected to apply %d migrations again, got %d", n, len(applied))
+			}
+			if after := db.schema(t); !reflect.DeepEqual(after, schema) {
+				t.Errorf("expected the schema to be the same after reverting %d migrations, got\n%v\ninstead of\n%v", n, after, schema)
+			}
+		}
+
+		if _, err := db.MigrateDown(ctx, latest, false); err != nil {
+			t.Fatalf("could not revert every migration: %v", err)
+		}
+		if after := db.schema(t); len(after) != 0 {
+			t.Errorf("expected no schema left, got %v", after)
+		}
+		if _, err := db.MigrateDown(ctx, 1, false); err == nil {
+			t.Errorf("expected reverting more migrations than applied to fail")
+		}
+	})
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	forEachMigratedDatabase(t, func(t *testing.T, db migratedDatabase) {
+		ctx := context.Background()
+		schema := db.schema(t)
+
+		reverted, err := db.MigrateDown(ctx, 2, true)
+		if err != nil {
+			t.Fatalf("could not revert migrations: %v", err)
+		}
+		if len(reverted) != 2 || reverted[0].Version != latestVersion(t) || reverted[0].Down == "" {
+			t.Errorf("expected the last 2 migrations, got %+v", reverted)
+		}
+		if after := db.schema(t); !reflect.DeepEqual(after, schema) {
+			t.Errorf("expected a dry run not to change the schema, got %v", after)
+		}
+
+		if _, err = db.MigrateDown(ctx, 1, false); err != nil {
+			t.Fatalf("could not revert a migration: %v", err)
+		}
+		pending, err := db.MigrateUp(ctx, true)
+		if err != nil {
+			t.Fatalf("could not apply migrations: %v", err)
+		}
+		if len(pending) != 1 || pending[0].Version != latestVersion(t) {
+			t.Errorf("expected the last migration to be pending, got %+v", pending)
+		}
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatalf("could not get the status of the migrations: %v", err)
+		}
+		if last := statuses[len(statuses)-1]; last.Applied {
+			t.Errorf("expected a dry run not to apply the last migration, got %+v", last)
+		}
+	})
+}
+
+func TestMigrationChecksums(t *testing.T) {
+	forEachMigratedDatabase(t, func(t *testing.T, db migratedDatabase) {
+		ctx := context.Background()
+		if _, err := db.conn.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = 3;"); err != nil {
+			t.Fatalf("could not edit the checksum: %v", err)
+		}
+
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatalf("could not get the status of the migrations: %v", err)
+		}
+		for _, status := range statuses {
+			if status.Modified != (status.Version == 3) {
+				t.Errorf("expected only migration 3 to be modified, got %+v", status)
+			}
+		}
+
+		if _, err = db.MigrateUp(ctx, false); err == nil {
+			t.Errorf("expected migrating a modified database to fail")
+		}
+	})
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	forEachMigratedDatabase(t, func(t *testing.T, db migratedDatabase) {
+		ctx := context.Background()
+
+		// Databases migrated before schema_migrations existed recorded their version alone, which
+		// was 8 at most.
+		legacyPending := latestVersion(t) - 8
+		if _, err := db.MigrateDown(ctx, legacyPending, false); err != nil {
+			t.Fatalf("could not revert the migrations after 8: %v", err)
+		}
+		statements := "DROP TABLE schema_migrations;"
+		if db.postgres {
+			statements += "CREATE TABLE schema_version (version INTEGER NOT NULL); INSERT INTO schema_version VALUES (8);"
+		}
+		if _, err := db.conn.Exec(statements); err != nil {
+			t.Fatalf("could not make the database a legacy one: %v", err)
+		}
+
+		pending, err := db.MigrateUp(ctx, false)
+		if err != nil {
+			t.Fatalf("could not migrate the database: %v", err)
+		}
+		if len(pending) != legacyPending {
+			t.Errorf("expected the migrations after 8 to be pending, got %+v", pending)
+		}
+
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatalf("could not get the status of the migrations: %v", err)
+		}
+		for _, status := range statuses {
+			if !status.Applied || status.Modified {
+				t.Errorf("expected %s to be recorded as applied, got %+v", status.Name, status)
+			}
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Environment variables that override DefaultOptions.
+const (
+	ReadConnectionsEnv = "MAGNETICO_DB_READ_CONNECTIONS"
+	BusyTimeoutEnv     = "MAGNETICO_DB_BUSY_TIMEOUT"
+	SynchronousEnv     = "MAGNETICO_DB_SYNCHRONOUS"
+	MmapSizeEnv        = "MAGNETICO_DB_MMAP_SIZE"
+	CacheSizeEnv       = "MAGNETICO_DB_CACHE_SIZE"
+	SearchTimeoutEnv   = "MAGNETICO_DB_SEARCH_TIMEOUT"
+	ReadTimeoutEnv     = "MAGNETICO_DB_READ_TIMEOUT"
+	WriteTimeoutEnv    = "MAGNETICO_DB_WRITE_TIMEOUT"
+)
+
+// Options tune the connections to the database: a single one that writes, and a pool of read-only
+// ones that the queries of the web interface share, so that neither blocks the other. PostgreSQL
+// databases have a single pool instead, see NewPostgresDatabase.
+type Options struct {
+	// ReadConnections is the maximum number of read-only connections.
+	ReadConnections int
+	// BusyTimeout is how long a connection waits for a lock before failing with SQLITE_BUSY.
+	BusyTimeout time.Duration
+	// Synchronous is the synchronous pragma: "OFF", "NORMAL", "FULL" or "EXTRA". NORMAL does not
+	// risk corruption in WAL mode, only losing the last transactions on a power failure.
+	Synchronous string
+	// MmapSize is how many bytes of the database each connection maps into memory.
+	MmapSize uint64
+	// CacheSize is how many bytes of pages each connection caches.
+	CacheSize uint64
+
+	// SearchTimeout, ReadTimeout and WriteTimeout bound how long full-text searches, other reads,
+	// and writes may take, respectively, unless zero. They are on top of the deadline of the
+	// context of each operation, if any.
+	SearchTimeout time.Duration
+	ReadTimeout   time.Duration
+	WriteTimeout  time.Duration
+
+	// SkipMigrations leaves the schema as it is when opening the database, for the sake of
+	// commands that migrate it themselves.
+	SkipMigrations bool
+}
+
+// DefaultOptions are the options used unless the environment overrides them.
+var DefaultOptions = Options{
+	ReadConnections: 4,
+	BusyTimeout:     5 * time.Second,
+	Synchronous:     "NORMAL",
+	MmapSize:        256 << 20,
+	CacheSize:       64 << 20,
+	SearchTimeout:   10 * time.Second,
+	ReadTimeout:     5 * time.Second,
+	WriteTimeout:    30 * time.Second,
+}
+
+// OptionsFromEnv returns DefaultOptions, overridden by those set in the environment.
+func OptionsFromEnv() (Options, error) {
+	opts := DefaultOptions
+
+	if s := os.Getenv(ReadConnectionsEnv); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid number of connections %q in %s", s, ReadConnectionsEnv)
+		}
+		opts.ReadConnections = n
+	}
+
+	for _, duration := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{BusyTimeoutEnv, &opts.BusyTimeout},
+		{SearchTimeoutEnv, &opts.SearchTimeout},
+		{ReadTimeoutEnv, &opts.ReadTimeout},
+		{WriteTimeoutEnv, &opts.WriteTimeout},
+	} {
+		if s := os.Getenv(duration.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				return opts, fmt.Errorf("invalid duration %q in %s", s, duration.env)
+			}
+			*duration.value = d
+		}
+	}
+
+	if s := os.Getenv(SynchronousEnv); s != "" {
+		opts.Synchronous = strings.ToUpper(s)
+	}
+
+	for _, size := range []struct {
+		env   string
+		value *uint64
+	}{{MmapSizeEnv, &opts.MmapSize}, {CacheSizeEnv, &opts.CacheSize}} {
+		if s := os.Getenv(size.env); s != "" {
+			n, err := humanize.ParseBytes(s)
+			if err != nil {
+				return opts, fmt.Errorf("invalid size %q in %s", s, size.env)
+			}
+			*size.value = n
+		}
+	}
+
+	return opts, opts.validate()
+}
+
+func (opts Options) validate() error {
+	if opts.ReadConnections < 1 {
+		return fmt.Errorf("invalid number of read connections %d", opts.ReadConnections)
+	}
+	switch opts.Synchronous {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return fmt.Errorf("invalid synchronous mode %q", opts.Synchronous)
+	}
+	return nil
+}
+
+// dsn returns the data source name that opens filename with the options: read-only unless
+// readWrite, in which case transactions take the write lock as they begin, rather than when they
+// first write, so that they wait for it for up to BusyTimeout rather than failing straight away
+// once they have read.
+//
+// PRAGMAs only apply to the connection they are run on, hence their being in the DSN, which every
+// connection of a pool opens: foreign keys, in particular, must be enforced on every connection for
+// ON DELETE CASCADE to work. Temporary files are forced to disk, instead of memory, to reduce the
+// memory footprint.
+func (opts Options) dsn(filename string, readWrite bool) string {
+	pragmas := []string{
+		"foreign_keys(1)",
+		fmt.Sprintf("busy_timeout(%d)", opts.BusyTimeout.Milliseconds()),
+		"synchronous(" + opts.Synchronous + ")",
+		fmt.Sprintf("mmap_size(%d)", opts.MmapSize),
+		fmt.Sprintf("cache_size(%d)", -int64(opts.CacheSize/1024)), // negative sizes are in KiB
+		"temp_store(1)",
+	}
+
+	dsn := "file:" + filename + "?"
+	if readWrite {
+		dsn += "_txlock=immediate"
+	} else {
+		dsn += "mode=ro&_pragma=query_only(1)"
+	}
+	for _, pragma := range pragmas {
+		dsn += "&_pragma=" + pragma
+	}
+	return dsn
+}
+
+// operation is a kind of database operation, which has a timeout of its own.
+type operation int
+
+const (
+	opSearch operation = iota
+	opRead
+	opWrite
+)
+
+// withTimeout returns a copy of ctx that is done once the timeout of the operation elapses.
+func (opts Options) withTimeout(ctx context.Context, op operation) (context.Context, context.CancelFunc) {
+	var timeout time.Duration
+	switch op {
+	case opSearch:
+		timeout = opts.SearchTimeout
+	case opRead:
+		timeout = opts.ReadTimeout
+	case opWrite:
+		timeout = opts.WriteTimeout
+	}
+
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
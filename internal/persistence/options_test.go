@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv(ReadConnectionsEnv, "8")
+	t.Setenv(BusyTimeoutEnv, "10s")
+	t.Setenv(SynchronousEnv, "full")
+	t.Setenv(MmapSizeEnv, "1GiB")
+	t.Setenv(CacheSizeEnv, "16MiB")
+	t.Setenv(SearchTimeoutEnv, "1m")
+	t.Setenv(ReadTimeoutEnv, "0s")
+
+	opts, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Options{
+		ReadConnections: 8,
+		BusyTimeout:     10 * time.Second,
+		Synchronous:     "FULL",
+		MmapSize:        1 << 30,
+		CacheSize:       16 << 20,
+		SearchTimeout:   time.Minute,
+		ReadTimeout:     0,
+		WriteTimeout:    DefaultOptions.WriteTimeout,
+	}
+	if opts != expected {
+		t.Errorf("expected %+v, got %+v", expected, opts)
+	}
+}
+
+func TestOptionsFromEnvRejectsInvalidValues(t *testing.T) {
+	for env, value := range map[string]string{
+		ReadConnectionsEnv: "0",
+		BusyTimeoutEnv:     "5",
+		WriteTimeoutEnv:    "-1s",
+		SynchronousEnv:     "sometimes",
+		MmapSizeEnv:        "lots",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := OptionsFromEnv(); err == nil {
+				t.Errorf("expected %s=%s to be rejected", env, value)
+			}
+		})
+	}
+}
+
+func TestConnections(t *testing.T) {
+	opts := DefaultOptions
+	opts.Synchronous = "FULL"
+	opts.CacheSize = 8 << 20
+	db, err := newSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), opts)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer db.Close()
+
+	var synchronous, cacheSize, queryOnly int
+	if err = db.writer.QueryRow("PRAGMA synchronous;").Scan(&synchronous); err != nil || synchronous != 2 {
+		t.Errorf("expected the writer to be synchronous=FULL (2), got %d (%v)", synchronous, err)
+	}
+	if err = db.reader.QueryRow("PRAGMA cache_size;").Scan(&cacheSize); err != nil || cacheSize != -8192 {
+		t.Errorf("expected the readers to cache 8MiB (-8192), got %d (%v)", cacheSize, err)
+	}
+	if err = db.reader.QueryRow("PRAGMA query_only;").Scan(&queryOnly); err != nil || queryOnly != 1 {
+		t.Errorf("expected the readers to be query-only, got %d (%v)", queryOnly, err)
+	}
+
+	if _, err = db.reader.Exec("DELETE FROM torrents;"); err == nil {
+		t.Errorf("expected the readers not to write")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	opts := DefaultOptions
+	opts.ReadTimeout = time.Nanosecond
+	opts.SearchTimeout = time.Nanosecond
+	db, err := newSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), opts)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err = db.GetNumberOfTorrents(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the read to time out, got %v", err)
+	}
+	if _, err = db.QueryTorrents(context.Background(), "ubuntu", "", ByRelevance, false, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the search to time out, got %v", err)
+	}
+	if err = db.AddNewTorrent(context.Background(), testTorrent(0)); err != nil {
+		t.Errorf("expected the write not to time out, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = db.AddNewTorrent(ctx, testTorrent(1)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the write to be canceled, got %v", err)
+	}
+
+	// Moderation reports timeouts as such too, for the web interface to answer 503 rather than 500.
+	infoHash := testTorrent(0).InfoHash
+	if _, err = db.DeleteTorrent(ctx, infoHash, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the deletion to be canceled, got %v", err)
+	}
+	if _, err = db.SetTorrentHidden(ctx, infoHash, true, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the moderation to be canceled, got %v", err)
+	}
+	if err = db.SetContentDetails(ctx, []ClassifiedTorrent{{ID: 1}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the classification to be canceled, got %v", err)
+	}
+	if err = db.DeleteTorrents(ctx, []uint64{1}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the deletions to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,845 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+	"github.com/t-richards/magnetico/internal/stats"
+)
+
+//go:embed queries/postgres/search.sql
+var postgresSearchQuery string
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresDialect serializes migrations with an advisory lock, which is released as the
+// transaction ends, as instances that start at the same time would migrate the schema concurrently
+// otherwise.
+var postgresDialect = dialect{
+	migrations: postgresMigrations,
+	dir:        "migrations/postgres",
+
+	createTable: `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		);
+	`,
+	insertMigration: "INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES ($1, $2, $3, $4);",
+	deleteMigration: "DELETE FROM schema_migrations WHERE version = $1;",
+	lock:            "SELECT pg_advisory_xact_lock(1835100014);", // "magn"
+
+	// Before schema_migrations, the version was the only row of schema_version.
+	legacyVersion: func(ctx context.Context, tx *sql.Tx) (int, error) {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT to_regclass('schema_version') IS NOT NULL;").Scan(&exists); err != nil {
+			return 0, fmt.Errorf("sql.Tx.QueryRow (to_regclass) %w", err)
+		} else if !exists {
+			return 0, nil
+		}
+
+		var version int
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&version); err != nil {
+			return 0, fmt.Errorf("sql.Tx.QueryRow (schema_version) %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DROP TABLE schema_version;"); err != nil {
+			return 0, fmt.Errorf("sql.Tx.Exec (DROP TABLE schema_version) %w", err)
+		}
+		return version, nil
+	},
+}
+
+// postgresDatabase is the PostgreSQL implementation of Database. Unlike SQLite, PostgreSQL does not
+// serialize writers, so a single pool serves both reads and writes.
+type postgresDatabase struct {
+	pool *sql.DB
+	opts Options
+	// filter, if loaded with LoadInfoHashFilter, rules out most of the info hashes that
+	// DoesTorrentExist is asked about, each of which would cost a round trip to the server.
+	filter *infoHashFilter
+	migrator
+}
+
+// IsPostgresDSN reports whether dsn is the URL of a PostgreSQL database, which Open opens with
+// NewPostgresDatabase.
+func IsPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// NewPostgresDatabase connects to the PostgreSQL database at the URL dsn, and migrates it to the
+// latest version of the schema. Of opts, ReadConnections+1 is the size of the pool of connections,
+// BusyTimeout is their lock_timeout unless dsn sets it, and the timeouts apply as they do to
+// SQLite.
+func NewPostgresDatabase(dsn string, opts Options) (Database, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("pgx.ParseConfig %w", err)
+	}
+	if _, ok := config.RuntimeParams["lock_timeout"]; !ok {
+		config.RuntimeParams["lock_timeout"] = strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10)
+	}
+
+	db := new(postgresDatabase)
+	db.opts = opts
+	db.pool = stdlib.OpenDB(*config)
+	db.pool.SetMaxOpenConns(opts.ReadConnections + 1)
+	db.pool.SetMaxIdleConns(opts.ReadConnections + 1)
+	db.migrator = migrator{db.pool, postgresDialect}
+
+	if err = db.pool.Ping(); err != nil {
+		db.pool.Close()
+		return nil, fmt.Errorf("sql.DB.Ping %w", err)
+	}
+
+	if !opts.SkipMigrations {
+		if _, err = db.MigrateUp(context.Background(), false); err != nil {
+			db.pool.Close()
+			return nil, fmt.Errorf("MigrateUp %w", err)
+		}
+	}
+
+	return db, nil
+}
+
+func (db *postgresDatabase) DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error) {
+	if db.filter != nil && !db.filter.mayContain(infoHash) {
+		return false, nil
+	}
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("DoesTorrentExist", time.Now())
+
+	var exists bool
+	err := db.pool.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM torrents WHERE info_hash = $1 OR substr(info_hash_v2, 1, 20) = $1);", infoHash).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if db.filter != nil && !exists {
+		metrics.DBFilterFalsePositives.Inc()
+	}
+
+	return exists, nil
+}
+
+func (db *postgresDatabase) AddNewTorrent(ctx context.Context, torrent NewTorrent) error {
+	_, err := db.AddNewTorrents(ctx, []NewTorrent{torrent})
+	return err
+}
+
+// AddNewTorrents inserts torrents in a single transaction, skipping those that exist already and
+// those that contain only empty files, as the SQLite implementation does.
+func (db *postgresDatabase) AddNewTorrents(ctx context.Context, torrents []NewTorrent) (int, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+	defer metrics.ObserveDBQuery("AddNewTorrents", time.Now())
+
+	tx, err := db.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("conn.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Torrents whose info hash exists return no row, and are skipped.
+	insertTorrent, err := tx.PrepareContext(ctx, `
+		INSERT INTO torrents (
+			info_hash,
+			info_hash_v2,
+			name,
+			total_size,
+			piece_length,
+			piece_count,
+			private,
+			source,
+			category,
+			resolution,
+			codec,
+			season,
+			episode,
+			created_at,
+			updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (info_hash) DO NOTHING
+		RETURNING id;
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("tx.Prepare (INSERT INTO torrents) %w", err)
+	}
+	defer insertTorrent.Close()
+
+	insertFile, err := tx.PrepareContext(ctx, "INSERT INTO files (torrent_id, size, path, attr) VALUES ($1, $2, $3, $4);")
+	if err != nil {
+		return 0, fmt.Errorf("tx.Prepare (INSERT INTO files) %w", err)
+	}
+	defer insertFile.Close()
+
+	insertInfo, err := tx.PrepareContext(ctx, "INSERT INTO torrent_infos (torrent_id, info) VALUES ($1, $2);")
+	if err != nil {
+		return 0, fmt.Errorf("tx.Prepare (INSERT INTO torrent_infos) %w", err)
+	}
+	defer insertInfo.Close()
+
+	now := time.Now().Unix()
+	var inserted, hybrids [][]byte // the info hashes and truncated v2 info hashes of the torrents inserted
+	for _, torrent := range torrents {
+		var totalSize uint64 = 0
+		for _, file := range torrent.Files {
+			totalSize += uint64(file.Size)
+		}
+
+		// We do not accept torrents that contain only empty files.
+		if totalSize == 0 {
+			continue
+		}
+
+		var id int64
+		err = insertTorrent.QueryRowContext(ctx,
+			torrent.InfoHash,
+			torrent.InfoHashV2,
+			torrent.Name,
+			int64(totalSize),
+			torrent.PieceLength,
+			torrent.PieceCount,
+			torrent.Private,
+			torrent.Source,
+			torrent.Category,
+			torrent.Resolution,
+			torrent.Codec,
+			torrent.Season,
+			torrent.Episode,
+			now,
+			now,
+		).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue // the torrent exists
+		} else if err != nil {
+			return 0, fmt.Errorf("tx.QueryRow (INSERT INTO torrents) %w", err)
+		}
+
+		for _, file := range torrent.Files {
+			if _, err = insertFile.ExecContext(ctx, id, file.Size, file.Path, file.Attr); err != nil {
+				return 0, fmt.Errorf("tx.Exec (INSERT INTO files) %w", err)
+			}
+		}
+
+		if torrent.Info != nil {
+			compressedInfo, err := compress(torrent.Info)
+			if err != nil {
+				return 0, fmt.Errorf("compress %w", err)
+			}
+
+			if _, err = insertInfo.ExecContext(ctx, id, compressedInfo); err != nil {
+				return 0, fmt.Errorf("tx.Exec (INSERT INTO torrent_infos) %w", err)
+			}
+		}
+
+		inserted = append(inserted, torrent.InfoHash)
+		if truncated := truncatedInfoHashV2(torrent.InfoHash, torrent.InfoHashV2); truncated != nil {
+			hybrids = append(hybrids, truncated)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("tx.Commit %w", err)
+	}
+	metrics.TorrentsInserted.Add(float64(len(inserted)))
+	for range inserted {
+		stats.Default.RecordDiscovery()
+	}
+
+	if db.filter != nil && db.filter.add(append(hybrids, inserted...)) {
+		db.filter.rebuild(db.pool)
+	}
+
+	return len(inserted), nil
+}
+
+// LoadInfoHashFilter loads the info hashes of the torrents in the database into a Bloom filter, as
+// the SQLite implementation does.
+func (db *postgresDatabase) LoadInfoHashFilter(ctx context.Context, falsePositiveRate float64) error {
+	f, err := loadInfoHashFilter(ctx, db.pool, falsePositiveRate)
+	if err != nil {
+		return err
+	}
+	db.filter = f
+	return nil
+}
+
+func (db *postgresDatabase) Close() error {
+	if db.filter != nil {
+		db.filter.rebuilds.Wait()
+	}
+	return db.pool.Close()
+}
+
+// GetDatabaseSize returns the size of the database on the server, in bytes.
+func (db *postgresDatabase) GetDatabaseSize(ctx context.Context) (int64, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var size int64
+	err := db.pool.QueryRowContext(ctx, "SELECT pg_database_size(current_database());").Scan(&size)
+	return size, err
+}
+
+// Returns an approximate number of torrents in the database.
+func (db *postgresDatabase) GetNumberOfTorrents(ctx context.Context) (int, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetNumberOfTorrents", time.Now())
+
+	// Counting the rows of a large table takes a sequential scan, so the estimate that the
+	// planner keeps up to date is used instead once there are enough torrents for it to matter.
+	// Until the table has been analyzed, the estimate is off, or -1.
+	var n int
+	err := db.pool.QueryRowContext(ctx, `
+		SELECT
+			CASE WHEN reltuples < 100000 THEN (SELECT COUNT(*) FROM torrents) ELSE reltuples::BIGINT END
+			- (SELECT COUNT(*) FROM torrents WHERE hidden)
+		FROM pg_class
+		WHERE oid = 'torrents'::regclass;
+	`).Scan(&n)
+	return n, err
+}
+
+// QueryTorrentsCount returns the number of torrents whose name or the path of one of whose files
+// matches query, restricted to category unless it is empty.
+func (db *postgresDatabase) QueryTorrentsCount(ctx context.Context, query string, category string) (int, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opSearch)
+	defer cancel()
+	defer metrics.ObserveDBQuery("QueryTorrentsCount", time.Now())
+
+	var count int
+	err := db.pool.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM phraseto_tsquery('simple', search_words($1)) AS query
+		CROSS JOIN LATERAL (
+			SELECT id FROM torrents WHERE name_tsv @@ query
+			UNION
+			SELECT torrent_id FROM files WHERE path_tsv @@ query
+		) AS matches
+		INNER JOIN torrents USING (id)
+		WHERE NOT hidden AND ($2 = '' OR category = $2);
+	`, query, category).Scan(&count)
+
+	return count, err
+}
+
+// QueryTorrents returns a page of the torrents whose name or the path of one of whose files matches
+// query, restricted to category unless it is empty.
+func (db *postgresDatabase) QueryTorrents(
+	ctx context.Context,
+	query string,
+	category string,
+	orderBy OrderingCriteria,
+	ascending bool,
+	offset int,
+) ([]TorrentMetadata, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opSearch)
+	defer cancel()
+	defer metrics.ObserveDBQuery("QueryTorrents", time.Now())
+
+	// Names are ordered byte by byte, as on SQLite, rather than by the collation of the database.
+	orderOnColumn := orderOn(orderBy)
+	if orderBy == ByName {
+		orderOnColumn = `name COLLATE "C"`
+	}
+	sqlQuery := executeTemplate(postgresSearchQuery, searchPlaceholders{
+		OrderOn:   orderOnColumn,
+		Ascending: ascending,
+	}, searchFuncs)
+
+	rows, err := db.pool.QueryContext(ctx, sqlQuery, query, category, MaxResults, offset)
+	if err != nil {
+		return nil, fmt.Errorf("query error %w", err)
+	}
+	defer closeRows(rows)
+
+	torrents := make([]TorrentMetadata, 0)
+	for rows.Next() {
+		var torrent TorrentMetadata
+		err = rows.Scan(
+			&torrent.ID,
+			&torrent.InfoHash,
+			&torrent.InfoHashV2,
+			&torrent.Name,
+			&torrent.Size,
+			&torrent.CreatedAt,
+			&torrent.UpdatedAt,
+			&torrent.NFiles,
+			&torrent.Relevance,
+			&torrent.Category,
+			&torrent.Resolution,
+			&torrent.Codec,
+			&torrent.Season,
+			&torrent.Episode,
+		)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, torrent)
+	}
+
+	return torrents, rows.Err()
+}
+
+func (db *postgresDatabase) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetTorrent", time.Now())
+
+	var tm TorrentMetadata
+	err := db.pool.QueryRowContext(ctx, `
+		SELECT
+			id,
+			info_hash,
+			info_hash_v2,
+			name,
+			total_size,
+			created_at,
+			updated_at,
+			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files,
+			EXISTS(SELECT 1 FROM torrent_infos WHERE torrent_id = torrents.id) AS has_info,
+			piece_length,
+			piece_count,
+			private,
+			source,
+			category,
+			resolution,
+			codec,
+			season,
+			episode,
+			flagged,
+			flag_reason
+		FROM torrents
+		WHERE info_hash = $1 AND NOT hidden;`,
+		infoHash,
+	).Scan(
+		&tm.ID,
+		&tm.InfoHash,
+		&tm.InfoHashV2,
+		&tm.Name,
+		&tm.Size,
+		&tm.CreatedAt,
+		&tm.UpdatedAt,
+		&tm.NFiles,
+		&tm.HasInfo,
+		&tm.PieceLength,
+		&tm.PieceCount,
+		&tm.Private,
+		&tm.Source,
+		&tm.Category,
+		&tm.Resolution,
+		&tm.Codec,
+		&tm.Season,
+		&tm.Episode,
+		&tm.Flagged,
+		&tm.FlagReason,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &tm, nil
+}
+
+// GetTorrentInfo returns the raw bencoded info dictionary of a torrent, or nil if it was not
+// stored.
+func (db *postgresDatabase) GetTorrentInfo(ctx context.Context, infoHash []byte) ([]byte, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetTorrentInfo", time.Now())
+
+	var compressedInfo []byte
+	err := db.pool.QueryRowContext(ctx, `
+		SELECT info
+		FROM torrent_infos, torrents
+		WHERE torrent_infos.torrent_id = torrents.id AND torrents.info_hash = $1 AND NOT torrents.hidden;`,
+		infoHash,
+	).Scan(&compressedInfo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decompress(compressedInfo)
+}
+
+func (db *postgresDatabase) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetFiles", time.Now())
+
+	return db.queryFiles(ctx,
+		"SELECT size, path, attr FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = $1 ORDER BY files.id;",
+		infoHash)
+}
+
+// GetUnclassifiedTorrents returns at most limit torrents that have not been classified yet, along
+// with their files.
+func (db *postgresDatabase) GetUnclassifiedTorrents(ctx context.Context, limit int) ([]TorrentFiles, error) {
+	return db.getTorrentFiles(ctx, `
+		SELECT id, info_hash, name FROM torrents WHERE category = '' ORDER BY id LIMIT $1;
+	`, limit)
+}
+
+// GetTorrentsAfter returns at most limit torrents whose ID is greater than afterID, in the order of
+// their IDs, along with their files.
+func (db *postgresDatabase) GetTorrentsAfter(ctx context.Context, afterID uint64, limit int) ([]TorrentFiles, error) {
+	return db.getTorrentFiles(ctx, `
+		SELECT id, info_hash, name FROM torrents WHERE id > $1 ORDER BY id LIMIT $2;
+	`, int64(afterID), limit)
+}
+
+func (db *postgresDatabase) getTorrentFiles(ctx context.Context, query string, args ...any) ([]TorrentFiles, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := db.pool.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var torrents []TorrentFiles
+	for rows.Next() {
+		var torrent TorrentFiles
+		if err = rows.Scan(&torrent.ID, &torrent.InfoHash, &torrent.Name); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, torrent)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range torrents {
+		torrents[i].Files, err = db.queryFiles(ctx,
+			"SELECT size, path, attr FROM files WHERE torrent_id = $1 ORDER BY id;", int64(torrents[i].ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return torrents, nil
+}
+
+func (db *postgresDatabase) queryFiles(ctx context.Context, query string, args ...any) ([]File, error) {
+	rows, err := db.pool.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var files []File
+	for rows.Next() {
+		var file File
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attr); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// SetContentDetails stores the content details of the given torrents, in a single transaction.
+func (db *postgresDatabase) SetContentDetails(ctx context.Context, torrents []ClassifiedTorrent) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, torrent := range torrents {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE torrents
+			SET category = $1, resolution = $2, codec = $3, season = $4, episode = $5
+			WHERE id = $6;
+		`, torrent.Category, torrent.Resolution, torrent.Codec, torrent.Season, torrent.Episode, int64(torrent.ID))
+		if err != nil {
+			return fmt.Errorf("tx.Exec (UPDATE torrents) %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+// DeleteTorrents deletes the torrents of the given IDs in a single statement. Their files and info
+// dictionaries are deleted along with them by ON DELETE CASCADE.
+func (db *postgresDatabase) DeleteTorrents(ctx context.Context, ids []uint64) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	signedIDs := make([]int64, len(ids))
+	for i, id := range ids {
+		signedIDs[i] = int64(id)
+	}
+
+	_, err := db.pool.ExecContext(ctx, "DELETE FROM torrents WHERE id = ANY($1);", signedIDs)
+	if err != nil {
+		return fmt.Errorf("sql.DB.Exec (DELETE FROM torrents) %w", err)
+	}
+	return nil
+}
+
+// DeleteTorrent deletes the torrent of the given info hash on behalf of actor, and reports whether
+// it existed.
+func (db *postgresDatabase) DeleteTorrent(ctx context.Context, infoHash []byte, actor string) (bool, error) {
+	existed, err := db.moderate(ctx, infoHash, actor, ActionDelete, "", "DELETE FROM torrents WHERE info_hash = $1;", infoHash)
+	if existed && db.filter != nil {
+		db.filter.markDeleted(infoHash)
+	}
+	return existed, err
+}
+
+// IsTorrentDeleted reports whether the torrent of the given info hash was deleted by DeleteTorrent:
+// according to the info hash filter if it is loaded, which holds every deleted info hash, and to the
+// audit log otherwise.
+func (db *postgresDatabase) IsTorrentDeleted(ctx context.Context, infoHash []byte) (bool, error) {
+	if db.filter != nil {
+		return db.filter.isDeleted(infoHash), nil
+	}
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("IsTorrentDeleted", time.Now())
+
+	// The condition on action must be spelled out for audit_log_deleted_index to apply.
+	rows, err := db.pool.QueryContext(ctx,
+		"SELECT 1 FROM audit_log WHERE info_hash = $1 AND action = 'delete' LIMIT 1;", infoHash)
+	if err != nil {
+		return false, err
+	}
+	defer closeRows(rows)
+
+	deleted := rows.Next()
+	return deleted, rows.Err()
+}
+
+// SetTorrentHidden hides or unhides the torrent of the given info hash on behalf of actor, and
+// reports whether it exists.
+func (db *postgresDatabase) SetTorrentHidden(ctx context.Context, infoHash []byte, hidden bool, actor string) (bool, error) {
+	action := ActionHide
+	if !hidden {
+		action = ActionUnhide
+	}
+	return db.moderate(ctx, infoHash, actor, action, "",
+		"UPDATE torrents SET hidden = $1 WHERE info_hash = $2;", hidden, infoHash)
+}
+
+// SetTorrentFlagged flags the torrent of the given info hash for the given reason, or unflags it,
+// on behalf of actor, and reports whether it exists.
+func (db *postgresDatabase) SetTorrentFlagged(ctx context.Context, infoHash []byte, flagged bool, reason string, actor string) (bool, error) {
+	action := ActionFlag
+	if !flagged {
+		action, reason = ActionUnflag, ""
+	}
+	return db.moderate(ctx, infoHash, actor, action, reason,
+		"UPDATE torrents SET flagged = $1, flag_reason = $2 WHERE info_hash = $3;", flagged, reason, infoHash)
+}
+
+// moderate runs a statement that affects the torrent of the given info hash, and records it in the
+// audit log if it did, in a single transaction.
+func (db *postgresDatabase) moderate(ctx context.Context, infoHash []byte, actor, action, reason string, query string, args ...any) (bool, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("conn.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, fmt.Errorf("tx.Exec (%s) %w", action, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sql.Result.RowsAffected %w", err)
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_log (actor, action, info_hash, reason, created_at) VALUES ($1, $2, $3, $4, $5);
+	`, actor, action, infoHash, reason, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("tx.Exec (INSERT INTO audit_log) %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return true, nil
+}
+
+// GetAuditLog returns the most recent limit entries of the audit log, most recent first.
+func (db *postgresDatabase) GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := db.pool.QueryContext(ctx, `
+		SELECT id, actor, action, info_hash, reason, created_at
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT $1;
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.InfoHash, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// GetFailedInfoHashes returns the limit most recent info hashes recorded by SaveFailedInfoHashes,
+// most recent first.
+func (db *postgresDatabase) GetFailedInfoHashes(ctx context.Context, limit int) ([]FailedInfoHash, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := db.pool.QueryContext(ctx, `
+		SELECT info_hash, failures, last_error, last_failed_at, retry_after
+		FROM failed_info_hashes
+		ORDER BY last_failed_at DESC, info_hash
+		LIMIT $1;
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var failures []FailedInfoHash
+	for rows.Next() {
+		var failure FailedInfoHash
+		err = rows.Scan(
+			&failure.InfoHash,
+			&failure.Failures,
+			&failure.LastError,
+			&failure.LastFailedAt,
+			&failure.RetryAfter,
+		)
+		if err != nil {
+			return nil, err
+		}
+		failures = append(failures, failure)
+	}
+
+	return failures, rows.Err()
+}
+
+// SaveFailedInfoHashes inserts or replaces the failure records of info hashes, in a single
+// transaction.
+func (db *postgresDatabase) SaveFailedInfoHashes(ctx context.Context, failures []FailedInfoHash) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, failure := range failures {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO failed_info_hashes (
+				info_hash,
+				failures,
+				last_error,
+				last_failed_at,
+				retry_after
+			) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (info_hash) DO UPDATE SET
+				failures = excluded.failures,
+				last_error = excluded.last_error,
+				last_failed_at = excluded.last_failed_at,
+				retry_after = excluded.retry_after;
+		`, failure.InfoHash, failure.Failures, failure.LastError, failure.LastFailedAt, failure.RetryAfter)
+		if err != nil {
+			return fmt.Errorf("tx.Exec (INSERT INTO failed_info_hashes) %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFailedInfoHashes deletes the failure records of info hashes.
+func (db *postgresDatabase) DeleteFailedInfoHashes(ctx context.Context, infoHashes [][]byte) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := db.pool.ExecContext(ctx, "DELETE FROM failed_info_hashes WHERE info_hash = ANY($1);", infoHashes)
+	if err != nil {
+		return fmt.Errorf("sql.DB.Exec (DELETE FROM failed_info_hashes) %w", err)
+	}
+	return nil
+}
+
+// DeleteFailedInfoHashesBefore deletes the failure records whose retry time is before retryAfter.
+func (db *postgresDatabase) DeleteFailedInfoHashesBefore(ctx context.Context, retryAfter int64) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := db.pool.ExecContext(ctx, "DELETE FROM failed_info_hashes WHERE retry_after < $1;", retryAfter)
+	return err
+}
+
+// TrimFailedInfoHashes deletes every failure record but the keep most recent ones.
+func (db *postgresDatabase) TrimFailedInfoHashes(ctx context.Context, keep int) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := db.pool.ExecContext(ctx, `
+		DELETE FROM failed_info_hashes
+		WHERE info_hash NOT IN (
+			SELECT info_hash
+			FROM failed_info_hashes
+			ORDER BY last_failed_at DESC, info_hash
+			LIMIT $1
+		);
+	`, keep)
+	return err
+}
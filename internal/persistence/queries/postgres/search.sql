@@ -0,0 +1,31 @@
+SELECT id
+    , info_hash
+    , info_hash_v2
+    , name
+    , total_size
+    , created_at
+    , updated_at
+    , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files
+    , idx.rank
+    , category
+    , resolution
+    , codec
+    , season
+    , episode
+
+FROM phraseto_tsquery('simple', search_words($1)) AS query
+-- Torrents match by their name or the path of any of their files, each looked up in its own index.
+CROSS JOIN LATERAL (
+    SELECT id FROM torrents WHERE name_tsv @@ query
+    UNION
+    SELECT torrent_id FROM files WHERE path_tsv @@ query
+) AS matches
+INNER JOIN torrents USING (id)
+-- ts_rank is higher for better matches, unlike bm25 on SQLite, hence its negation. Torrents that
+-- match by their files only rank last.
+CROSS JOIN LATERAL (SELECT -ts_rank(torrents.name_tsv, query) AS rank) AS idx
+WHERE NOT hidden AND ($2 = '' OR category = $2)
+
+ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
+
+LIMIT $3 OFFSET $4;
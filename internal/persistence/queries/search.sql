@@ -1,11 +1,17 @@
 SELECT id 
     , info_hash
+    , info_hash_v2
     , name
     , total_size
     , created_at
     , updated_at
     , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files
     , idx.rank
+    , category
+    , resolution
+    , codec
+    , season
+    , episode
 
 FROM torrents
 
@@ -15,6 +21,10 @@ INNER JOIN (
     FROM torrents_idx
     WHERE torrents_idx MATCH ?
 ) AS idx USING(id)
+WHERE NOT hidden
+{{ if .Category }}
+    AND category = ?
+{{ end }}
 
 ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
 
@@ -2,18 +2,22 @@ package persistence
 
 import (
 	"bytes"
+	"compress/zlib"
 	"context"
 	"database/sql"
 	"embed" // Required to use embed.FS
 	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"io"
 	"strings"
 	"text/template"
 	"time"
 
 	_ "modernc.org/sqlite" // Required to use sqlite3
+
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/metrics"
+	"github.com/t-richards/magnetico/internal/stats"
 )
 
 //go:embed queries/search.sql
@@ -22,40 +26,123 @@ var searchQuery string
 //go:embed migrations/*.sql
 var migrations embed.FS
 
+var logger = logging.For(logging.Persistence)
+
+// sqliteDialect records the migrations applied in user_version too, as magnetico used to do alone,
+// so that older versions know which are.
+var sqliteDialect = dialect{
+	migrations: migrations,
+	dir:        "migrations",
+
+	createTable: `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		);
+	`,
+	insertMigration: "INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?);",
+	deleteMigration: "DELETE FROM schema_migrations WHERE version = ?;",
+
+	legacyVersion: func(ctx context.Context, tx *sql.Tx) (int, error) {
+		// NOTE: The user_version starts at 0, so our first migration MUST start at 1.
+		var userVersion int
+		if err := tx.QueryRowContext(ctx, "PRAGMA user_version;").Scan(&userVersion); err != nil {
+			return 0, fmt.Errorf("sql.Tx.QueryRow (user_version) %w", err)
+		}
+		return userVersion, nil
+	},
+	setVersion: func(ctx context.Context, tx *sql.Tx, version int) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d;", version))
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (PRAGMA user_version) %w", err)
+		}
+		return nil
+	},
+}
+
 const (
 	// The maximum number of torrents to return in a single page.
 	MaxResults = 15
 )
 
-type Database struct {
-	conn *sql.DB
+// sqlite3Database is the SQLite implementation of Database.
+type sqlite3Database struct {
+	// writer is the only connection that writes, as SQLite would have the others wait for it
+	// anyway; reader is a pool of read-only connections, which in WAL mode neither block it nor
+	// are blocked by it.
+	writer *sql.DB
+	reader *sql.DB
+	opts   Options
+	// filter, if loaded with LoadInfoHashFilter, rules out most of the info hashes that
+	// DoesTorrentExist is asked about.
+	filter *infoHashFilter
+	// migrator migrates the database over the writer.
+	migrator
 }
 
-func NewSqlite3Database(filename string) (*Database, error) {
-	db := new(Database)
+// NewSqlite3Database opens the SQLite database at filename, creating it if need be, and migrates it
+// to the latest version of the schema.
+func NewSqlite3Database(filename string, opts Options) (Database, error) {
+	return newSqlite3Database(filename, opts)
+}
+
+func newSqlite3Database(filename string, opts Options) (*sqlite3Database, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	db := new(sqlite3Database)
+	db.opts = opts
 
 	var err error
-	db.conn, err = sql.Open("sqlite", filename)
+	db.writer, err = sql.Open("sqlite", opts.dsn(filename, true))
 	if err != nil {
-		return nil, errors.New("sql.Open " + err.Error())
+		return nil, fmt.Errorf("sql.Open %w", err)
 	}
+	db.writer.SetMaxOpenConns(1)
+	db.migrator = migrator{db.writer, sqliteDialect}
 
 	// > Open may just validate its arguments without creating a connection to the database. To
 	// > verify that the data source Name is valid, call Ping.
 	// https://golang.org/pkg/database/sql/#Open
-	if err = db.conn.Ping(); err != nil {
-		return nil, errors.New("sql.DB.Ping " + err.Error())
+	if err = db.writer.Ping(); err != nil {
+		db.writer.Close()
+		return nil, fmt.Errorf("sql.DB.Ping %w", err)
 	}
 
 	if err := db.setupDatabase(); err != nil {
-		return nil, errors.New("setupDatabase " + err.Error())
+		db.writer.Close()
+		return nil, fmt.Errorf("setupDatabase %w", err)
+	}
+
+	// The read-only connections can only be opened once the database exists.
+	db.reader, err = sql.Open("sqlite", opts.dsn(filename, false))
+	if err != nil {
+		db.writer.Close()
+		return nil, fmt.Errorf("sql.Open (read-only) %w", err)
+	}
+	db.reader.SetMaxOpenConns(opts.ReadConnections)
+	db.reader.SetMaxIdleConns(opts.ReadConnections)
+
+	if err = db.reader.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql.DB.Ping (read-only) %w", err)
 	}
 
 	return db, nil
 }
 
-func (db *Database) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = ?;", infoHash)
+func (db *sqlite3Database) DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error) {
+	if db.filter != nil && !db.filter.mayContain(infoHash) {
+		return false, nil
+	}
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("DoesTorrentExist", time.Now())
+
+	rows, err := db.reader.QueryContext(ctx, "SELECT 1 FROM torrents WHERE info_hash = ?1 OR substr(info_hash_v2, 1, 20) = ?1;", infoHash)
 	if err != nil {
 		return false, err
 	}
@@ -63,17 +150,34 @@ func (db *Database) DoesTorrentExist(infoHash []byte) (bool, error) {
 
 	// When we receive a single result row, it means the torrent is in the database.
 	exists := rows.Next()
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		return false, err
 	}
+	if db.filter != nil && !exists {
+		metrics.DBFilterFalsePositives.Inc()
+	}
 
 	return exists, nil
 }
 
-func (db *Database) AddNewTorrent(infoHash []byte, name string, files []File) error {
-	tx, err := db.conn.Begin()
+// AddNewTorrent inserts a torrent along with its files and, if available, its raw bencoded info
+// dictionary.
+func (db *sqlite3Database) AddNewTorrent(ctx context.Context, torrent NewTorrent) error {
+	_, err := db.AddNewTorrents(ctx, []NewTorrent{torrent})
+	return err
+}
+
+// AddNewTorrents inserts torrents as AddNewTorrent does, all in a single transaction, and returns
+// how many of them it inserted: torrents that exist already, and those that contain only empty
+// files, are skipped. Either all of the torrents are inserted or, if an error occurs, none are.
+func (db *sqlite3Database) AddNewTorrents(ctx context.Context, torrents []NewTorrent) (int, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+	defer metrics.ObserveDBQuery("AddNewTorrents", time.Now())
+
+	tx, err := db.writer.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.New("conn.Begin " + err.Error())
+		return 0, fmt.Errorf("conn.Begin %w", err)
 	}
 	// If everything goes as planned and no error occurs, we will commit the transaction before
 	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
@@ -81,25 +185,13 @@ func (db *Database) AddNewTorrent(infoHash []byte, name string, files []File) er
 	// is nice.
 	defer tx.Rollback() //nolint:errcheck
 
-	var totalSize uint64 = 0
-	for _, file := range files {
-		totalSize += uint64(file.Size)
-	}
-
-	// We do not accept torrents that contain only empty files.
-	if totalSize == 0 {
-		return nil
-	}
-
 	// Although we check whether the torrent exists in the database before asking MetadataSink to
-	// fetch its metadata, the torrent can also exists in the Sink before that:
-	//
-	// If the torrent is complete (i.e. its metadata) and if its waiting in the channel to be
-	// received, a race condition arises when we query the database and seeing that it doesn't
-	// exists there, add it to the sink.
+	// fetch its metadata, the torrent can also exist in the Sink before that (or twice in the same
+	// batch): if its metadata is waiting to be written, a race condition arises when we query the
+	// database, see that it does not exist there, and add it to the sink again.
 	//
-	// Do NOT try to be clever and attempt to use INSERT OR IGNORE INTO or INSERT OR REPLACE INTO
-	// without understanding their consequences fully:
+	// Do NOT try to be clever and replace ON CONFLICT (info_hash) DO NOTHING with INSERT OR IGNORE
+	// INTO or INSERT OR REPLACE INTO without understanding their consequences fully:
 	//
 	// https://www.sqlite.org/lang_conflict.html
 	//
@@ -124,66 +216,174 @@ func (db *Database) AddNewTorrent(infoHash []byte, name string, files []File) er
 	//     INSERT OR REPLACE INTO is definitely much closer to what you may want, but deleting
 	//     pre-existing rows means that you might cause users loose data (such as seeder and leecher
 	//     information, readme, and so on) at the expense of /your/ own laziness...
-	if exist, err := db.DoesTorrentExist(infoHash); exist || err != nil {
-		return err
-	}
-
-	now := time.Now().Unix()
-	res, err := tx.Exec(`
+	//
+	// Whereas ON CONFLICT (info_hash) DO NOTHING skips the torrents whose info hash exists, and
+	// only those, within the transaction.
+	insertTorrent, err := tx.PrepareContext(ctx, `
 		INSERT INTO torrents (
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
+			piece_length,
+			piece_count,
+			private,
+			source,
+			category,
+			resolution,
+			codec,
+			season,
+			episode,
 			created_at,
 			updated_at
-		) VALUES (?, ?, ?, ?, ?);
-	`, infoHash, name, totalSize, now, now)
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (info_hash) DO NOTHING;
+	`)
 	if err != nil {
-		return errors.New("tx.Exec (INSERT INTO torrents) " + err.Error())
+		return 0, fmt.Errorf("tx.Prepare (INSERT INTO torrents) %w", err)
 	}
+	defer insertTorrent.Close()
 
-	var lastInsertID int64
-	if lastInsertID, err = res.LastInsertId(); err != nil {
-		return errors.New("sql.Result.LastInsertId " + err.Error())
+	insertFile, err := tx.PrepareContext(ctx, "INSERT INTO files (torrent_id, size, path, attr) VALUES (?, ?, ?, ?);")
+	if err != nil {
+		return 0, fmt.Errorf("tx.Prepare (INSERT INTO files) %w", err)
 	}
+	defer insertFile.Close()
 
-	// > last_insert_rowid()
-	// >   The last_insert_rowid() function returns the ROWID of the last row insert from the
-	// >   database connection which invoked the function. If no successful INSERTs into rowid
-	// >   tables have ever occurred on the database connection, then last_insert_rowid() returns
-	// >   zero.
-	// https://www.sqlite.org/lang_corefunc.html#last_insert_rowid
-	// https://www.sqlite.org/c3ref/last_insert_rowid.html
-	//
-	// Now, last_insert_rowid() should never return zero (or any negative values really) as we
-	// insert into torrents and handle any errors accordingly right afterwards.
-	if lastInsertID <= 0 {
-		log.Panicf("last_insert_rowid() <= 0 (this should have never happened!). lastInsertId: %d", lastInsertID)
+	insertInfo, err := tx.PrepareContext(ctx, "INSERT INTO torrent_infos (torrent_id, info) VALUES (?, ?);")
+	if err != nil {
+		return 0, fmt.Errorf("tx.Prepare (INSERT INTO torrent_infos) %w", err)
 	}
+	defer insertInfo.Close()
+
+	now := time.Now().Unix()
+	var inserted, hybrids [][]byte // the info hashes and truncated v2 info hashes of the torrents inserted
+	for _, torrent := range torrents {
+		var totalSize uint64 = 0
+		for _, file := range torrent.Files {
+			totalSize += uint64(file.Size)
+		}
+
+		// We do not accept torrents that contain only empty files.
+		if totalSize == 0 {
+			continue
+		}
 
-	for _, file := range files {
-		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path) VALUES (?, ?, ?);",
-			lastInsertID, file.Size, file.Path,
+		res, err := insertTorrent.ExecContext(ctx,
+			torrent.InfoHash,
+			torrent.InfoHashV2,
+			torrent.Name,
+			totalSize,
+			torrent.PieceLength,
+			torrent.PieceCount,
+			torrent.Private,
+			torrent.Source,
+			torrent.Category,
+			torrent.Resolution,
+			torrent.Codec,
+			torrent.Season,
+			torrent.Episode,
+			now,
+			now,
 		)
 		if err != nil {
-			return errors.New("tx.Exec (INSERT INTO files) " + err.Error())
+			return 0, fmt.Errorf("tx.Exec (INSERT INTO torrents) %w", err)
+		}
+
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("sql.Result.RowsAffected %w", err)
+		} else if rowsAffected == 0 {
+			continue // the torrent exists
+		}
+
+		var lastInsertID int64
+		if lastInsertID, err = res.LastInsertId(); err != nil {
+			return 0, fmt.Errorf("sql.Result.LastInsertId %w", err)
+		}
+
+		// > last_insert_rowid()
+		// >   The last_insert_rowid() function returns the ROWID of the last row insert from the
+		// >   database connection which invoked the function. If no successful INSERTs into rowid
+		// >   tables have ever occurred on the database connection, then last_insert_rowid()
+		// >   returns zero.
+		// https://www.sqlite.org/lang_corefunc.html#last_insert_rowid
+		// https://www.sqlite.org/c3ref/last_insert_rowid.html
+		//
+		// Now, last_insert_rowid() should never return zero (or any negative values really) as we
+		// insert into torrents and handle any errors accordingly right afterwards.
+		if lastInsertID <= 0 {
+			panic(fmt.Sprintf("last_insert_rowid() <= 0 (this should have never happened!). lastInsertId: %d", lastInsertID))
+		}
+
+		for _, file := range torrent.Files {
+			if _, err = insertFile.ExecContext(ctx, lastInsertID, file.Size, file.Path, file.Attr); err != nil {
+				return 0, fmt.Errorf("tx.Exec (INSERT INTO files) %w", err)
+			}
+		}
+
+		if torrent.Info != nil {
+			compressedInfo, err := compress(torrent.Info)
+			if err != nil {
+				return 0, fmt.Errorf("compress %w", err)
+			}
+
+			if _, err = insertInfo.ExecContext(ctx, lastInsertID, compressedInfo); err != nil {
+				return 0, fmt.Errorf("tx.Exec (INSERT INTO torrent_infos) %w", err)
+			}
+		}
+
+		inserted = append(inserted, torrent.InfoHash)
+		if truncated := truncatedInfoHashV2(torrent.InfoHash, torrent.InfoHashV2); truncated != nil {
+			hybrids = append(hybrids, truncated)
 		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return errors.New("tx.Commit " + err.Error())
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("tx.Commit %w", err)
+	}
+	metrics.TorrentsInserted.Add(float64(len(inserted)))
+	for range inserted {
+		stats.Default.RecordDiscovery()
 	}
 
-	return nil
+	if db.filter != nil && db.filter.add(append(hybrids, inserted...)) {
+		db.filter.rebuild(db.reader)
+	}
+
+	return len(inserted), nil
+}
+
+func (db *sqlite3Database) Close() error {
+	if db.filter != nil {
+		db.filter.rebuilds.Wait()
+	}
+	if db.reader != nil {
+		if err := db.reader.Close(); err != nil {
+			db.writer.Close()
+			return err
+		}
+	}
+	return db.writer.Close()
 }
 
-func (db *Database) Close() error {
-	return db.conn.Close()
+// GetDatabaseSize returns the size of the database, in bytes.
+func (db *sqlite3Database) GetDatabaseSize(ctx context.Context) (int64, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var size int64
+	err := db.reader.QueryRowContext(ctx, `
+		SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size();
+	`).Scan(&size)
+	return size, err
 }
 
 // Returns an approximate number of torrents in the database.
-func (db *Database) GetNumberOfTorrents(ctx context.Context) (int, error) {
+func (db *sqlite3Database) GetNumberOfTorrents(ctx context.Context) (int, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetNumberOfTorrents", time.Now())
+
 	var n int
 
 	// Note that SELECT COUNT(1) is less efficient than asking for the maximum ROWID:
@@ -193,13 +393,17 @@ func (db *Database) GetNumberOfTorrents(ctx context.Context) (int, error) {
 	// sqlite> EXPLAIN QUERY PLAN SELECT MAX(ROWID) FROM torrents;
 	// `--SEARCH torrents
 	//
-	err := db.conn.QueryRowContext(ctx, "SELECT MAX(ROWID) FROM torrents;").Scan(&n)
+	// Hidden torrents are few and counted using a partial index.
+	err := db.reader.QueryRowContext(ctx, `
+		SELECT IFNULL(MAX(ROWID), 0) - (SELECT COUNT(1) FROM torrents WHERE hidden) FROM torrents;
+	`).Scan(&n)
 	return n, err
 }
 
 type searchPlaceholders struct {
 	OrderOn   string
 	Ascending bool
+	Category  bool // whether results are restricted to a category
 }
 
 var searchFuncs = template.FuncMap{
@@ -219,38 +423,61 @@ var searchFuncs = template.FuncMap{
 	},
 }
 
-func (db *Database) QueryTorrentsCount(
+// QueryTorrentsCount returns the number of torrents matching query, restricted to category unless
+// it is empty.
+func (db *sqlite3Database) QueryTorrentsCount(
 	ctx context.Context,
 	query string,
+	category string,
 ) (int, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opSearch)
+	defer cancel()
+	defer metrics.ObserveDBQuery("QueryTorrentsCount", time.Now())
+
 	var count int
 	query = wrapFtsQuery(query)
-	err := db.conn.QueryRowContext(ctx, `
+	err := db.reader.QueryRowContext(ctx, `
 		SELECT COUNT(1)
 		FROM torrents_idx
-		WHERE torrents_idx MATCH ?;
-	`, query).Scan(&count)
+		INNER JOIN torrents ON torrents.id = torrents_idx.rowid
+		WHERE torrents_idx MATCH ? AND NOT torrents.hidden AND (? = '' OR torrents.category = ?);
+	`, query, category, category).Scan(&count)
 
 	return count, err
 }
 
-func (db *Database) QueryTorrents(
+// QueryTorrents returns a page of the torrents matching query, restricted to category unless it is
+// empty.
+func (db *sqlite3Database) QueryTorrents(
+	ctx context.Context,
 	query string,
+	category string,
 	orderBy OrderingCriteria,
 	ascending bool,
 	offset int,
 ) ([]TorrentMetadata, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opSearch)
+	defer cancel()
+	defer metrics.ObserveDBQuery("QueryTorrents", time.Now())
+
 	// Prepare query
 	searchParams := searchPlaceholders{
 		OrderOn:   orderOn(orderBy),
 		Ascending: ascending,
+		Category:  category != "",
 	}
 	sqlQuery := executeTemplate(searchQuery, searchParams, searchFuncs)
 
+	args := []any{wrapFtsQuery(query)}
+	if category != "" {
+		args = append(args, category)
+	}
+	args = append(args, MaxResults, offset)
+
 	// Run query
-	rows, err := db.conn.Query(sqlQuery, wrapFtsQuery(query), MaxResults, offset)
+	rows, err := db.reader.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
-		return nil, errors.New("query error " + err.Error())
+		return nil, fmt.Errorf("query error %w", err)
 	}
 	defer closeRows(rows)
 
@@ -260,12 +487,18 @@ func (db *Database) QueryTorrents(
 		err = rows.Scan(
 			&torrent.ID,
 			&torrent.InfoHash,
+			&torrent.InfoHashV2,
 			&torrent.Name,
 			&torrent.Size,
 			&torrent.CreatedAt,
 			&torrent.UpdatedAt,
 			&torrent.NFiles,
 			&torrent.Relevance,
+			&torrent.Category,
+			&torrent.Resolution,
+			&torrent.Codec,
+			&torrent.Season,
+			&torrent.Episode,
 		)
 		if err != nil {
 			return nil, err
@@ -273,7 +506,7 @@ func (db *Database) QueryTorrents(
 		torrents = append(torrents, torrent)
 	}
 
-	return torrents, nil
+	return torrents, rows.Err()
 }
 
 func orderOn(orderBy OrderingCriteria) string {
@@ -298,17 +531,34 @@ func orderOn(orderBy OrderingCriteria) string {
 	}
 }
 
-func (db *Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
-	rows, err := db.conn.Query(`
+func (db *sqlite3Database) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetTorrent", time.Now())
+
+	rows, err := db.reader.QueryContext(ctx, `
 		SELECT
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			created_at,
 			updated_at,
-			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files
+			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files,
+			EXISTS(SELECT 1 FROM torrent_infos WHERE torrent_id = torrents.id) AS has_info,
+			piece_length,
+			piece_count,
+			private,
+			source,
+			category,
+			resolution,
+			codec,
+			season,
+			episode,
+			flagged,
+			flag_reason
 		FROM torrents
-		WHERE info_hash = ?`,
+		WHERE info_hash = ? AND NOT hidden`,
 		infoHash,
 	)
 	if err != nil {
@@ -322,16 +572,64 @@ func (db *Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.CreatedAt, &tm.UpdatedAt, &tm.NFiles); err != nil {
+	err = rows.Scan(
+		&tm.InfoHash,
+		&tm.InfoHashV2,
+		&tm.Name,
+		&tm.Size,
+		&tm.CreatedAt,
+		&tm.UpdatedAt,
+		&tm.NFiles,
+		&tm.HasInfo,
+		&tm.PieceLength,
+		&tm.PieceCount,
+		&tm.Private,
+		&tm.Source,
+		&tm.Category,
+		&tm.Resolution,
+		&tm.Codec,
+		&tm.Season,
+		&tm.Episode,
+		&tm.Flagged,
+		&tm.FlagReason,
+	)
+	if err != nil {
 		return nil, err
 	}
 
 	return &tm, nil
 }
 
-func (db *Database) GetFiles(infoHash []byte) ([]File, error) {
-	rows, err := db.conn.Query(
-		"SELECT size, path FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = ?;",
+// GetTorrentInfo returns the raw bencoded info dictionary of a torrent, or nil if it was not
+// stored.
+func (db *sqlite3Database) GetTorrentInfo(ctx context.Context, infoHash []byte) ([]byte, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetTorrentInfo", time.Now())
+
+	var compressedInfo []byte
+	err := db.reader.QueryRowContext(ctx, `
+		SELECT info
+		FROM torrent_infos, torrents
+		WHERE torrent_infos.torrent_id = torrents.id AND torrents.info_hash = ? AND NOT torrents.hidden;`,
+		infoHash,
+	).Scan(&compressedInfo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decompress(compressedInfo)
+}
+
+func (db *sqlite3Database) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("GetFiles", time.Now())
+
+	rows, err := db.reader.QueryContext(ctx,
+		"SELECT size, path, attr FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = ?;",
 		infoHash)
 	if err != nil {
 		return nil, err
@@ -341,7 +639,7 @@ func (db *Database) GetFiles(infoHash []byte) ([]File, error) {
 	var files []File
 	for rows.Next() {
 		var file File
-		if err = rows.Scan(&file.Size, &file.Path); err != nil {
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attr); err != nil {
 			return nil, err
 		}
 		files = append(files, file)
@@ -350,101 +648,403 @@ func (db *Database) GetFiles(infoHash []byte) ([]File, error) {
 	return files, nil
 }
 
-func (db *Database) setupDatabase() error {
-	// Enable Write-Ahead Logging for SQLite as "WAL provides more concurrency as readers do not
-	// block writers and a writer does not block readers. Reading and writing can proceed
-	// concurrently."
-	// Caveats:
-	//   * Might be unsupported by OSes other than Windows and UNIXes.
-	//   * Does not work over a network filesystem.
-	//   * Transactions that involve changes against multiple ATTACHed databases are not atomic
-	//     across all databases as a set.
-	// See: https://www.sqlite.org/wal.html
-	//
-	// Force SQLite to use disk, instead of memory, for all temporary files to reduce the memory
-	// footprint.
-	//
-	// Enable foreign key constraints in SQLite which are crucial to prevent programmer errors on
-	// our side.
-	_, err := db.conn.Exec(`
-		PRAGMA journal_mode=WAL;
-		PRAGMA temp_store=1;
-		PRAGMA foreign_keys=ON;
-		PRAGMA encoding='UTF-8';
-	`)
+// GetUnclassifiedTorrents returns at most limit torrents that have not been classified yet, along
+// with their files.
+func (db *sqlite3Database) GetUnclassifiedTorrents(ctx context.Context, limit int) ([]TorrentFiles, error) {
+	return db.getTorrentFiles(ctx, `
+		SELECT id, info_hash, name FROM torrents WHERE category = '' LIMIT ?;
+	`, limit)
+}
+
+// GetTorrentsAfter returns at most limit torrents whose ID is greater than afterID, in the order of
+// their IDs, along with their files.
+func (db *sqlite3Database) GetTorrentsAfter(ctx context.Context, afterID uint64, limit int) ([]TorrentFiles, error) {
+	return db.getTorrentFiles(ctx, `
+		SELECT id, info_hash, name FROM torrents WHERE id > ? ORDER BY id LIMIT ?;
+	`, afterID, limit)
+}
+
+func (db *sqlite3Database) getTorrentFiles(ctx context.Context, query string, args ...any) ([]TorrentFiles, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := db.reader.QueryContext(ctx, query, args...)
 	if err != nil {
-		return errors.New("sql.DB.Exec (PRAGMAs) " + err.Error())
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var torrents []TorrentFiles
+	for rows.Next() {
+		var torrent TorrentFiles
+		if err = rows.Scan(&torrent.ID, &torrent.InfoHash, &torrent.Name); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, torrent)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	tx, err := db.conn.Begin()
+	for i := range torrents {
+		torrents[i].Files, err = db.getFilesByID(ctx, torrents[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return torrents, nil
+}
+
+func (db *sqlite3Database) getFilesByID(ctx context.Context, torrentID uint64) ([]File, error) {
+	rows, err := db.reader.QueryContext(ctx, "SELECT size, path, attr FROM files WHERE torrent_id = ?;", torrentID)
 	if err != nil {
-		return errors.New("sql.DB.Begin " + err.Error())
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var files []File
+	for rows.Next() {
+		var file File
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attr); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// SetContentDetails stores the content details of the given torrents, in a single transaction.
+func (db *sqlite3Database) SetContentDetails(ctx context.Context, torrents []ClassifiedTorrent) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.Begin %w", err)
 	}
-	// If everything goes as planned and no error occurs, we will commit the transaction before
-	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
-	// committed transaction. BUT, if an error occurs, we'll get our transaction rollback'ed, which
-	// is nice.
 	defer tx.Rollback() //nolint:errcheck
 
-	// Get the user_version:
-	rows, err := tx.Query("PRAGMA user_version;")
+	for _, torrent := range torrents {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE torrents
+			SET category = ?, resolution = ?, codec = ?, season = ?, episode = ?
+			WHERE id = ?;
+		`, torrent.Category, torrent.Resolution, torrent.Codec, torrent.Season, torrent.Episode, torrent.ID)
+		if err != nil {
+			return fmt.Errorf("tx.Exec (UPDATE torrents) %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+// DeleteTorrents deletes the torrents of the given IDs in a single transaction. Their files and
+// info dictionaries are deleted along with them by ON DELETE CASCADE, and their search index
+// entries by a trigger.
+func (db *sqlite3Database) DeleteTorrents(ctx context.Context, ids []uint64) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.writer.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.New("sql.Tx.Query (user_version) " + err.Error())
+		return fmt.Errorf("conn.Begin %w", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback() //nolint:errcheck
 
-	// NOTE: The user_version starts at 0, so our first migration MUST start at 1 to be applied.
-	var userVersion int
-	if !rows.Next() {
-		return fmt.Errorf("sql.Rows.Next (user_version): PRAGMA user_version did not return any rows")
+	for _, id := range ids {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM torrents WHERE id = ?;", id); err != nil {
+			return fmt.Errorf("tx.Exec (DELETE FROM torrents) %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+// DeleteTorrent deletes the torrent of the given info hash on behalf of actor, and reports whether
+// it existed.
+func (db *sqlite3Database) DeleteTorrent(ctx context.Context, infoHash []byte, actor string) (bool, error) {
+	existed, err := db.moderate(ctx, infoHash, actor, ActionDelete, "", "DELETE FROM torrents WHERE info_hash = ?;", infoHash)
+	if existed && db.filter != nil {
+		db.filter.markDeleted(infoHash)
+	}
+	return existed, err
+}
+
+// IsTorrentDeleted reports whether the torrent of the given info hash was deleted by DeleteTorrent:
+// according to the info hash filter if it is loaded, which holds every deleted info hash, and to the
+// audit log otherwise.
+func (db *sqlite3Database) IsTorrentDeleted(ctx context.Context, infoHash []byte) (bool, error) {
+	if db.filter != nil {
+		return db.filter.isDeleted(infoHash), nil
+	}
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+	defer metrics.ObserveDBQuery("IsTorrentDeleted", time.Now())
+
+	// The condition on action must be spelled out for audit_log_deleted_index to apply.
+	rows, err := db.reader.QueryContext(ctx,
+		"SELECT 1 FROM audit_log WHERE info_hash = ? AND action = 'delete' LIMIT 1;", infoHash)
+	if err != nil {
+		return false, err
 	}
-	if err = rows.Scan(&userVersion); err != nil {
-		return errors.New("sql.Rows.Scan (user_version) " + err.Error())
+	defer closeRows(rows)
+
+	deleted := rows.Next()
+	return deleted, rows.Err()
+}
+
+// SetTorrentHidden hides or unhides the torrent of the given info hash on behalf of actor, and
+// reports whether it exists.
+func (db *sqlite3Database) SetTorrentHidden(ctx context.Context, infoHash []byte, hidden bool, actor string) (bool, error) {
+	action := ActionHide
+	if !hidden {
+		action = ActionUnhide
+	}
+	return db.moderate(ctx, infoHash, actor, action, "",
+		"UPDATE torrents SET hidden = ? WHERE info_hash = ?;", hidden, infoHash)
+}
+
+// SetTorrentFlagged flags the torrent of the given info hash for the given reason, or unflags it,
+// on behalf of actor, and reports whether it exists.
+func (db *sqlite3Database) SetTorrentFlagged(ctx context.Context, infoHash []byte, flagged bool, reason string, actor string) (bool, error) {
+	action := ActionFlag
+	if !flagged {
+		action, reason = ActionUnflag, ""
+	}
+	return db.moderate(ctx, infoHash, actor, action, reason,
+		"UPDATE torrents SET flagged = ?, flag_reason = ? WHERE info_hash = ?;", flagged, reason, infoHash)
+}
+
+// moderate runs a statement that affects the torrent of the given info hash, and records it in the
+// audit log if it did, in a single transaction.
+func (db *sqlite3Database) moderate(ctx context.Context, infoHash []byte, actor, action, reason string, query string, args ...any) (bool, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("conn.Begin %w", err)
 	}
+	defer tx.Rollback() //nolint:errcheck
 
-	// Given the user version, find all migrations greater than it and execute them.
-	entries, err := migrations.ReadDir("migrations")
+	res, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
-		return errors.New("migrations.ReadDir " + err.Error())
+		return false, fmt.Errorf("tx.Exec (%s) %w", action, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sql.Result.RowsAffected %w", err)
+	}
+	if affected == 0 {
+		return false, nil
 	}
 
-	// TODO(tom): Ensure migrations are sorted by version.
-	for _, migration := range entries {
-		migrateVerString := strings.Split(migration.Name(), "_")[0]
-		migrateVersion, err := strconv.ParseInt(migrateVerString, 10, 32)
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_log (actor, action, info_hash, reason, created_at) VALUES (?, ?, ?, ?, ?);
+	`, actor, action, infoHash, reason, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("tx.Exec (INSERT INTO audit_log) %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return true, nil
+}
+
+// GetAuditLog returns the most recent limit entries of the audit log, most recent first.
+func (db *sqlite3Database) GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := db.reader.QueryContext(ctx, `
+		SELECT id, actor, action, info_hash, reason, created_at
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT ?;
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.InfoHash, &entry.Reason, &entry.CreatedAt)
 		if err != nil {
-			return errors.New("strconv.ParseInt " + err.Error())
+			return nil, err
 		}
+		entries = append(entries, entry)
+	}
 
-		if int(migrateVersion) <= userVersion {
-			continue
-		}
+	return entries, rows.Err()
+}
 
-		log.Printf("Applying migration %s", migration.Name())
-		contents, err := migrations.ReadFile("migrations/" + migration.Name())
+// GetFailedInfoHashes returns the limit most recent info hashes recorded by SaveFailedInfoHashes,
+// most recent first.
+func (db *sqlite3Database) GetFailedInfoHashes(ctx context.Context, limit int) ([]FailedInfoHash, error) {
+	ctx, cancel := db.opts.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := db.reader.QueryContext(ctx, `
+		SELECT info_hash, failures, last_error, last_failed_at, retry_after
+		FROM failed_info_hashes
+		ORDER BY last_failed_at DESC, info_hash
+		LIMIT ?;
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var failures []FailedInfoHash
+	for rows.Next() {
+		var failure FailedInfoHash
+		err = rows.Scan(
+			&failure.InfoHash,
+			&failure.Failures,
+			&failure.LastError,
+			&failure.LastFailedAt,
+			&failure.RetryAfter,
+		)
 		if err != nil {
-			return errors.New("fs.ReadFile " + err.Error())
+			return nil, err
 		}
+		failures = append(failures, failure)
+	}
+
+	return failures, rows.Err()
+}
 
-		_, err = tx.Exec(string(contents))
+// SaveFailedInfoHashes inserts or replaces the failure records of info hashes, in a single
+// transaction.
+func (db *sqlite3Database) SaveFailedInfoHashes(ctx context.Context, failures []FailedInfoHash) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, failure := range failures {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO failed_info_hashes (
+				info_hash,
+				failures,
+				last_error,
+				last_failed_at,
+				retry_after
+			) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (info_hash) DO UPDATE SET
+				failures = excluded.failures,
+				last_error = excluded.last_error,
+				last_failed_at = excluded.last_failed_at,
+				retry_after = excluded.retry_after;
+		`, failure.InfoHash, failure.Failures, failure.LastError, failure.LastFailedAt, failure.RetryAfter)
 		if err != nil {
-			return errors.New("sql.Tx.Exec " + err.Error())
+			return fmt.Errorf("tx.Exec (INSERT INTO failed_info_hashes) %w", err)
 		}
+	}
 
-		// Update the user_version.
-		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", migrateVersion))
-		if err != nil {
-			return errors.New("sql.Tx.Exec (PRAGMA user_version) " + err.Error())
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFailedInfoHashes deletes the failure records of info hashes, in a single transaction.
+func (db *sqlite3Database) DeleteFailedInfoHashes(ctx context.Context, infoHashes [][]byte) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := db.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.Begin %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, infoHash := range infoHashes {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM failed_info_hashes WHERE info_hash = ?;", infoHash); err != nil {
+			return fmt.Errorf("tx.Exec (DELETE FROM failed_info_hashes) %w", err)
 		}
 	}
 
 	if err = tx.Commit(); err != nil {
-		return errors.New("sql.Tx.Commit " + err.Error())
+		return fmt.Errorf("tx.Commit %w", err)
 	}
 
 	return nil
 }
 
+// DeleteFailedInfoHashesBefore deletes the failure records whose retry time is before retryAfter.
+func (db *sqlite3Database) DeleteFailedInfoHashesBefore(ctx context.Context, retryAfter int64) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := db.writer.ExecContext(ctx, "DELETE FROM failed_info_hashes WHERE retry_after < ?;", retryAfter)
+	return err
+}
+
+// TrimFailedInfoHashes deletes every failure record but the keep most recent ones.
+func (db *sqlite3Database) TrimFailedInfoHashes(ctx context.Context, keep int) error {
+	ctx, cancel := db.opts.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := db.writer.ExecContext(ctx, `
+		DELETE FROM failed_info_hashes
+		WHERE info_hash NOT IN (
+			SELECT info_hash
+			FROM failed_info_hashes
+			ORDER BY last_failed_at DESC, info_hash
+			LIMIT ?
+		);
+	`, keep)
+	return err
+}
+
+func (db *sqlite3Database) setupDatabase() error {
+	// Enable Write-Ahead Logging for SQLite as "WAL provides more concurrency as readers do not
+	// block writers and a writer does not block readers. Reading and writing can proceed
+	// concurrently."
+	// Caveats:
+	//   * Might be unsupported by OSes other than Windows and UNIXes.
+	//   * Does not work over a network filesystem.
+	//   * Transactions that involve changes against multiple ATTACHed databases are not atomic
+	//     across all databases as a set.
+	// See: https://www.sqlite.org/wal.html
+	//
+	// Unlike the other PRAGMAs, which are in the DSN as they only apply to the connection they are
+	// run on, the journal mode and the encoding persist in the database file.
+	_, err := db.writer.Exec(`
+		PRAGMA journal_mode=WAL;
+		PRAGMA encoding='UTF-8';
+	`)
+	if err != nil {
+		return fmt.Errorf("sql.DB.Exec (PRAGMAs) %w", err)
+	}
+
+	if db.opts.SkipMigrations {
+		return nil
+	}
+	_, err = db.MigrateUp(context.Background(), false)
+	return err
+}
+
 func executeTemplate(text string, data any, funcs template.FuncMap) string {
 	t := template.Must(template.New("anon").Funcs(funcs).Parse(text))
 
@@ -456,9 +1056,34 @@ func executeTemplate(text string, data any, funcs template.FuncMap) string {
 	return buf.String()
 }
 
+// compress deflates raw info dictionaries, which are otherwise stored as-is.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
 func closeRows(rows *sql.Rows) {
 	if err := rows.Close(); err != nil {
-		log.Printf("could not close row %v", err)
+		logger.Warn("could not close rows", "err", err)
 	}
 }
 
@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func newTestDatabase(tb testing.TB) *sqlite3Database {
+	db, err := newSqlite3Database(filepath.Join(tb.TempDir(), "magnetico.db"), DefaultOptions)
+	if err != nil {
+		tb.Fatalf("could not open the database: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testTorrent returns a distinct torrent for every n, of a few files and a small info dictionary.
+func testTorrent(n int) NewTorrent {
+	seed := binary.BigEndian.AppendUint64(nil, uint64(n))
+	infoHash := sha1.Sum(seed)
+	torrent := NewTorrent{
+		InfoHash: infoHash[:],
+		Name:     fmt.Sprintf("Torrent %d", n),
+		Info:     append([]byte("d4:name"), seed...),
+	}
+	for i := 0; i < 5; i++ {
+		torrent.Files = append(torrent.Files, File{Size: 1 << 20, Path: fmt.Sprintf("file%d.mkv", i)})
+	}
+	return torrent
+}
+
+// The batch sizes of the benchmarks are the number of torrents per transaction; 1 is what calling
+// AddNewTorrent for every torrent amounts to.
+func BenchmarkAddNewTorrents(b *testing.B) {
+	for _, batchSize := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			db := newTestDatabase(b)
+			batch := make([]NewTorrent, 0, batchSize)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch = append(batch, testTorrent(i))
+				if len(batch) == batchSize || i == b.N-1 {
+					if _, err := db.AddNewTorrents(context.Background(), batch); err != nil {
+						b.Fatalf("could not add the torrents: %v", err)
+					}
+					batch = batch[:0]
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "torrents/s")
+		})
+	}
+}
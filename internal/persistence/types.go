@@ -14,15 +14,96 @@ const (
 type File struct {
 	Size int64  `json:"size"`
 	Path string `json:"path"`
+	Attr string `json:"attr"` // BEP 47 attributes, such as "x" for executable files
+}
+
+// TorrentDetails are the torrent-wide properties of the info dictionary, besides its name.
+type TorrentDetails struct {
+	PieceLength int64  `json:"pieceLength"`
+	PieceCount  int    `json:"pieceCount"`
+	Private     bool   `json:"private"` // BEP 27
+	Source      string `json:"source"`
+}
+
+// ContentDetails are the category of the contents of a torrent, and their attributes that could
+// be detected, as assigned by the classifier. Attributes that could not be detected are left zero.
+type ContentDetails struct {
+	Category   string `json:"category"` // empty if the torrent has not been classified yet
+	Resolution string `json:"resolution"`
+	Codec      string `json:"codec"`
+	Season     int    `json:"season"`
+	Episode    int    `json:"episode"`
+}
+
+// NewTorrent is a torrent whose metadata has just been fetched, as added by AddNewTorrent.
+type NewTorrent struct {
+	InfoHash   []byte
+	InfoHashV2 []byte // the full SHA-256 info hash of v2 and hybrid torrents (BEP 52)
+	Name       string
+	Files      []File
+	Info       []byte // the raw bencoded info dictionary, if available
+
+	TorrentDetails
+	ContentDetails
 }
 
 type TorrentMetadata struct {
-	ID        uint64  `json:"id"`
-	InfoHash  []byte  `json:"infoHash"` // marshalled differently
-	Name      string  `json:"name"`
-	Size      uint64  `json:"size"`
-	CreatedAt int64   `json:"createdAt"`
-	UpdatedAt int64   `json:"updatedAt"`
-	NFiles    uint    `json:"nFiles"`
-	Relevance float64 `json:"relevance"`
+	ID         uint64  `json:"id"`
+	InfoHash   []byte  `json:"infoHash"`   // marshalled differently
+	InfoHashV2 []byte  `json:"infoHashV2"` // marshalled differently; nil for v1-only torrents
+	Name       string  `json:"name"`
+	Size       uint64  `json:"size"`
+	CreatedAt  int64   `json:"createdAt"`
+	UpdatedAt  int64   `json:"updatedAt"`
+	NFiles     uint    `json:"nFiles"`
+	Relevance  float64 `json:"relevance"`
+	HasInfo    bool    `json:"hasInfo"` // whether the raw info dictionary is stored
+	Flagged    bool    `json:"flagged"`
+	FlagReason string  `json:"flagReason"`
+
+	TorrentDetails
+	ContentDetails
+}
+
+// TorrentFiles is a stored torrent along with its files, for maintenance tasks that need to look at
+// every torrent.
+type TorrentFiles struct {
+	ID       uint64
+	InfoHash []byte
+	Name     string
+	Files    []File
+}
+
+// ClassifiedTorrent is the outcome of classifying a torrent returned by GetUnclassifiedTorrents.
+type ClassifiedTorrent struct {
+	ID uint64
+	ContentDetails
+}
+
+// FailedInfoHash is an info hash whose metadata could not be fetched, and when to try again.
+type FailedInfoHash struct {
+	InfoHash     []byte
+	Failures     int
+	LastError    string
+	LastFailedAt int64
+	RetryAfter   int64
+}
+
+// Actions recorded in the audit log.
+const (
+	ActionDelete = "delete"
+	ActionHide   = "hide"
+	ActionUnhide = "unhide"
+	ActionFlag   = "flag"
+	ActionUnflag = "unflag"
+)
+
+// AuditEntry records an administrative action taken on a torrent.
+type AuditEntry struct {
+	ID        uint64 `json:"id"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	InfoHash  []byte `json:"infoHash"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"createdAt"`
 }
@@ -0,0 +1,122 @@
+package rules
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+var logger = logging.For(logging.Rules)
+
+// Engine evaluates the rules of a file, reloading them whenever the file changes.
+//
+// A missing file amounts to no rules, so that rules can be added without restarting. A file that
+// fails to parse is reported and ignored, keeping the rules that were loaded last.
+type Engine struct {
+	path string
+
+	mu      sync.RWMutex
+	rules   *RuleSet
+	modTime time.Time
+
+	termination chan any
+}
+
+// NewEngine loads the rules at filePath and, if reloadInterval is positive, checks whether they
+// changed every reloadInterval until Terminate is called.
+func NewEngine(filePath string, reloadInterval time.Duration) (*Engine, error) {
+	e := new(Engine)
+	e.path = filePath
+	e.termination = make(chan any)
+
+	if _, err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	if reloadInterval > 0 {
+		go e.watch(reloadInterval)
+	}
+
+	return e, nil
+}
+
+// Reload reloads the rules if the file has been modified, created or removed since they were last
+// loaded, and reports whether it did.
+func (e *Engine) Reload() (bool, error) {
+	var modTime time.Time
+	info, err := os.Stat(e.path)
+	if err == nil {
+		modTime = info.ModTime()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	e.mu.RLock()
+	unchanged := e.rules != nil && modTime.Equal(e.modTime)
+	e.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	rules := new(RuleSet)
+	if !modTime.IsZero() {
+		if rules, err = Load(e.path); err != nil {
+			return false, err
+		}
+	}
+
+	e.mu.Lock()
+	e.rules = rules
+	e.modTime = modTime
+	e.mu.Unlock()
+
+	return true, nil
+}
+
+// watch is a goroutine!
+func (e *Engine) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := e.Reload()
+			if err != nil {
+				logger.Error("could not reload the rules, keeping the previous ones", "path", e.path, "err", err)
+			} else if reloaded {
+				logger.Info("reloaded the rules", "path", e.path, "count", e.Rules().Len())
+			}
+
+		case <-e.termination:
+			return
+		}
+	}
+}
+
+// Rules returns the rules currently in effect.
+func (e *Engine) Rules() *RuleSet {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rules
+}
+
+// MatchInfoHash reports whether the info hash is blocked by the rules currently in effect.
+func (e *Engine) MatchInfoHash(infoHash []byte) bool {
+	return e.Rules().MatchInfoHash(infoHash)
+}
+
+// Match returns the first rule currently in effect that the torrent matches, if any.
+func (e *Engine) Match(t *persistence.TorrentFiles) (string, bool) {
+	return e.Rules().Match(t)
+}
+
+// Terminate stops watching the rules file.
+func (e *Engine) Terminate() {
+	close(e.termination)
+}
@@ -0,0 +1,42 @@
+package rules
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// Purge deletes the stored torrents that match the rules, looking at batchSize torrents at a time,
+// and returns how many it deleted.
+func Purge(ctx context.Context, database persistence.Database, rules *RuleSet, batchSize int) (int, error) {
+	var n int
+	var lastID uint64
+	for {
+		torrents, err := database.GetTorrentsAfter(ctx, lastID, batchSize)
+		if err != nil {
+			return n, err
+		}
+		if len(torrents) == 0 {
+			return n, nil
+		}
+		lastID = torrents[len(torrents)-1].ID
+
+		var ids []uint64
+		for i := range torrents {
+			if text, matched := rules.Match(&torrents[i]); matched {
+				logger.Info("purging torrent", "infohash", hex.EncodeToString(torrents[i].InfoHash),
+					"name", torrents[i].Name, "rule", text)
+				ids = append(ids, torrents[i].ID)
+			}
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+		if err = database.DeleteTorrents(ctx, ids); err != nil {
+			return n, err
+		}
+		n += len(ids)
+	}
+}
@@ -0,0 +1,201 @@
+// Package rules keeps torrents out of the index, according to a list of rules such as:
+//
+//	# Lines starting with a hash are comments.
+//	infohash 0123456789abcdef0123456789abcdef01234567
+//	name (?i)\bsample\b
+//	path (?i)/private/
+//	extension exe scr
+//	size > 100GiB
+//	size < 1KiB
+//
+// A torrent matches the list if it matches any of its rules:
+//   - infohash matches the torrent of that (hex-encoded) info hash;
+//   - name matches the torrents whose name matches the regular expression;
+//   - path matches the torrents that have a file whose path matches the regular expression;
+//   - extension matches the torrents that have a file with any of the extensions;
+//   - size matches the torrents whose total size is greater or less than the size.
+package rules
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// DefaultPath is where the crawler looks for its rules by default.
+const DefaultPath = "data/rules.txt"
+
+// rule is a rule other than infohash, which is looked up rather than evaluated.
+type rule struct {
+	text  string // as written in the rules file, to report matches
+	match func(t *persistence.TorrentFiles, totalSize uint64) bool
+}
+
+// RuleSet is a parsed list of rules. The zero RuleSet matches nothing.
+type RuleSet struct {
+	infoHashes map[string]string // hex-encoded info hash -> rule text
+	rules      []rule
+}
+
+// Load parses the rules file at filePath.
+func Load(filePath string) (*RuleSet, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses a list of rules.
+func Parse(r io.Reader) (*RuleSet, error) {
+	rs := new(RuleSet)
+	rs.infoHashes = make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := rs.add(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (rs *RuleSet) add(line string) error {
+	kind, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return fmt.Errorf("%s rule without an argument", kind)
+	}
+
+	switch kind {
+	case "infohash":
+		infoHash, err := hex.DecodeString(arg)
+		if err != nil || len(infoHash) != 20 {
+			return fmt.Errorf("invalid info hash %q", arg)
+		}
+		rs.infoHashes[hex.EncodeToString(infoHash)] = line
+
+	case "name":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return err
+		}
+		rs.rules = append(rs.rules, rule{line, func(t *persistence.TorrentFiles, _ uint64) bool {
+			return re.MatchString(t.Name)
+		}})
+
+	case "path":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return err
+		}
+		rs.rules = append(rs.rules, rule{line, func(t *persistence.TorrentFiles, _ uint64) bool {
+			for _, file := range t.Files {
+				if re.MatchString(file.Path) {
+					return true
+				}
+			}
+			return false
+		}})
+
+	case "extension":
+		extensions := make(map[string]struct{})
+		for _, extension := range strings.Fields(arg) {
+			extensions["."+strings.ToLower(strings.TrimPrefix(extension, "."))] = struct{}{}
+		}
+		rs.rules = append(rs.rules, rule{line, func(t *persistence.TorrentFiles, _ uint64) bool {
+			for _, file := range t.Files {
+				if _, ok := extensions[strings.ToLower(path.Ext(file.Path))]; ok {
+					return true
+				}
+			}
+			return false
+		}})
+
+	case "size":
+		operator, sizeText, _ := strings.Cut(arg, " ")
+		size, err := humanize.ParseBytes(strings.TrimSpace(sizeText))
+		if err != nil {
+			return fmt.Errorf("invalid size %q", sizeText)
+		}
+		switch operator {
+		case ">":
+			rs.rules = append(rs.rules, rule{line, func(_ *persistence.TorrentFiles, totalSize uint64) bool {
+				return totalSize > size
+			}})
+		case "<":
+			rs.rules = append(rs.rules, rule{line, func(_ *persistence.TorrentFiles, totalSize uint64) bool {
+				return totalSize < size
+			}})
+		default:
+			return fmt.Errorf("invalid size operator %q", operator)
+		}
+
+	default:
+		return fmt.Errorf("unknown rule %q", kind)
+	}
+
+	return nil
+}
+
+// Len returns the number of rules in the set.
+func (rs *RuleSet) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.infoHashes) + len(rs.rules)
+}
+
+// MatchInfoHash reports whether the info hash is blocked by an infohash rule, which unlike other
+// rules can be checked before fetching the metadata.
+func (rs *RuleSet) MatchInfoHash(infoHash []byte) bool {
+	if rs == nil {
+		return false
+	}
+	_, ok := rs.infoHashes[hex.EncodeToString(infoHash)]
+	return ok
+}
+
+// Match returns the first rule that the torrent matches, if any.
+func (rs *RuleSet) Match(t *persistence.TorrentFiles) (string, bool) {
+	if rs == nil {
+		return "", false
+	}
+
+	if text, ok := rs.infoHashes[hex.EncodeToString(t.InfoHash)]; ok {
+		return text, true
+	}
+
+	var totalSize uint64
+	for _, file := range t.Files {
+		totalSize += uint64(file.Size)
+	}
+
+	for _, r := range rs.rules {
+		if r.match(t, totalSize) {
+			return r.text, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,161 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+const testRules = `
+# Comments and blank lines are ignored.
+
+infohash 0123456789ABCDEF0123456789abcdef01234567
+name (?i)\bsample\b
+path ^private/
+extension .EXE scr
+size > 1GiB
+size < 1KiB
+`
+
+func testTorrent(name string, files ...persistence.File) *persistence.TorrentFiles {
+	return &persistence.TorrentFiles{InfoHash: make([]byte, 20), Name: name, Files: files}
+}
+
+func TestMatch(t *testing.T) {
+	rs, err := Parse(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatalf("could not parse rules: %v", err)
+	}
+	if rs.Len() != 6 {
+		t.Errorf("expected 6 rules, got %d", rs.Len())
+	}
+
+	blocked := testTorrent("blocked", persistence.File{Path: "a.txt", Size: 1 << 20})
+	blocked.InfoHash = []byte("\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67")
+
+	cases := []struct {
+		torrent *persistence.TorrentFiles
+		rule    string
+	}{
+		{blocked, "infohash 0123456789ABCDEF0123456789abcdef01234567"},
+		{testTorrent("A Sample Torrent", persistence.File{Path: "a.txt", Size: 1 << 20}), `name (?i)\bsample\b`},
+		{testTorrent("x", persistence.File{Path: "private/a.txt", Size: 1 << 20}), "path ^private/"},
+		{testTorrent("x", persistence.File{Path: "dir/SETUP.exe", Size: 1 << 20}), "extension .EXE scr"},
+		{testTorrent("x", persistence.File{Path: "a.mkv", Size: 2 << 30}), "size > 1GiB"},
+		{testTorrent("x", persistence.File{Path: "a.txt", Size: 10}), "size < 1KiB"},
+		{testTorrent("Examples", persistence.File{Path: "public/a.txt", Size: 1 << 20}), ""},
+	}
+
+	for _, c := range cases {
+		rule, matched := rs.Match(c.torrent)
+		if matched != (c.rule != "") || rule != c.rule {
+			t.Errorf("expected %q to match %q, got %q (%v)", c.torrent.Name, c.rule, rule, matched)
+		}
+	}
+
+	if !rs.MatchInfoHash(blocked.InfoHash) {
+		t.Errorf("expected the info hash to be blocked")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, text := range []string{
+		"infohash 0123",
+		"name (",
+		"size = 1GiB",
+		"size > lots",
+		"extension",
+		"color red",
+	} {
+		if _, err := Parse(strings.NewReader(text)); err == nil {
+			t.Errorf("expected %q not to parse", text)
+		}
+	}
+}
+
+func TestEngineReloads(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.txt")
+
+	e, err := NewEngine(rulesPath, 0)
+	if err != nil {
+		t.Fatalf("expected a missing rules file to be allowed: %v", err)
+	}
+	sample := testTorrent("sample", persistence.File{Path: "a.txt", Size: 1 << 20})
+	if _, matched := e.Match(sample); matched {
+		t.Errorf("expected no rules")
+	}
+
+	if err = os.WriteFile(rulesPath, []byte("name sample\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := e.Reload(); !reloaded || err != nil {
+		t.Fatalf("expected the rules to be reloaded, got %v, %v", reloaded, err)
+	}
+	if _, matched := e.Match(sample); !matched {
+		t.Errorf("expected the new rule to apply")
+	}
+	if reloaded, _ := e.Reload(); reloaded {
+		t.Errorf("expected an unchanged file not to be reloaded")
+	}
+
+	// A broken file leaves the rules in effect.
+	if err = os.WriteFile(rulesPath, []byte("name (\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes(rulesPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Reload(); err == nil {
+		t.Errorf("expected the broken file to fail to load")
+	}
+	if _, matched := e.Match(sample); !matched {
+		t.Errorf("expected the previous rules to stay in effect")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	database, err := persistence.NewSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), persistence.DefaultOptions)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer database.Close()
+
+	for i, name := range []string{"keep me", "sample one", "keep me too", "sample two"} {
+		infoHash := make([]byte, 20)
+		infoHash[0] = byte(i)
+		err = database.AddNewTorrent(context.Background(), persistence.NewTorrent{
+			InfoHash: infoHash,
+			Name:     name,
+			Files:    []persistence.File{{Path: name + ".txt", Size: 100}},
+			Info:     []byte("d4:name4:teste"),
+		})
+		if err != nil {
+			t.Fatalf("could not add torrent: %v", err)
+		}
+	}
+
+	rs, _ := Parse(strings.NewReader("name sample"))
+	n, err := Purge(context.Background(), database, rs, 1)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 torrents to be purged, got %d, %v", n, err)
+	}
+
+	if count, _ := database.QueryTorrentsCount(context.Background(), "sample", ""); count != 0 {
+		t.Errorf("expected purged torrents to be removed from the search index, found %d", count)
+	}
+	if count, _ := database.QueryTorrentsCount(context.Background(), "keep", ""); count != 2 {
+		t.Errorf("expected 2 torrents to be kept, found %d", count)
+	}
+	if files, _ := database.GetFiles(context.Background(), []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); len(files) != 0 {
+		t.Errorf("expected the files of purged torrents to be deleted, found %v", files)
+	}
+	if info, _ := database.GetTorrentInfo(context.Background(), []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); info != nil {
+		t.Errorf("expected the info of purged torrents to be deleted")
+	}
+}
@@ -0,0 +1,142 @@
+package serve
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+const (
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 1000
+)
+
+// requireAdmin lets in the requests of the admins of config, which must have been authenticated
+// already. Who made them is recorded in the audit log.
+func requireAdmin(config *AuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !config.isAdmin(User(r)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectCrossSite rejects the requests that change state on behalf of another site. Browsers send
+// the credentials they cached for the admin routes along with the forms and fetches of any page, so
+// such requests would act as the admin otherwise. Browsers tell where requests come from with
+// Sec-Fetch-Site or, for older ones, Origin; clients such as curl send neither, and are let in.
+func rejectCrossSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		crossSite := false
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+			crossSite = site != "same-origin" && site != "none"
+		} else if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			crossSite = err != nil || u.Host != r.Host
+		}
+		if crossSite {
+			http.Error(w, "Forbidden: cross-site request", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminRouter returns the admin routes, which only the admins of config may use. They must be
+// mounted behind authenticate.
+func adminRouter(database persistence.Database, config *AuthConfig) http.Handler {
+	router := chi.NewRouter()
+	router.Use(rejectCrossSite, requireAdmin(config))
+	router.Delete("/torrents/{infohash:[a-f0-9]{40}}", moderationHandler(
+		func(infoHash []byte, r *http.Request) (bool, error) {
+			return database.DeleteTorrent(r.Context(), infoHash, User(r))
+		}))
+	router.Post("/torrents/{infohash:[a-f0-9]{40}}/hide", moderationHandler(
+		func(infoHash []byte, r *http.Request) (bool, error) {
+			return database.SetTorrentHidden(r.Context(), infoHash, true, User(r))
+		}))
+	router.Post("/torrents/{infohash:[a-f0-9]{40}}/unhide", moderationHandler(
+		func(infoHash []byte, r *http.Request) (bool, error) {
+			return database.SetTorrentHidden(r.Context(), infoHash, false, User(r))
+		}))
+	router.Post("/torrents/{infohash:[a-f0-9]{40}}/flag", moderationHandler(
+		func(infoHash []byte, r *http.Request) (bool, error) {
+			return database.SetTorrentFlagged(r.Context(), infoHash, true, r.FormValue("reason"), User(r))
+		}))
+	router.Post("/torrents/{infohash:[a-f0-9]{40}}/unflag", moderationHandler(
+		func(infoHash []byte, r *http.Request) (bool, error) {
+			return database.SetTorrentFlagged(r.Context(), infoHash, false, "", User(r))
+		}))
+	router.Get("/audit", auditLogHandler(database))
+	return router
+}
+
+// moderationHandler applies an action to the torrent of the info hash in the URL, which reports
+// whether the torrent exists.
+func moderationHandler(action func(infoHash []byte, r *http.Request) (bool, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hashBytes, err := hex.DecodeString(chi.URLParam(r, "infohash"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		found, err := action(hashBytes, r)
+		if err != nil {
+			databaseError(w, r, "could not moderate the torrent", err)
+			return
+		}
+
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// auditLogHandler lists the most recent entries of the audit log as JSON, up to the "limit" query
+// parameter.
+func auditLogHandler(database persistence.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultAuditLogLimit
+		if s := r.FormValue("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = minInt(n, maxAuditLogLimit)
+		}
+
+		entries, err := database.GetAuditLog(r.Context(), limit)
+		if err != nil {
+			databaseError(w, r, "could not fetch the audit log", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(entries); err != nil {
+			logger.ErrorContext(r.Context(), "could not write the audit log", "err", err)
+		}
+	}
+}
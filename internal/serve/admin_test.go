@@ -0,0 +1,310 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+const testPassword = "hunter2"
+
+// testAdminConfig lets alice, bob, carol and dave in with testPassword, and alice, bob and carol
+// use the admin routes.
+func testAdminConfig(t *testing.T) *AuthConfig {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash the password: %v", err)
+	}
+
+	var lines []string
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		lines = append(lines, "user "+user+" "+string(hash))
+	}
+	lines = append(lines, "admin alice bob carol")
+	config, err := ParseAuthConfig(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("could not parse the configuration: %v", err)
+	}
+	return config
+}
+
+func newAdminTestDatabase(t *testing.T) (persistence.Database, []byte) {
+	database, err := persistence.NewSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), persistence.DefaultOptions)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	infoHash := make([]byte, 20)
+	infoHash[0] = 0xaa
+	err = database.AddNewTorrent(context.Background(), persistence.NewTorrent{
+		InfoHash: infoHash,
+		Name:     "some torrent",
+		Files:    []persistence.File{{Path: "some file.txt", Size: 100}},
+	})
+	if err != nil {
+		t.Fatalf("could not add torrent: %v", err)
+	}
+
+	return database, infoHash
+}
+
+func doAdminRequest(handler http.Handler, method, path, user, password string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	database, infoHash := newAdminTestDatabase(t)
+	handler := newRouter(database, testAdminConfig(t))
+	path := "/admin/torrents/" + hex.EncodeToString(infoHash) + "/hide"
+
+	for _, c := range []struct {
+		user, password string
+		expectedCode   int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		// The password of an admin does not let anyone else in under a name of their choosing.
+		{"mallory", testPassword, http.StatusUnauthorized},
+		// Those who are not admins may use the rest of the web interface only.
+		{"dave", testPassword, http.StatusForbidden},
+	} {
+		w := doAdminRequest(handler, http.MethodPost, path, c.user, c.password, nil)
+		if w.Code != c.expectedCode {
+			t.Errorf("%q:%q: expected %d, got %d", c.user, c.password, c.expectedCode, w.Code)
+		}
+		if c.expectedCode == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q:%q: expected a WWW-Authenticate challenge", c.user, c.password)
+		}
+	}
+
+	if entries, _ := database.GetAuditLog(context.Background(), 10); len(entries) != 0 {
+		t.Errorf("expected unauthorized requests not to be audited, got %v", entries)
+	}
+}
+
+func TestAdminModeration(t *testing.T) {
+	database, infoHash := newAdminTestDatabase(t)
+	handler := newRouter(database, testAdminConfig(t))
+	path := "/admin/torrents/" + hex.EncodeToString(infoHash)
+
+	w := doAdminRequest(handler, http.MethodPost, path+"/hide", "alice", testPassword, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("hide: expected 204, got %d", w.Code)
+	}
+	if torrent, _ := database.GetTorrent(context.Background(), infoHash); torrent != nil {
+		t.Errorf("expected the hidden torrent not to be found")
+	}
+	if count, _ := database.QueryTorrentsCount(context.Background(), "some", ""); count != 0 {
+		t.Errorf("expected the hidden torrent not to be counted, got %d", count)
+	}
+	if n, _ := database.GetNumberOfTorrents(context.Background()); n != 0 {
+		t.Errorf("expected the hidden torrent not to be counted, got %d", n)
+	}
+	if exists, _ := database.DoesTorrentExist(context.Background(), infoHash); !exists {
+		t.Errorf("expected the hidden torrent to still exist, so that it is not indexed again")
+	}
+
+	w = doAdminRequest(handler, http.MethodPost, path+"/unhide", "alice", testPassword, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unhide: expected 204, got %d", w.Code)
+	}
+
+	w = doAdminRequest(handler, http.MethodPost, path+"/flag", "bob", testPassword, url.Values{"reason": {"mislabelled"}})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("flag: expected 204, got %d", w.Code)
+	}
+	torrent, _ := database.GetTorrent(context.Background(), infoHash)
+	if torrent == nil || !torrent.Flagged || torrent.FlagReason != "mislabelled" {
+		t.Errorf("expected the torrent to be flagged as mislabelled, got %+v", torrent)
+	}
+
+	w = doAdminRequest(handler, http.MethodDelete, path, "bob", testPassword, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", w.Code)
+	}
+	if exists, _ := database.DoesTorrentExist(context.Background(), infoHash); exists {
+		t.Errorf("expected the torrent to be deleted")
+	}
+
+	w = doAdminRequest(handler, http.MethodDelete, path, "bob", testPassword, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("delete again: expected 404, got %d", w.Code)
+	}
+
+	w = doAdminRequest(handler, http.MethodGet, "/admin/audit", "carol", testPassword, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit: expected 200, got %d", w.Code)
+	}
+	var entries []persistence.AuditEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("could not decode the audit log: %v", err)
+	}
+
+	expected := []struct{ actor, action, reason string }{
+		{"bob", persistence.ActionDelete, ""},
+		{"bob", persistence.ActionFlag, "mislabelled"},
+		{"alice", persistence.ActionUnhide, ""},
+		{"alice", persistence.ActionHide, ""},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d audit entries, got %+v", len(expected), entries)
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.Actor != e.actor || entry.Action != e.action || entry.Reason != e.reason ||
+			hex.EncodeToString(entry.InfoHash) != hex.EncodeToString(infoHash) {
+			t.Errorf("entry %d: expected %v, got %+v", i, e, entry)
+		}
+	}
+}
+
+func TestAdminRoutesUseAccessControl(t *testing.T) {
+	database, infoHash := newAdminTestDatabase(t)
+	tokenHash := sha256.Sum256([]byte("s3cret-token"))
+	config, err := ParseAuthConfig(strings.NewReader(`
+token backup ` + hex.EncodeToString(tokenHash[:]) + `
+proxy X-Forwarded-User 10.0.0.0/8
+exempt /admin/audit
+admin backup erin
+`))
+	if err != nil {
+		t.Fatalf("could not parse the configuration: %v", err)
+	}
+	handler := newRouter(database, config)
+	path := "/admin/torrents/" + hex.EncodeToString(infoHash)
+
+	r := httptest.NewRequest(http.MethodPost, path+"/flag", nil)
+	r.Header.Set("Authorization", "Bearer s3cret-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("flag with a token: expected 204, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, path+"/unflag", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-User", "erin")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unflag through the proxy: expected 204, got %d", w.Code)
+	}
+
+	// Exempting an admin route lets nobody in, as nobody is authenticated there.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("exempt audit log: expected 403, got %d", w.Code)
+	}
+
+	entries, err := database.GetAuditLog(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("could not get the audit log: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Actor != "erin" || entries[1].Actor != "backup" {
+		t.Errorf("expected the actions of erin and backup, got %+v", entries)
+	}
+}
+
+func TestAdminRejectsCrossSiteRequests(t *testing.T) {
+	database, infoHash := newAdminTestDatabase(t)
+	handler := newRouter(database, testAdminConfig(t))
+	path := "/admin/torrents/" + hex.EncodeToString(infoHash) + "/hide"
+
+	for _, c := range []struct {
+		header, value string
+		code          int
+	}{
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		{"Origin", "https://evil.example", http.StatusForbidden},
+		{"Origin", "null", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-origin", http.StatusNoContent},
+		{"Origin", "http://example.com", http.StatusNoContent}, // the host of httptest requests
+		{"", "", http.StatusNoContent},                         // curl and the like
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("alice", testPassword)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: %s: expected %d, got %d", c.header, c.value, c.code, w.Code)
+		}
+	}
+
+	entries, err := database.GetAuditLog(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("could not get the audit log: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected only the same-origin requests to be audited, got %+v", entries)
+	}
+}
+
+func TestAdminModerationUnavailable(t *testing.T) {
+	infoHash := make([]byte, 20)
+	path := "/admin/torrents/" + hex.EncodeToString(infoHash) + "/hide"
+
+	opts := persistence.DefaultOptions
+	opts.WriteTimeout = time.Nanosecond
+	database, err := persistence.NewSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), opts)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer database.Close()
+	w := doAdminRequest(newRouter(database, testAdminConfig(t)), http.MethodPost, path, "alice", testPassword, nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 for a moderation that timed out, got %d", w.Code)
+	}
+
+	// So do moderations that find the database locked by another process.
+	filename := filepath.Join(t.TempDir(), "magnetico.db")
+	opts = persistence.DefaultOptions
+	opts.BusyTimeout = time.Millisecond
+	database, err = persistence.NewSqlite3Database(filename, opts)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer database.Close()
+	locker, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer locker.Close()
+	tx, err := locker.Begin()
+	if err != nil {
+		t.Fatalf("could not begin a transaction: %v", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+	if _, err = tx.Exec("CREATE TABLE t (x);"); err != nil {
+		t.Fatalf("could not take the write lock: %v", err)
+	}
+	w = doAdminRequest(newRouter(database, testAdminConfig(t)), http.MethodPost, path, "alice", testPassword, nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 for a moderation of a locked database, got %d", w.Code)
+	}
+}
@@ -0,0 +1,318 @@
+package serve
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultAuthPath is where the web interface looks for its access control configuration, such as:
+//
+//	# Lines starting with a hash are comments.
+//	user alice $2y$10$...
+//	token backup-script 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	proxy X-Forwarded-User 127.0.0.1/32 ::1/128
+//	exempt /healthz
+//	exempt /static/
+//	admin alice
+//
+// Every request must then be authenticated by one of:
+//   - user, with HTTP basic authentication against the bcrypt hash of the password of the user;
+//   - token, with an "Authorization: Bearer" header holding the token of the (hex-encoded) SHA-256
+//     hash, for scripts;
+//   - proxy, with the header set by a reverse proxy to the name of the user it authenticated, which
+//     is trusted only from the given networks;
+//
+// except for the exempt paths, or those under them if they end with a slash. The users, tokens and
+// proxied users named by admin may also use the admin routes.
+const DefaultAuthPath = "data/auth.txt"
+
+// maxCachedCredentials bounds the cache of basic authentication credentials that were verified
+// already, as bcrypt is deliberately too slow to run on every request.
+const maxCachedCredentials = 1024
+
+// Authenticator identifies who makes a request.
+type Authenticator interface {
+	// Authenticate returns the user that made the request, and whether it could tell.
+	Authenticate(r *http.Request) (string, bool)
+}
+
+// AuthConfig is a parsed access control configuration. A nil AuthConfig lets everyone in.
+type AuthConfig struct {
+	Authenticators []Authenticator
+	Exempt         []string
+	// Admins are the names of those who may use the admin routes.
+	Admins map[string]bool
+	// basicAuth is the basic authentication among Authenticators, if any, so that clients can be
+	// challenged for it.
+	basicAuth *BasicAuthenticator
+}
+
+// LoadAuthConfig parses the access control configuration at filePath.
+func LoadAuthConfig(filePath string) (*AuthConfig, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseAuthConfig(f)
+}
+
+// ParseAuthConfig parses an access control configuration.
+func ParseAuthConfig(r io.Reader) (*AuthConfig, error) {
+	config := new(AuthConfig)
+	tokens := NewTokenAuthenticator()
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var err error
+		switch kind, args := fields[0], fields[1:]; kind {
+		case "user":
+			if len(args) != 2 {
+				err = fmt.Errorf("expected a user name and a bcrypt hash")
+				break
+			}
+			if config.basicAuth == nil {
+				config.basicAuth = NewBasicAuthenticator()
+				config.Authenticators = append(config.Authenticators, config.basicAuth)
+			}
+			err = config.basicAuth.AddUser(args[0], []byte(args[1]))
+
+		case "token":
+			if len(args) != 2 {
+				err = fmt.Errorf("expected a token name and its SHA-256 hash")
+				break
+			}
+			if len(tokens.tokens) == 0 {
+				config.Authenticators = append(config.Authenticators, tokens)
+			}
+			err = tokens.AddToken(args[0], args[1])
+
+		case "proxy":
+			if len(args) < 2 {
+				err = fmt.Errorf("expected a header and the networks of the trusted proxies")
+				break
+			}
+			var proxy *ProxyAuthenticator
+			proxy, err = NewProxyAuthenticator(args[0], args[1:])
+			if err == nil {
+				config.Authenticators = append(config.Authenticators, proxy)
+			}
+
+		case "exempt":
+			if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+				err = fmt.Errorf("expected an absolute path")
+				break
+			}
+			config.Exempt = append(config.Exempt, args[0])
+
+		case "admin":
+			if len(args) == 0 {
+				err = fmt.Errorf("expected the names of the admins")
+				break
+			}
+			if config.Admins == nil {
+				config.Admins = make(map[string]bool)
+			}
+			for _, name := range args {
+				config.Admins[name] = true
+			}
+
+		default:
+			err = fmt.Errorf("unknown directive %q", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(config.Authenticators) == 0 {
+		return nil, fmt.Errorf("no users, tokens or proxies")
+	}
+
+	return config, nil
+}
+
+// isExempt reports whether requests for urlPath need not be authenticated.
+func (config *AuthConfig) isExempt(urlPath string) bool {
+	for _, exempt := range config.Exempt {
+		if urlPath == exempt || (strings.HasSuffix(exempt, "/") && strings.HasPrefix(urlPath, exempt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether user may use the admin routes. Nobody may without a configuration, as
+// nobody is authenticated then.
+func (config *AuthConfig) isAdmin(user string) bool {
+	return config != nil && user != "" && config.Admins[user]
+}
+
+// authenticate returns who made the request, according to the first authenticator that can tell.
+func (config *AuthConfig) authenticate(r *http.Request) (string, bool) {
+	for _, authenticator := range config.Authenticators {
+		if user, ok := authenticator.Authenticate(r); ok {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// BasicAuthenticator authenticates users by HTTP basic authentication.
+type BasicAuthenticator struct {
+	hashes map[string][]byte // user name -> bcrypt hash of the password
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{} // hashes of the credentials that matched a hash
+}
+
+func NewBasicAuthenticator() *BasicAuthenticator {
+	ba := new(BasicAuthenticator)
+	ba.hashes = make(map[string][]byte)
+	ba.verified = make(map[[sha256.Size]byte]struct{})
+	return ba
+}
+
+// AddUser lets the user of the given bcrypt password hash in.
+func (ba *BasicAuthenticator) AddUser(name string, hash []byte) error {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return fmt.Errorf("invalid bcrypt hash for %s: %w", name, err)
+	}
+	ba.hashes[name] = hash
+	return nil
+}
+
+func (ba *BasicAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := ba.hashes[name]
+	if !ok {
+		return "", false
+	}
+
+	credentials := sha256.Sum256([]byte(name + ":" + password))
+	ba.mu.Lock()
+	_, verified := ba.verified[credentials]
+	ba.mu.Unlock()
+	if verified {
+		return name, true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+
+	ba.mu.Lock()
+	if len(ba.verified) >= maxCachedCredentials {
+		ba.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	ba.verified[credentials] = struct{}{}
+	ba.mu.Unlock()
+
+	return name, true
+}
+
+// TokenAuthenticator authenticates scripts by the bearer token of their Authorization header.
+type TokenAuthenticator struct {
+	tokens map[[sha256.Size]byte]string // SHA-256 hash of the token -> its name
+}
+
+func NewTokenAuthenticator() *TokenAuthenticator {
+	ta := new(TokenAuthenticator)
+	ta.tokens = make(map[[sha256.Size]byte]string)
+	return ta
+}
+
+// AddToken lets the token of the given hex-encoded SHA-256 hash in, as the user name.
+func (ta *TokenAuthenticator) AddToken(name string, hexHash string) error {
+	var hash [sha256.Size]byte
+	if n, err := hex.Decode(hash[:], []byte(hexHash)); err != nil || n != sha256.Size {
+		return fmt.Errorf("invalid SHA-256 hash for token %s", name)
+	}
+	ta.tokens[hash] = name
+	return nil
+}
+
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	// Tokens are looked up by their hash, so that timing reveals nothing about them.
+	name, ok := ta.tokens[sha256.Sum256([]byte(token))]
+	return name, ok
+}
+
+// ProxyAuthenticator trusts the user name that a reverse proxy sets in a header, when the request
+// comes from one of the networks of the proxy.
+type ProxyAuthenticator struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func NewProxyAuthenticator(header string, networks []string) (*ProxyAuthenticator, error) {
+	pa := new(ProxyAuthenticator)
+	pa.header = textproto.CanonicalMIMEHeaderKey(header)
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		pa.trusted = append(pa.trusted, ipNet)
+	}
+	return pa, nil
+}
+
+func (pa *ProxyAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	user := r.Header.Get(pa.header)
+	if user == "" {
+		return "", false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	for _, ipNet := range pa.trusted {
+		if ipNet.Contains(ip) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+type userKey struct{}
+
+// User returns who made an authenticated request, or "" if access control is off or the path is
+// exempt.
+func User(r *http.Request) string {
+	name, _ := r.Context().Value(userKey{}).(string)
+	return name
+}
@@ -0,0 +1,123 @@
+package serve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testAuthConfig(t *testing.T) *AuthConfig {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash the password: %v", err)
+	}
+	tokenHash := sha256.Sum256([]byte("s3cret-token"))
+
+	config, err := ParseAuthConfig(strings.NewReader(`
+# Lines starting with a hash are comments.
+user alice ` + string(hash) + `
+token backup ` + hex.EncodeToString(tokenHash[:]) + `
+proxy X-Forwarded-User 10.0.0.0/8
+exempt /healthz
+exempt /static/
+`))
+	if err != nil {
+		t.Fatalf("could not parse the configuration: %v", err)
+	}
+	return config
+}
+
+func TestAuthenticate(t *testing.T) {
+	handler := authenticate(testAuthConfig(t))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(User(r)))
+	}))
+
+	cases := []struct {
+		name         string
+		path         string
+		remoteAddr   string
+		setup        func(r *http.Request)
+		expectedCode int
+		expectedUser string
+	}{
+		{"anonymous", "/", "192.0.2.1:1234", func(r *http.Request) {}, http.StatusUnauthorized, ""},
+		{"basic", "/", "192.0.2.1:1234", func(r *http.Request) {
+			r.SetBasicAuth("alice", "correct horse")
+		}, http.StatusOK, "alice"},
+		{"wrong password", "/", "192.0.2.1:1234", func(r *http.Request) {
+			r.SetBasicAuth("alice", "battery staple")
+		}, http.StatusUnauthorized, ""},
+		{"unknown user", "/", "192.0.2.1:1234", func(r *http.Request) {
+			r.SetBasicAuth("mallory", "correct horse")
+		}, http.StatusUnauthorized, ""},
+		{"token", "/torrents", "192.0.2.1:1234", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer s3cret-token")
+		}, http.StatusOK, "backup"},
+		{"wrong token", "/torrents", "192.0.2.1:1234", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer guess")
+		}, http.StatusUnauthorized, ""},
+		{"trusted proxy", "/", "10.1.2.3:1234", func(r *http.Request) {
+			r.Header.Set("X-Forwarded-User", "bob")
+		}, http.StatusOK, "bob"},
+		{"untrusted proxy", "/", "192.0.2.1:1234", func(r *http.Request) {
+			r.Header.Set("X-Forwarded-User", "bob")
+		}, http.StatusUnauthorized, ""},
+		{"exempt path", "/healthz", "192.0.2.1:1234", func(r *http.Request) {}, http.StatusOK, ""},
+		{"exempt prefix", "/static/application.css", "192.0.2.1:1234", func(r *http.Request) {}, http.StatusOK, ""},
+		{"not a prefix", "/healthz/more", "192.0.2.1:1234", func(r *http.Request) {}, http.StatusUnauthorized, ""},
+	}
+
+	for _, c := range cases {
+		// Twice, to go through the cache of verified credentials.
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodGet, c.path, nil)
+			r.RemoteAddr = c.remoteAddr
+			c.setup(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != c.expectedCode {
+				t.Errorf("%s: expected %d, got %d", c.name, c.expectedCode, w.Code)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != c.expectedUser {
+				t.Errorf("%s: expected the user %q, got %q", c.name, c.expectedUser, w.Body.String())
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: expected a basic authentication challenge", c.name)
+			}
+		}
+	}
+}
+
+func TestParseAuthConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"",
+		"# only comments",
+		"user alice",
+		"user alice not-a-bcrypt-hash",
+		"token backup 1234",
+		"proxy X-Forwarded-User",
+		"proxy X-Forwarded-User not-a-network",
+		"exempt healthz",
+		"admin",
+		"group admins alice",
+	} {
+		if _, err := ParseAuthConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("expected %q to fail to parse", config)
+		}
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	handler := authenticate(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected everyone to be let in, got %d", w.Code)
+	}
+}
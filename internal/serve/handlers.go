@@ -1,18 +1,25 @@
 package serve
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
 	"io"
-	"log"
 	"math"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/go-chi/chi/v5"
 
+	"github.com/t-richards/magnetico/internal/classifier"
 	"github.com/t-richards/magnetico/internal/persistence"
+	"github.com/t-richards/magnetico/internal/stats"
 )
 
 // Homepage.
@@ -20,13 +27,13 @@ type homepageData struct {
 	NTorrents int
 }
 
-func rootHandler(database *persistence.Database) http.HandlerFunc {
+func rootHandler(database persistence.Database) http.HandlerFunc {
 	homepageTemplate := template.Must(template.New("homepage").Funcs(templateFunctions).Parse(mustTemplate("templates/homepage.html")))
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		nTorrents, err := database.GetNumberOfTorrents(r.Context())
 		if err != nil {
-			log.Printf("while fetching number of torrents: %v\n", err)
+			logger.ErrorContext(r.Context(), "could not fetch the number of torrents", "err", err)
 			return
 		}
 
@@ -34,7 +41,7 @@ func rootHandler(database *persistence.Database) http.HandlerFunc {
 			NTorrents: nTorrents,
 		})
 		if err != nil {
-			log.Printf("while executing homepage template: %v", err)
+			logger.ErrorContext(r.Context(), "could not execute the homepage template", "err", err)
 		}
 	}
 }
@@ -42,8 +49,11 @@ func rootHandler(database *persistence.Database) http.HandlerFunc {
 // Torrents search page.
 type torrentsData struct {
 	// User inputs
-	Query string
-	Page  int
+	Query    string
+	Category string // empty for all categories
+	Page     int
+
+	Categories []string
 
 	// Query results
 	Torrents []persistence.TorrentMetadata
@@ -59,32 +69,33 @@ type ResultCount struct {
 	EndIdx   int
 }
 
-func torrentsHandler(database *persistence.Database) http.HandlerFunc {
+func torrentsHandler(database persistence.Database) http.HandlerFunc {
 	listTemplate := template.Must(template.New("torrent").Funcs(templateFunctions).Parse(mustTemplate("templates/torrents.html")))
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		_ = r.ParseForm()
 		query := r.FormValue("query")
+		category := getCategory(r)
 		page := getPageNumber(r)
 
-		count, err := database.QueryTorrentsCount(r.Context(), query)
+		count, err := database.QueryTorrentsCount(r.Context(), query, category)
 		if err != nil {
-			log.Printf("while fetching number of torrents: %v\n", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			databaseError(w, r, "could not fetch the number of torrents", err)
 			return
 		}
 
 		// Pages on the UI are 1-indexed, but the database is 0-indexed.
 		offset := (page - 1) * persistence.MaxResults
 		torrents, err := database.QueryTorrents(
+			r.Context(),
 			query,
+			category,
 			persistence.ByRelevance,
 			true,
 			offset,
 		)
 		if err != nil {
-			log.Printf("while fetching torrents: %v\n", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			databaseError(w, r, "could not fetch torrents", err)
 			return
 		}
 
@@ -96,8 +107,11 @@ func torrentsHandler(database *persistence.Database) http.HandlerFunc {
 			EndIdx:   offset + len(torrents),
 		}
 		err = listTemplate.Execute(w, torrentsData{
-			Query: query,
-			Page:  page,
+			Query:    query,
+			Category: category,
+			Page:     page,
+
+			Categories: classifier.Categories,
 
 			Torrents: torrents,
 
@@ -105,11 +119,21 @@ func torrentsHandler(database *persistence.Database) http.HandlerFunc {
 			ResultCount: resultCount,
 		})
 		if err != nil {
-			log.Printf("while executing torrents template: %v", err)
+			logger.ErrorContext(r.Context(), "could not execute the torrents template", "err", err)
 		}
 	}
 }
 
+// getCategory returns the category to restrict search results to, or an empty string for all of
+// them.
+func getCategory(r *http.Request) string {
+	category := r.FormValue("category")
+	if !classifier.IsCategory(category) {
+		return ""
+	}
+	return category
+}
+
 func getPageNumber(r *http.Request) int {
 	page := r.FormValue("page")
 	pageNo, err := strconv.ParseInt(page, 10, 64)
@@ -125,13 +149,14 @@ func getPageNumber(r *http.Request) int {
 }
 
 type torrentData struct {
-	Torrent persistence.TorrentMetadata
-	Files   []persistence.File
-	Query   string
-	Tree    Directory
+	Torrent     persistence.TorrentMetadata
+	Files       []persistence.File
+	Query       string
+	Tree        Directory
+	TorrentFile bool // whether a .torrent file can be downloaded
 }
 
-func torrentsInfohashHandler(database *persistence.Database) http.HandlerFunc {
+func torrentsInfohashHandler(database persistence.Database) http.HandlerFunc {
 	infoTemplate := template.Must(template.New("torrent").Funcs(templateFunctions).Parse(mustTemplate("templates/torrent.html")))
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -142,10 +167,9 @@ func torrentsInfohashHandler(database *persistence.Database) http.HandlerFunc {
 			return
 		}
 
-		metadata, err := database.GetTorrent(hashBytes)
+		metadata, err := database.GetTorrent(r.Context(), hashBytes)
 		if err != nil {
-			log.Printf("while fetching torrent: %v\n", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			databaseError(w, r, "could not fetch the torrent", err)
 			return
 		}
 
@@ -154,9 +178,9 @@ func torrentsInfohashHandler(database *persistence.Database) http.HandlerFunc {
 			return
 		}
 
-		files, err := database.GetFiles(hashBytes)
+		files, err := database.GetFiles(r.Context(), hashBytes)
 		if err != nil {
-			log.Printf("while fetching files: %v\n", err)
+			logger.ErrorContext(r.Context(), "could not fetch the files", "err", err)
 		}
 
 		err = infoTemplate.Execute(w, torrentData{
@@ -164,9 +188,108 @@ func torrentsInfohashHandler(database *persistence.Database) http.HandlerFunc {
 			Files:   files,
 			Query:   r.FormValue("query"),
 			Tree:    makeTree(files),
+
+			TorrentFile: metadata.HasInfo && !isV2Only(*metadata),
 		})
 		if err != nil {
-			log.Printf("while executing torrent template: %v", err)
+			logger.ErrorContext(r.Context(), "could not execute the torrent template", "err", err)
+		}
+	}
+}
+
+// torrentFileHandler reconstructs a .torrent file from the stored info dictionary, for clients
+// that cannot resolve magnet links.
+func torrentFileHandler(database persistence.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		infohash := chi.URLParam(r, "infohash")
+		hashBytes, err := hex.DecodeString(infohash)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		info, err := database.GetTorrentInfo(r.Context(), hashBytes)
+		if err != nil {
+			databaseError(w, r, "could not fetch the torrent info", err)
+			return
+		}
+
+		if info == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		metaInfo := metainfo.MetaInfo{
+			InfoBytes:    info,
+			CreatedBy:    "magnetico",
+			CreationDate: time.Now().Unix(),
+		}
+
+		parsedInfo, err := metaInfo.UnmarshalInfo()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "could not unmarshal the torrent info", "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// A v2-only .torrent file must also carry the piece layers, which are not part of the info
+		// dictionary and hence cannot be fetched over BEP 9.
+		if len(parsedInfo.Pieces) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		name := parsedInfo.Name
+		if name == "" {
+			name = infohash
+		}
+
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": name + ".torrent",
+		}))
+
+		if err = metaInfo.Write(w); err != nil {
+			logger.ErrorContext(r.Context(), "could not write the torrent file", "err", err)
+		}
+	}
+}
+
+// healthHandler tells load balancers and monitoring that the web interface is up.
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// status returns the current stats of the crawler, along with the size of the database.
+func status(r *http.Request, database persistence.Database) stats.Status {
+	s := stats.Default.Snapshot()
+
+	size, err := database.GetDatabaseSize(r.Context())
+	if err != nil {
+		logger.ErrorContext(r.Context(), "could not fetch the database size", "err", err)
+	}
+	s.DatabaseSize = size
+
+	return s
+}
+
+func statusHandler(database persistence.Database) http.HandlerFunc {
+	statusTemplate := template.Must(template.New("status").Funcs(templateFunctions).Parse(mustTemplate("templates/status.html")))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := statusTemplate.Execute(w, status(r, database))
+		if err != nil {
+			logger.ErrorContext(r.Context(), "could not execute the status template", "err", err)
+		}
+	}
+}
+
+func statusJSONHandler(database persistence.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status(r, database)); err != nil {
+			logger.ErrorContext(r.Context(), "could not write the status", "err", err)
 		}
 	}
 }
@@ -195,6 +318,25 @@ func staticHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, err = io.Copy(w, file)
 	if err != nil {
-		log.Printf("while serving static file: %v", err)
+		logger.ErrorContext(r.Context(), "could not serve the static file", "err", err)
+	}
+}
+
+// databaseError responds to a request that failed as the database did: with 503 Service
+// Unavailable if the query timed out or the database was busy, and 500 Internal Server Error
+// otherwise. Requests whose client went away before the query completed get no response.
+func databaseError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		logger.DebugContext(r.Context(), msg, "err", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.WarnContext(r.Context(), msg, "err", err)
+		http.Error(w, "The database timed out", http.StatusServiceUnavailable)
+	case persistence.IsBusy(err):
+		logger.WarnContext(r.Context(), msg, "err", err)
+		http.Error(w, "The database is busy", http.StatusServiceUnavailable)
+	default:
+		logger.ErrorContext(r.Context(), msg, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,205 @@
+package serve
+
+import (
+	"context"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/go-chi/chi/v5"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// newTestDatabase returns an in-memory database of a single torrent, and its info hash.
+func newTestDatabase(t *testing.T) (persistence.Database, []byte) {
+	database := persistence.NewMemoryDatabase()
+	infoHash := make([]byte, 20)
+	infoHash[0] = 0xbb
+	err := database.AddNewTorrent(context.Background(), persistence.NewTorrent{
+		InfoHash: infoHash,
+		Name:     "Ubuntu 22.04 Desktop",
+		Files:    []persistence.File{{Path: "ubuntu-22.04-desktop-amd64.iso", Size: 4 << 30}},
+	})
+	if err != nil {
+		t.Fatalf("could not add torrent: %v", err)
+	}
+	return database, infoHash
+}
+
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestRootHandler(t *testing.T) {
+	database, _ := newTestDatabase(t)
+
+	w := get(rootHandler(database), "/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "~1 torrents available") {
+		t.Errorf("expected the number of torrents, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTorrentsHandler(t *testing.T) {
+	database, _ := newTestDatabase(t)
+
+	w := get(torrentsHandler(database), "/torrents?query=ubuntu")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Ubuntu 22.04 Desktop") {
+		t.Errorf("expected the torrent to be found, got %d: %s", w.Code, w.Body.String())
+	}
+	if magnet := `href="magnet:?xt=urn:btih:bb00`; !strings.Contains(w.Body.String(), magnet) {
+		t.Errorf("expected the magnet link of the torrent, got %s", w.Body.String())
+	}
+
+	w = get(torrentsHandler(database), "/torrents?query=debian")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Ubuntu 22.04 Desktop") {
+		t.Errorf("expected no torrent to be found, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = get(torrentsHandler(database), "/torrents?query=ubuntu&category=audio")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Ubuntu 22.04 Desktop") {
+		t.Errorf("expected the torrent to be filtered out by category, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTorrentsInfohashHandler(t *testing.T) {
+	database, infoHash := newTestDatabase(t)
+	router := chi.NewRouter()
+	router.Get("/torrents/{infohash:[a-f0-9]{40}}", torrentsInfohashHandler(database))
+	router.Get("/torrents/{infohash:[a-f0-9]{40}}.torrent", torrentFileHandler(database))
+
+	w := get(router, "/torrents/"+hex.EncodeToString(infoHash))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ubuntu-22.04-desktop-amd64.iso") {
+		t.Errorf("expected the torrent page, got %d: %s", w.Code, w.Body.String())
+	}
+
+	unknown := strings.Repeat("cc", 20)
+	if w = get(router, "/torrents/"+unknown); w.Code != http.StatusNotFound {
+		t.Errorf("unknown torrent: expected 404, got %d", w.Code)
+	}
+	// The info dictionary of the torrent was not fetched.
+	if w = get(router, "/torrents/"+hex.EncodeToString(infoHash)+".torrent"); w.Code != http.StatusNotFound {
+		t.Errorf("torrent file: expected 404, got %d", w.Code)
+	}
+
+	if _, err := database.SetTorrentHidden(context.Background(), infoHash, true, "alice"); err != nil {
+		t.Fatalf("could not hide the torrent: %v", err)
+	}
+	if w = get(router, "/torrents/"+hex.EncodeToString(infoHash)); w.Code != http.StatusNotFound {
+		t.Errorf("hidden torrent: expected 404, got %d", w.Code)
+	}
+}
+
+func TestTorrentFileHandler(t *testing.T) {
+	info := metainfo.Info{
+		Name:        "Debian 12 netinst",
+		PieceLength: 1 << 18,
+		Pieces:      make([]byte, 2*20),
+		Length:      1<<18 + 1,
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("could not encode the info dictionary: %v", err)
+	}
+	infoHash := metainfo.HashBytes(infoBytes)
+
+	database := persistence.NewMemoryDatabase()
+	err = database.AddNewTorrent(context.Background(), persistence.NewTorrent{
+		InfoHash: infoHash[:],
+		Name:     info.Name,
+		Files:    []persistence.File{{Path: info.Name, Size: info.Length}},
+		Info:     infoBytes,
+	})
+	if err != nil {
+		t.Fatalf("could not add torrent: %v", err)
+	}
+	router := chi.NewRouter()
+	router.Get("/torrents/{infohash:[a-f0-9]{40}}.torrent", torrentFileHandler(database))
+
+	w := get(router, "/torrents/"+infoHash.HexString()+".torrent")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the torrent file, got %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-bittorrent" {
+		t.Errorf("expected a torrent file, got %q", contentType)
+	}
+	disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || params["filename"] != "Debian 12 netinst.torrent" {
+		t.Errorf("expected the torrent file to be downloaded under its name, got %q (%v)",
+			w.Header().Get("Content-Disposition"), err)
+	}
+
+	mi, err := metainfo.Load(w.Body)
+	if err != nil {
+		t.Fatalf("could not load the torrent file: %v", err)
+	}
+	if mi.HashInfoBytes() != infoHash {
+		t.Errorf("expected the info hash %s, got %s", infoHash, mi.HashInfoBytes())
+	}
+}
+
+// timingOutSearches is a database that counts the torrents matching a query, but times out
+// searching them.
+type timingOutSearches struct {
+	persistence.Database
+}
+
+func (db timingOutSearches) QueryTorrents(
+	ctx context.Context,
+	query string,
+	category string,
+	orderBy persistence.OrderingCriteria,
+	ascending bool,
+	offset int,
+) ([]persistence.TorrentMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	return db.Database.QueryTorrents(ctx, query, category, orderBy, ascending, offset)
+}
+
+func TestSearchTimeout(t *testing.T) {
+	opts := persistence.DefaultOptions
+	opts.SearchTimeout = time.Nanosecond
+	database, err := persistence.NewSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), opts)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer database.Close()
+
+	w := httptest.NewRecorder()
+	torrentsHandler(database)(w, httptest.NewRequest(http.MethodGet, "/torrents?query=ubuntu", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+
+	// So do searches that time out once their matches are counted.
+	database, err = persistence.NewSqlite3Database(filepath.Join(t.TempDir(), "magnetico.db"), persistence.DefaultOptions)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer database.Close()
+	w = httptest.NewRecorder()
+	torrentsHandler(timingOutSearches{database})(w, httptest.NewRequest(http.MethodGet, "/torrents?query=ubuntu", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 for a search that timed out, got %d", w.Code)
+	}
+
+	// Abandoned requests cancel their queries, and get no response.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	torrentsHandler(database)(w, httptest.NewRequest(http.MethodGet, "/torrents?query=ubuntu", nil).WithContext(ctx))
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no response, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+)
+
+// The multihash prefix of a 32 bytes long SHA-256 digest, as used by btmh magnet links.
+const sha256MultihashPrefix = "1220"
+
+// MagnetLink builds the magnet link of a torrent, carrying its v1 info hash (btih) and, for v2
+// and hybrid torrents, its v2 info hash (btmh) too.
+func MagnetLink(torrent persistence.TorrentMetadata) string {
+	var b strings.Builder
+	b.WriteString("magnet:?")
+
+	// The info hash of v2-only torrents is their truncated v2 info hash, which is not a btih.
+	if !isV2Only(torrent) {
+		b.WriteString("xt=urn:btih:")
+		b.WriteString(hex.EncodeToString(torrent.InfoHash))
+		b.WriteString("&")
+	}
+
+	if len(torrent.InfoHashV2) > 0 {
+		b.WriteString("xt=urn:btmh:")
+		b.WriteString(sha256MultihashPrefix)
+		b.WriteString(hex.EncodeToString(torrent.InfoHashV2))
+		b.WriteString("&")
+	}
+
+	b.WriteString("dn=")
+	b.WriteString(url.QueryEscape(torrent.Name))
+
+	return b.String()
+}
+
+// isV2Only reports whether the torrent has no v1 info hash, in which case it is identified by its
+// truncated v2 info hash.
+func isV2Only(torrent persistence.TorrentMetadata) bool {
+	return len(torrent.InfoHashV2) > 0 && bytes.HasPrefix(torrent.InfoHashV2, torrent.InfoHash)
+}
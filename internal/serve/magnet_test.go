@@ -0,0 +1,42 @@
+package serve_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/t-richards/magnetico/internal/persistence"
+	"github.com/t-richards/magnetico/internal/serve"
+)
+
+func TestMagnetLink(t *testing.T) {
+	v1 := bytes.Repeat([]byte{0xaa}, 20)
+	v2 := bytes.Repeat([]byte{0xbb}, 32)
+
+	cases := []struct {
+		torrent  persistence.TorrentMetadata
+		expected string
+	}{
+		// v1-only.
+		{
+			persistence.TorrentMetadata{InfoHash: v1, Name: "a b&c"},
+			"magnet:?xt=urn:btih:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa&dn=a+b%26c",
+		},
+		// Hybrid.
+		{
+			persistence.TorrentMetadata{InfoHash: v1, InfoHashV2: v2, Name: "x"},
+			"magnet:?xt=urn:btih:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+				"&xt=urn:btmh:1220bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb&dn=x",
+		},
+		// v2-only, whose info hash is the truncated v2 info hash.
+		{
+			persistence.TorrentMetadata{InfoHash: v2[:20], InfoHashV2: v2, Name: "x"},
+			"magnet:?xt=urn:btmh:1220bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb&dn=x",
+		},
+	}
+
+	for _, c := range cases {
+		if link := serve.MagnetLink(c.torrent); link != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, link)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/t-richards/magnetico/internal/metrics"
+)
+
+func TestInstrument(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(instrument)
+	router.Get("/things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	for _, path := range []string{"/things/1", "/things/2", "/elsewhere"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %v", err)
+	}
+
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "magnetico_http_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var route, code string
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "route":
+					route = label.GetValue()
+				case "code":
+					code = label.GetValue()
+				}
+			}
+			counts[route+" "+code] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	// Requests are told apart by their route pattern rather than their path.
+	if counts["/things/{id} 418"] != 2 {
+		t.Errorf("expected 2 requests to /things/{id}, got %v", counts)
+	}
+	if counts["unmatched 404"] != 1 {
+		t.Errorf("expected 1 unmatched request, got %v", counts)
+	}
+}
@@ -1,19 +1,29 @@
 package serve
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/t-richards/magnetico/internal/metrics"
 )
 
 const (
 	// Standard HTTP headers.
-	HeaderReferrerPolicy      = "Referrer-Policy"
-	HeaderXContentTypeOptions = "X-Content-Type-Options"
-	HeaderXFrameOptions       = "X-Frame-Options"
-	HeaderXRobotsTag          = "X-Robots-Tag"
-	HeaderXXSSProtection      = "X-XSS-Protection"
+	HeaderReferrerPolicy          = "Referrer-Policy"
+	HeaderStrictTransportSecurity = "Strict-Transport-Security"
+	HeaderXContentTypeOptions     = "X-Content-Type-Options"
+	HeaderXFrameOptions           = "X-Frame-Options"
+	HeaderXRobotsTag              = "X-Robots-Tag"
+	HeaderXXSSProtection          = "X-XSS-Protection"
 )
 
-// securityHeaders sets HTTP headers for security purposes.
+// securityHeaders sets HTTP headers for security purposes, including HSTS on HTTPS requests.
 func securityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(HeaderReferrerPolicy, "no-referrer")
@@ -21,7 +31,96 @@ func securityHeaders(next http.Handler) http.Handler {
 		w.Header().Set(HeaderXFrameOptions, "deny")
 		w.Header().Set(HeaderXRobotsTag, "noindex, nofollow")
 		w.Header().Set(HeaderXXSSProtection, "1; mode=block")
+		if r.TLS != nil {
+			w.Header().Set(HeaderStrictTransportSecurity, hstsMaxAge)
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// authenticate lets in the requests that config authenticates, or for the paths it exempts, and
+// records who made them for User. A nil config lets everyone in.
+func authenticate(config *AuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if config == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.isExempt(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			user, ok := config.authenticate(r)
+			if !ok {
+				// Only basic authentication can be prompted for by browsers.
+				if config.basicAuth != nil {
+					w.Header().Set("WWW-Authenticate", `Basic realm="magnetico", charset="UTF-8"`)
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+		})
+	}
+}
+
+// instrument observes the duration of requests by their route pattern rather than their path, so
+// that the number of label values stays bounded.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := routePattern(r)
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+		default:
+			method = "other"
+		}
+
+		metrics.HTTPRequestDuration.WithLabelValues(route, method, strconv.Itoa(statusCode(ww))).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// accessLog logs every request, along with its route pattern, status and latency.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", routePattern(r)),
+			slog.Int("status", statusCode(ww)),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
+
+// routePattern returns the pattern of the route that handled the request, such as
+// "/torrents/{infohash}", or "unmatched".
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return "unmatched"
+}
+
+// statusCode returns the status code written to ww, which is 200 unless another one was written.
+func statusCode(ww middleware.WrapResponseWriter) int {
+	if ww.Status() == 0 {
+		return http.StatusOK
+	}
+	return ww.Status()
+}
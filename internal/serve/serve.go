@@ -3,14 +3,19 @@ package serve
 import (
 	"embed"
 	"encoding/hex"
+	"errors"
 	"html/template"
-	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/t-richards/magnetico/internal/logging"
+	"github.com/t-richards/magnetico/internal/metrics"
 	"github.com/t-richards/magnetico/internal/persistence"
 )
 
@@ -39,6 +44,12 @@ var templateFunctions = template.FuncMap{
 
 	"hex": hex.EncodeToString,
 
+	// Magnet links are trusted as URLs, which html/template would otherwise reject for their
+	// scheme.
+	"magnet": func(t persistence.TorrentMetadata) template.URL {
+		return template.URL(MagnetLink(t))
+	},
+
 	"humanizeTime": func(s int64) string {
 		return humanize.Time(time.Unix(s, 0))
 	},
@@ -58,6 +69,18 @@ var templateFunctions = template.FuncMap{
 		}
 	},
 
+	"duration": func(seconds int64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+
+	"percent": func(ratio float64) string {
+		return strconv.FormatFloat(ratio*100, 'f', 1, 64) + "%"
+	},
+
+	"rate": func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 1, 64)
+	},
+
 	"unixTimeToString": func(s int64) string {
 		tm := time.Unix(s, 0)
 		// > Format and Parse use a reference time for specifying the format.
@@ -70,27 +93,73 @@ const (
 	BindAddress = ":8080"
 )
 
-func Run(database *persistence.Database) {
-	// Main application routes
-	router := chi.NewRouter()
-	router.Use(securityHeaders)
-	router.Get("/", rootHandler(database))
-	router.Get("/static/*", staticHandler)
-	router.Get("/favicon.ico", emptyFaviconHandler)
-	router.Get("/torrents", torrentsHandler(database))
-	router.Get("/torrents/{infohash:[a-f0-9]{40}}", torrentsInfohashHandler(database))
-
-	log.Printf("magnetico is ready to serve on %s!", BindAddress)
-	err := http.ListenAndServe(BindAddress, router)
+var logger = logging.For(logging.Serve)
+
+func Run(database persistence.Database) {
+	authConfig, err := LoadAuthConfig(DefaultAuthPath)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Warn("no access control configuration, the web interface is open to everyone", "path", DefaultAuthPath)
+	} else if err != nil {
+		fatal("could not load the access control configuration", "path", DefaultAuthPath, "err", err)
+	}
+
+	tlsOpts, err := tlsOptsFromEnv()
 	if err != nil {
-		log.Printf("ListenAndServe error %v", err)
+		fatal("could not configure TLS", "err", err)
+	}
+
+	router := newRouter(database, authConfig)
+	if authConfig == nil || len(authConfig.Admins) == 0 {
+		logger.Info("the admin routes are disabled, as no admin is configured", "path", DefaultAuthPath)
+	}
+
+	if tlsOpts != nil {
+		logger.Info("ready to serve HTTPS", "address", BindAddress)
+		err = listenAndServeTLS(BindAddress, router, tlsOpts)
+	} else {
+		logger.Info("ready to serve HTTP", "address", BindAddress)
+		err = http.ListenAndServe(BindAddress, router)
+	}
+	if err != nil {
+		logger.Error("could not serve", "err", err)
 	}
 }
 
+// newRouter returns the routes of the web interface, which config controls access to.
+func newRouter(database persistence.Database, config *AuthConfig) http.Handler {
+	router := chi.NewRouter()
+	router.Use(instrument)
+	router.Use(accessLog)
+	router.Use(securityHeaders)
+	router.Group(func(router chi.Router) {
+		router.Use(authenticate(config))
+		router.Get("/", rootHandler(database))
+		router.Get("/healthz", healthHandler)
+		router.Get("/status", statusHandler(database))
+		router.Get("/status.json", statusJSONHandler(database))
+		router.Get("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}).ServeHTTP)
+		router.Get("/static/*", staticHandler)
+		router.Get("/favicon.ico", emptyFaviconHandler)
+		router.Get("/torrents", torrentsHandler(database))
+		router.Get("/torrents/{infohash:[a-f0-9]{40}}", torrentsInfohashHandler(database))
+		router.Get("/torrents/{infohash:[a-f0-9]{40}}.torrent", torrentFileHandler(database))
+
+		if config != nil && len(config.Admins) > 0 {
+			router.Mount("/admin", adminRouter(database, config))
+		}
+	})
+	return router
+}
+
 func mustTemplate(name string) string {
 	data, err := fs.ReadFile(name)
 	if err != nil {
-		log.Panic(err)
+		panic(err)
 	}
 	return string(data)
 }
+
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,56 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/t-richards/magnetico/internal/stats"
+)
+
+func TestStatus(t *testing.T) {
+	database, _ := newAdminTestDatabase(t)
+
+	w := httptest.NewRecorder()
+	statusJSONHandler(database)(w, httptest.NewRequest(http.MethodGet, "/status.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var s stats.Status
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatalf("could not decode the status: %v", err)
+	}
+	if s.DatabaseSize <= 0 {
+		t.Errorf("expected the size of the database, got %d", s.DatabaseSize)
+	}
+	if s.DiscoveredTotal == 0 {
+		t.Errorf("expected the torrent added by the test to be counted as discovered")
+	}
+
+	w = httptest.NewRecorder()
+	statusHandler(database)(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Leech success rate") {
+		t.Errorf("expected the status page, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStatusEscapesWhatPeersSay(t *testing.T) {
+	database, _ := newAdminTestDatabase(t)
+	script := "<script>alert(1)</script>"
+	stats.Default.SetSink(func() stats.Sink {
+		return stats.Sink{Clients: []stats.ClientCount{{Client: script, Succeeded: 1}}}
+	})
+	t.Cleanup(func() { stats.Default.SetSink(nil) })
+	stats.Default.RecordLeech(script)
+
+	w := httptest.NewRecorder()
+	statusHandler(database)(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the status page, got %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, script) || !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("expected the client name and error class to be escaped, got %s", body)
+	}
+}
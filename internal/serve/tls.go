@@ -0,0 +1,216 @@
+package serve
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables that configure TLS, which is enabled when both the certificate and its
+// key are set.
+const (
+	TLSCertEnv             = "MAGNETICO_TLS_CERT"              // path to the PEM certificate (chain)
+	TLSKeyEnv              = "MAGNETICO_TLS_KEY"               // path to the PEM private key
+	TLSMinVersionEnv       = "MAGNETICO_TLS_MIN_VERSION"       // "1.2" (default) or "1.3"
+	HTTPRedirectAddressEnv = "MAGNETICO_HTTP_REDIRECT_ADDRESS" // e.g. ":80", to redirect HTTP to HTTPS
+)
+
+const (
+	// certReloadInterval is how often the certificate files are checked for changes, such as
+	// renewals.
+	certReloadInterval = 1 * time.Minute
+	// hstsMaxAge is sent in the Strict-Transport-Security header of HTTPS responses.
+	hstsMaxAge = "max-age=31536000"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type tlsOpts struct {
+	CertPath        string
+	KeyPath         string
+	MinVersion      uint16
+	RedirectAddress string // none if empty
+}
+
+// tlsOptsFromEnv returns the TLS options in the environment, or nil if TLS is not enabled.
+func tlsOptsFromEnv() (*tlsOpts, error) {
+	opts := new(tlsOpts)
+	opts.CertPath = os.Getenv(TLSCertEnv)
+	opts.KeyPath = os.Getenv(TLSKeyEnv)
+	if opts.CertPath == "" && opts.KeyPath == "" {
+		return nil, nil
+	}
+	if opts.CertPath == "" || opts.KeyPath == "" {
+		return nil, fmt.Errorf("both %s and %s must be set to enable TLS", TLSCertEnv, TLSKeyEnv)
+	}
+
+	opts.MinVersion = tls.VersionTLS12
+	if s := os.Getenv(TLSMinVersionEnv); s != "" {
+		var ok bool
+		if opts.MinVersion, ok = tlsVersions[s]; !ok {
+			return nil, fmt.Errorf("unknown TLS version %q in %s", s, TLSMinVersionEnv)
+		}
+	}
+
+	opts.RedirectAddress = os.Getenv(HTTPRedirectAddressEnv)
+
+	return opts, nil
+}
+
+// certReloader serves a certificate, reloading it whenever its files change, so that renewed
+// certificates are picked up without a restart. A pair of files that fails to load is reported
+// and ignored, keeping the certificate that was loaded last.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := new(certReloader)
+	cr.certPath = certPath
+	cr.keyPath = keyPath
+
+	if _, err := cr.Reload(false); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// Reload reloads the certificate if either of its files has been modified since it was last
+// loaded, or regardless if force is set, and reports whether it did.
+func (cr *certReloader) Reload(force bool) (bool, error) {
+	certInfo, err := os.Stat(cr.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(cr.keyPath)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && certInfo.ModTime().Equal(cr.certModTime) && keyInfo.ModTime().Equal(cr.keyModTime)
+	cr.mu.RUnlock()
+	if unchanged && !force {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.certModTime = certInfo.ModTime()
+	cr.keyModTime = keyInfo.ModTime()
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+// GetCertificate is for tls.Config.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// watch is a goroutine! It reloads the certificate every interval if it changed, and on SIGHUP
+// regardless.
+func (cr *certReloader) watch(interval time.Duration) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var reloaded bool
+		var err error
+		select {
+		case <-ticker.C:
+			reloaded, err = cr.Reload(false)
+		case <-hangups:
+			reloaded, err = cr.Reload(true)
+		}
+
+		if err != nil {
+			logger.Error("could not reload the TLS certificate, keeping the previous one", "path", cr.certPath, "err", err)
+		} else if reloaded {
+			logger.Info("reloaded the TLS certificate", "path", cr.certPath)
+		}
+	}
+}
+
+// listenAndServeTLS serves handler over TLS on address, and redirects plain HTTP requests on the
+// redirect address, if any, to it.
+func listenAndServeTLS(address string, handler http.Handler, opts *tlsOpts) error {
+	cr, err := newCertReloader(opts.CertPath, opts.KeyPath)
+	if err != nil {
+		return err
+	}
+	go cr.watch(certReloadInterval)
+
+	if opts.RedirectAddress != "" {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		go func() {
+			logger.Info("redirecting HTTP to HTTPS", "address", opts.RedirectAddress)
+			err := http.ListenAndServe(opts.RedirectAddress, redirectToHTTPS(port))
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("could not redirect HTTP to HTTPS", "err", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     opts.MinVersion,
+			GetCertificate: cr.GetCertificate,
+		},
+	}
+
+	return server.ListenAndServeTLS("", "")
+}
+
+// redirectToHTTPS redirects requests to the same URL over HTTPS, on the given port.
+func redirectToHTTPS(port string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// No port in the Host header.
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for commonName and its key to certPath and
+// keyPath, dated modTime.
+func writeTestCert(t *testing.T, certPath, keyPath, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create a certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal the key: %v", err)
+	}
+
+	for path, block := range map[string]*pem.Block{
+		certPath: {Type: "CERTIFICATE", Bytes: der},
+		keyPath:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err = os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("could not write %s: %v", path, err)
+		}
+		if err = os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("could not date %s: %v", path, err)
+		}
+	}
+}
+
+func commonName(t *testing.T, cr *certReloader) string {
+	cert, _ := cr.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("could not parse the certificate: %v", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	then := time.Now().Add(-time.Hour)
+	writeTestCert(t, certPath, keyPath, "first", then)
+
+	cr, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("could not load the certificate: %v", err)
+	}
+	if name := commonName(t, cr); name != "first" {
+		t.Errorf("expected the first certificate, got %q", name)
+	}
+
+	if reloaded, err := cr.Reload(false); reloaded || err != nil {
+		t.Errorf("expected an unchanged certificate not to be reloaded, got %v, %v", reloaded, err)
+	}
+
+	writeTestCert(t, certPath, keyPath, "renewed", then.Add(time.Minute))
+	if reloaded, err := cr.Reload(false); !reloaded || err != nil {
+		t.Fatalf("expected the renewed certificate to be reloaded, got %v, %v", reloaded, err)
+	}
+	if name := commonName(t, cr); name != "renewed" {
+		t.Errorf("expected the renewed certificate, got %q", name)
+	}
+
+	if err = os.WriteFile(keyPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("could not break the key: %v", err)
+	}
+	if _, err = cr.Reload(true); err == nil {
+		t.Errorf("expected the broken key to fail to load")
+	}
+	if name := commonName(t, cr); name != "renewed" {
+		t.Errorf("expected the previous certificate to stay in use, got %q", name)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		host     string
+		port     string
+		expected string
+	}{
+		{"example.com", "443", "https://example.com/torrents?query=linux"},
+		{"example.com:80", "443", "https://example.com/torrents?query=linux"},
+		{"example.com:8000", "8443", "https://example.com:8443/torrents?query=linux"},
+		{"[::1]:80", "8443", "https://[::1]:8443/torrents?query=linux"},
+		{"[::1]", "443", "https://[::1]/torrents?query=linux"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/torrents?query=linux", nil)
+		r.Host = c.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(c.port)(w, r)
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: expected 301, got %d", c.host, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != c.expected {
+			t.Errorf("%s: expected a redirect to %s, got %s", c.host, c.expected, location)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	handler := securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if hsts := w.Header().Get(HeaderStrictTransportSecurity); hsts != "" {
+		t.Errorf("expected no HSTS over plain HTTP, got %q", hsts)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if hsts := w.Header().Get(HeaderStrictTransportSecurity); hsts == "" {
+		t.Errorf("expected HSTS over HTTPS")
+	}
+}
@@ -0,0 +1,298 @@
+// Package stats is an in-process registry of the state of the crawler, which its components
+// publish to and the status page reads from. Unlike the Prometheus metrics, which are meant to be
+// scraped and aggregated elsewhere, it keeps the recent history needed to show rates directly.
+package stats
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rateWindow is the longest period over which rates are computed, in seconds.
+const rateWindow = 3600
+
+// maxTopErrors is the number of error classes listed in Status.
+const maxTopErrors = 5
+
+// maxTopClients is the number of peer clients listed in Status.
+const maxTopClients = 10
+
+// Default is the registry the crawler publishes to.
+var Default = New()
+
+// MessageCount is the number of DHT messages of a type, or of a query within a type, received
+// during the last stats period.
+type MessageCount struct {
+	Type       string         `json:"type"`
+	Count      int            `json:"count"`
+	Percentage float64        `json:"percentage"` // of all the messages received
+	Queries    []MessageCount `json:"queries,omitempty"`
+}
+
+// ErrorCount is the number of leeches that failed with an error class.
+type ErrorCount struct {
+	Class string `json:"class"`
+	Count uint64 `json:"count"`
+}
+
+// ClientCount is the number of leeches that got as far as the extension handshake with peers of a
+// client, by outcome.
+type ClientCount struct {
+	Client    string `json:"client"`
+	Succeeded uint64 `json:"succeeded"`
+	Failed    uint64 `json:"failed"`
+}
+
+// Sink is the state of the metadata sink: its queue of info hashes waiting for a leech, and what
+// the peers leeched from told about themselves and about us.
+type Sink struct {
+	QueueLength int // info hashes waiting for a leech
+	InFlight    int // info hashes being leeched
+
+	// The info hashes offered to the queue since starting: accepted into it, merged into one queued
+	// already, dropped because it was full, and expired while waiting.
+	Queued, Merged, Dropped, Expired uint64
+
+	Fetches          map[string]uint64 // metadata fetched, by transport
+	EncryptedFetches uint64            // metadata fetched over an encrypted connection
+
+	Clients    []ClientCount
+	ExternalIP net.IP // as reported by most peers; nil if unknown
+}
+
+// Status is a snapshot of the registry.
+type Status struct {
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+
+	// Torrents discovered during the last minute and hour, and since starting.
+	DiscoveredLastMinute uint64 `json:"discoveredLastMinute"`
+	DiscoveredLastHour   uint64 `json:"discoveredLastHour"`
+	DiscoveredTotal      uint64 `json:"discoveredTotal"`
+
+	RoutingTableSize int `json:"routingTableSize"`
+
+	LeechesInFlight  int          `json:"leechesInFlight"`
+	LeechesQueued    int          `json:"leechesQueued"`
+	LeechesSucceeded uint64       `json:"leechesSucceeded"`
+	LeechesFailed    uint64       `json:"leechesFailed"`
+	LeechSuccessRate float64      `json:"leechSuccessRate"` // between 0 and 1
+	TopErrors        []ErrorCount `json:"topErrors"`
+
+	// The info hashes offered to the leech queue since starting, by what became of them.
+	InfoHashesQueued  uint64 `json:"infoHashesQueued"`
+	InfoHashesMerged  uint64 `json:"infoHashesMerged"`
+	InfoHashesDropped uint64 `json:"infoHashesDropped"`
+	InfoHashesExpired uint64 `json:"infoHashesExpired"`
+
+	// Metadata fetched since starting, by transport, and over an encrypted connection.
+	Fetches          map[string]uint64 `json:"fetches"`
+	EncryptedFetches uint64            `json:"encryptedFetches"`
+
+	// TopClients are the clients of the peers leeched from, most frequent first.
+	TopClients []ClientCount `json:"topClients"`
+	// ExternalIP is the IP address that most peers reported seeing us at, if enough of them agree.
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// DHTMessages is the mix of the DHT messages received during the last stats period, most
+	// frequent first.
+	DHTMessages []MessageCount `json:"dhtMessages"`
+
+	// Messages sent and read by the DHT transport since starting, and their rates during the last
+	// stats period.
+	MessagesSent     uint64  `json:"messagesSent"`
+	MessagesRead     uint64  `json:"messagesRead"`
+	MessagesSentRate float64 `json:"messagesSentRate"` // per second
+	MessagesReadRate float64 `json:"messagesReadRate"` // per second
+
+	// DatabaseSize is filled in by whoever has access to the database, in bytes.
+	DatabaseSize int64 `json:"databaseSize"`
+}
+
+// Registry gathers the stats published by the components of the crawler. It is safe for
+// concurrent use.
+type Registry struct {
+	mu sync.Mutex
+	// now is time.Now, but can be replaced by tests.
+	now       func() time.Time
+	startedAt time.Time
+
+	// discoveries[s % rateWindow] counts the discoveries during the second s since the epoch, if
+	// discoverySeconds[s % rateWindow] == s.
+	discoveries      [rateWindow]uint64
+	discoverySeconds [rateWindow]int64
+	discoveredTotal  uint64
+
+	routingTableSizes map[string]int // by the address of the indexing service
+
+	sink func() Sink
+
+	leechesSucceeded uint64
+	leechErrors      map[string]uint64
+
+	dhtMessages []MessageCount
+
+	messagesSent, messagesRead         uint64
+	messagesSentRate, messagesReadRate float64
+}
+
+func New() *Registry {
+	r := new(Registry)
+	r.now = time.Now
+	r.startedAt = r.now()
+	r.routingTableSizes = make(map[string]int)
+	r.leechErrors = make(map[string]uint64)
+	return r
+}
+
+// RecordDiscovery records the discovery of a new torrent.
+func (r *Registry) RecordDiscovery() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	second := r.now().Unix()
+	i := second % rateWindow
+	if r.discoverySeconds[i] != second {
+		r.discoverySeconds[i] = second
+		r.discoveries[i] = 0
+	}
+	r.discoveries[i]++
+	r.discoveredTotal++
+}
+
+// SetRoutingTableSize sets the size of the routing table of the indexing service at address.
+func (r *Registry) SetRoutingTableSize(address string, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routingTableSizes[address] = size
+}
+
+// SetSink sets the function that returns the state of the metadata sink.
+func (r *Registry) SetSink(sink func() Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sink = sink
+}
+
+// RecordLeech records the outcome of a leech: success if errorClass is empty, failure otherwise.
+func (r *Registry) RecordLeech(errorClass string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if errorClass == "" {
+		r.leechesSucceeded++
+	} else {
+		r.leechErrors[errorClass]++
+	}
+}
+
+// SetDHTMessages sets the mix of the DHT messages received during the last stats period.
+func (r *Registry) SetDHTMessages(messages []MessageCount) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dhtMessages = messages
+}
+
+// AddTransport adds the messages that the DHT transport sent and read during the last stats
+// period, which lasted period.
+func (r *Registry) AddTransport(sent, read uint64, period time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messagesSent += sent
+	r.messagesRead += read
+	r.messagesSentRate = float64(sent) / period.Seconds()
+	r.messagesReadRate = float64(read) / period.Seconds()
+}
+
+// Snapshot returns the current stats.
+func (r *Registry) Snapshot() Status {
+	r.mu.Lock()
+	sink := r.sink
+	r.mu.Unlock()
+
+	// The sink is asked outside of the lock, as it has locks of its own.
+	var q Sink
+	if sink != nil {
+		q = sink()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	s := Status{
+		StartedAt:         r.startedAt,
+		UptimeSeconds:     int64(now.Sub(r.startedAt).Seconds()),
+		DiscoveredTotal:   r.discoveredTotal,
+		LeechesQueued:     q.QueueLength,
+		LeechesInFlight:   q.InFlight,
+		LeechesSucceeded:  r.leechesSucceeded,
+		InfoHashesQueued:  q.Queued,
+		InfoHashesMerged:  q.Merged,
+		InfoHashesDropped: q.Dropped,
+		InfoHashesExpired: q.Expired,
+		Fetches:           q.Fetches,
+		EncryptedFetches:  q.EncryptedFetches,
+		DHTMessages:       r.dhtMessages,
+		MessagesSent:      r.messagesSent,
+		MessagesRead:      r.messagesRead,
+		MessagesSentRate:  r.messagesSentRate,
+		MessagesReadRate:  r.messagesReadRate,
+	}
+
+	second := now.Unix()
+	for i, n := range r.discoveries {
+		age := second - r.discoverySeconds[i]
+		if age < 0 || age >= rateWindow {
+			continue
+		}
+		s.DiscoveredLastHour += n
+		if age < 60 {
+			s.DiscoveredLastMinute += n
+		}
+	}
+
+	for _, size := range r.routingTableSizes {
+		s.RoutingTableSize += size
+	}
+
+	s.TopErrors = make([]ErrorCount, 0, len(r.leechErrors))
+	for class, n := range r.leechErrors {
+		s.LeechesFailed += n
+		s.TopErrors = append(s.TopErrors, ErrorCount{class, n})
+	}
+	sort.Slice(s.TopErrors, func(i, j int) bool {
+		if s.TopErrors[i].Count != s.TopErrors[j].Count {
+			return s.TopErrors[i].Count > s.TopErrors[j].Count
+		}
+		return s.TopErrors[i].Class < s.TopErrors[j].Class
+	})
+	if len(s.TopErrors) > maxTopErrors {
+		s.TopErrors = s.TopErrors[:maxTopErrors]
+	}
+
+	s.TopClients = append([]ClientCount{}, q.Clients...)
+	sort.Slice(s.TopClients, func(i, j int) bool {
+		ni := s.TopClients[i].Succeeded + s.TopClients[i].Failed
+		nj := s.TopClients[j].Succeeded + s.TopClients[j].Failed
+		if ni != nj {
+			return ni > nj
+		}
+		return s.TopClients[i].Client < s.TopClients[j].Client
+	})
+	if len(s.TopClients) > maxTopClients {
+		s.TopClients = s.TopClients[:maxTopClients]
+	}
+	if q.ExternalIP != nil {
+		s.ExternalIP = q.ExternalIP.String()
+	}
+
+	if total := s.LeechesSucceeded + s.LeechesFailed; total > 0 {
+		s.LeechSuccessRate = float64(s.LeechesSucceeded) / float64(total)
+	}
+
+	return s
+}
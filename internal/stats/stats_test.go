@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryRates(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := New()
+	r.now = func() time.Time { return now }
+
+	record := func(n int, ago time.Duration) {
+		saved := now
+		now = now.Add(-ago)
+		for i := 0; i < n; i++ {
+			r.RecordDiscovery()
+		}
+		now = saved
+	}
+	record(1, 2*time.Hour)
+	record(2, 30*time.Minute)
+	record(3, 30*time.Second)
+	record(4, 0)
+
+	s := r.Snapshot()
+	if s.DiscoveredLastMinute != 7 {
+		t.Errorf("expected 7 discoveries in the last minute, got %d", s.DiscoveredLastMinute)
+	}
+	if s.DiscoveredLastHour != 9 {
+		t.Errorf("expected 9 discoveries in the last hour, got %d", s.DiscoveredLastHour)
+	}
+	if s.DiscoveredTotal != 10 {
+		t.Errorf("expected 10 discoveries in total, got %d", s.DiscoveredTotal)
+	}
+
+	// A second that comes around again an hour later starts from scratch.
+	now = now.Add(time.Hour)
+	r.RecordDiscovery()
+	if s = r.Snapshot(); s.DiscoveredLastMinute != 1 || s.DiscoveredLastHour != 1 {
+		t.Errorf("expected 1 recent discovery, got %d and %d", s.DiscoveredLastMinute, s.DiscoveredLastHour)
+	}
+}
+
+func TestLeeches(t *testing.T) {
+	r := New()
+	r.SetSink(func() Sink {
+		return Sink{QueueLength: 12, InFlight: 3, Queued: 40, Merged: 30, Dropped: 20, Expired: 10}
+	})
+	for class, n := range map[string]int{"": 4, "timeout": 3, "connect": 2, "a": 1, "b": 1, "c": 1, "d": 1, "e": 1} {
+		for i := 0; i < n; i++ {
+			r.RecordLeech(class)
+		}
+	}
+
+	s := r.Snapshot()
+	if s.LeechesQueued != 12 || s.LeechesInFlight != 3 {
+		t.Errorf("expected 12 queued and 3 in flight, got %d and %d", s.LeechesQueued, s.LeechesInFlight)
+	}
+	if s.InfoHashesQueued != 40 || s.InfoHashesMerged != 30 || s.InfoHashesDropped != 20 || s.InfoHashesExpired != 10 {
+		t.Errorf("expected the queue counters, got %+v", s)
+	}
+	if s.LeechesSucceeded != 4 || s.LeechesFailed != 10 {
+		t.Errorf("expected 4 successes and 10 failures, got %d and %d", s.LeechesSucceeded, s.LeechesFailed)
+	}
+	if s.LeechSuccessRate < 0.285 || s.LeechSuccessRate > 0.286 {
+		t.Errorf("expected a success rate of 4/14, got %f", s.LeechSuccessRate)
+	}
+
+	expected := []ErrorCount{{"timeout", 3}, {"connect", 2}, {"a", 1}, {"b", 1}, {"c", 1}}
+	if len(s.TopErrors) != len(expected) {
+		t.Fatalf("expected the top %d errors, got %v", len(expected), s.TopErrors)
+	}
+	for i := range expected {
+		if s.TopErrors[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, s.TopErrors)
+			break
+		}
+	}
+}
+
+func TestClients(t *testing.T) {
+	r := New()
+	if s := r.Snapshot(); len(s.TopClients) != 0 || s.ExternalIP != "" {
+		t.Errorf("expected no clients nor external IP without a sink, got %v and %q", s.TopClients, s.ExternalIP)
+	}
+
+	sink := Sink{ExternalIP: net.IPv4(203, 0, 113, 1)}
+	for i := 0; i < maxTopClients+2; i++ {
+		sink.Clients = append(sink.Clients, ClientCount{Client: fmt.Sprintf("client%02d", i), Succeeded: uint64(i), Failed: 1})
+	}
+	r.SetSink(func() Sink { return sink })
+
+	s := r.Snapshot()
+	if len(s.TopClients) != maxTopClients || s.TopClients[0].Client != "client11" || s.TopClients[maxTopClients-1].Client != "client02" {
+		t.Errorf("expected the top %d clients, most frequent first, got %v", maxTopClients, s.TopClients)
+	}
+	if s.ExternalIP != "203.0.113.1" {
+		t.Errorf("expected the external IP, got %q", s.ExternalIP)
+	}
+}
+
+func TestTransportAndRoutingTable(t *testing.T) {
+	r := New()
+	r.AddTransport(100, 50, 10*time.Second)
+	r.AddTransport(200, 20, 10*time.Second)
+	r.SetRoutingTableSize("0.0.0.0:0", 10)
+	r.SetRoutingTableSize("0.0.0.0:1", 5)
+	r.SetRoutingTableSize("0.0.0.0:0", 20)
+
+	s := r.Snapshot()
+	if s.MessagesSent != 300 || s.MessagesRead != 70 {
+		t.Errorf("expected 300 sent and 70 read, got %d and %d", s.MessagesSent, s.MessagesRead)
+	}
+	if s.MessagesSentRate != 20 || s.MessagesReadRate != 2 {
+		t.Errorf("expected rates of the last period, got %f and %f", s.MessagesSentRate, s.MessagesReadRate)
+	}
+	if s.RoutingTableSize != 25 {
+		t.Errorf("expected 25 nodes across services, got %d", s.RoutingTableSize)
+	}
+}
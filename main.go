@@ -2,32 +2,217 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/t-richards/magnetico/internal/classifier"
 	"github.com/t-richards/magnetico/internal/crawler"
+	"github.com/t-richards/magnetico/internal/logging"
 	"github.com/t-richards/magnetico/internal/persistence"
+	"github.com/t-richards/magnetico/internal/rules"
 	"github.com/t-richards/magnetico/internal/serve"
 )
 
 const (
 	DatabasePath = "data/magnetico.db"
+	// DatabaseEnv overrides DatabasePath; "memory" keeps the database in memory, for ephemeral runs.
+	DatabaseEnv = "MAGNETICO_DATABASE"
 )
 
+// commands are the maintenance tasks that can be run instead of the crawler and the web interface,
+// e.g. `magnetico backfill-categories`.
+var commands = map[string]func(ctx context.Context, database persistence.Database, args []string) error{
+	"backfill-categories": backfillCategories,
+	"purge-blocked":       purgeBlocked,
+	"migrate":             migrate,
+}
+
 func main() {
+	if err := logging.SetupFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up logging! %v\n", err)
+		os.Exit(1)
+	}
+
+	var command func(context.Context, persistence.Database, []string) error
+	if len(os.Args) > 1 {
+		var ok bool
+		command, ok = commands[os.Args[1]]
+		if !ok {
+			fatal("unknown command", "command", os.Args[1])
+		}
+	}
+
 	// open the database
-	database, err := persistence.NewSqlite3Database(DatabasePath)
+	databaseOpts, err := persistence.OptionsFromEnv()
 	if err != nil {
-		log.Fatalf("Could not open the database %s. %v", DatabasePath, err)
+		fatal("invalid database options", "err", err)
+	}
+	// migrate is the only command that may run against a database whose migrations fail.
+	databaseOpts.SkipMigrations = len(os.Args) > 1 && os.Args[1] == "migrate"
+	databaseDSN := DatabasePath
+	if dsn := os.Getenv(DatabaseEnv); dsn != "" {
+		databaseDSN = dsn
+	}
+	database, err := persistence.Open(databaseDSN, databaseOpts)
+	if err != nil {
+		fatal("could not open the database", "dsn", databaseDSN, "err", err)
 	}
 	defer func() {
 		if err := database.Close(); err != nil {
-			log.Printf("Could not close database! %v", err)
+			slog.Error("could not close the database", "err", err)
 		}
 	}()
 
+	if command != nil {
+		// Interrupting a command cancels the database operation in progress.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := command(ctx, database, os.Args[2:])
+		stop()
+		if err != nil {
+			_ = database.Close()
+			fatal("command failed", "command", os.Args[1], "err", err)
+		}
+		return
+	}
+
 	// launch the web service in the background
 	go serve.Run(database)
 
 	// run the crawler with primary interrupt handling logic
-	crawler.Run(database)
+	if err := crawler.Run(database); err != nil {
+		_ = database.Close()
+		fatal("the crawler failed", "err", err)
+	}
+}
+
+func backfillCategories(ctx context.Context, database persistence.Database, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+
+	n, err := classifier.Backfill(ctx, database, 1000)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("classified torrents", "count", n)
+	return nil
+}
+
+// purgeBlocked deletes the stored torrents that match the rules file given as its argument, or the
+// crawler's one by default.
+func purgeBlocked(ctx context.Context, database persistence.Database, args []string) error {
+	rulesPath := rules.DefaultPath
+	switch len(args) {
+	case 0:
+	case 1:
+		rulesPath = args[0]
+	default:
+		return fmt.Errorf("unexpected arguments %q", args[1:])
+	}
+
+	ruleSet, err := rules.Load(rulesPath)
+	if err != nil {
+		return err
+	}
+
+	n, err := rules.Purge(ctx, database, ruleSet, 1000)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("purged torrents", "count", n)
+	return nil
+}
+
+// migrate shows or changes the migrations applied to the database: `migrate [-dry-run] status`,
+// `migrate [-dry-run] up` or `migrate [-dry-run] down N`, which reverts the last N migrations. With
+// -dry-run, up and down print the SQL they would run instead.
+func migrate(ctx context.Context, database persistence.Database, args []string) error {
+	migrator, ok := database.(persistence.Migrator)
+	if !ok {
+		return errors.New("the database has no migrations")
+	}
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the SQL to run instead of running it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New("expected status, up or down N")
+	}
+
+	var migrations []persistence.Migration
+	var err error
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		return printMigrationStatus(ctx, migrator)
+	case args[0] == "up" && len(args) == 1:
+		migrations, err = migrator.MigrateUp(ctx, *dryRun)
+	case args[0] == "down" && len(args) == 2:
+		n, parseErr := strconv.Atoi(args[1])
+		if parseErr != nil || n < 1 {
+			return fmt.Errorf("expected a positive number of migrations to revert, got %q", args[1])
+		}
+		migrations, err = migrator.MigrateDown(ctx, n, *dryRun)
+	default:
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !*dryRun {
+		slog.Info("migrated the database", "count", len(migrations))
+		return nil
+	}
+	for _, migration := range migrations {
+		sql := migration.Up
+		if args[0] == "down" {
+			sql = migration.Down
+		}
+		fmt.Printf("-- %s\n%s\n", migration.Name, sql)
+	}
+	return nil
+}
+
+func printMigrationStatus(ctx context.Context, migrator persistence.Migrator) error {
+	statuses, err := migrator.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+	for _, status := range statuses {
+		var state string
+		switch {
+		case status.Unknown:
+			state = "unknown"
+		case status.Modified:
+			state = "modified"
+		case status.Applied:
+			state = "applied " + time.Unix(status.AppliedAt, 0).UTC().Format(time.RFC3339)
+		default:
+			state = "pending"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, state)
+	}
+	return w.Flush()
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }